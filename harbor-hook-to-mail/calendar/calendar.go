@@ -0,0 +1,255 @@
+package calendar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const dateLayout = "2006-01-02"
+
+// Calendar 非工作日日历, 节假日不检查构建, 调休上班的日期按工作日检查
+type Calendar struct {
+	// 日期 2006-01-02 -> 名称
+	holidays map[string]string
+	workdays map[string]string
+}
+
+// Entry YAML 日历中的一项, 兼容只写日期的写法:
+//
+//	holidays:
+//	- 2024-05-01
+//	- date: 2024-10-01
+//	  to: 2024-10-07
+//	  name: 国庆节
+//	workdays:
+//	- date: 2024-10-12
+//	  name: 国庆节调休
+type Entry struct {
+	Date string `yaml:"date"`
+	// 可选, 包含 to 当天
+	To   string `yaml:"to"`
+	Name string `yaml:"name"`
+}
+
+func (entry *Entry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		entry.Date = value.Value
+		return nil
+	}
+	type plain Entry
+	return value.Decode((*plain)(entry))
+}
+
+type yamlCalendar struct {
+	Holidays []Entry `yaml:"holidays"`
+	Workdays []Entry `yaml:"workdays"`
+}
+
+// Load 按扩展名读取 .ics 或 .yaml/.yml 日历
+func Load(path string) (*Calendar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calendar: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ics":
+		cal, err := ParseICS(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return cal, nil
+	case ".yaml", ".yml":
+		cal, err := ParseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		return cal, nil
+	default:
+		return nil, fmt.Errorf("unsupported calendar %s, expect .ics, .yaml or .yml", path)
+	}
+}
+
+func newCalendar() *Calendar {
+	return &Calendar{holidays: make(map[string]string), workdays: make(map[string]string)}
+}
+
+// ParseYAML 解析 holidays 和 workdays 列表
+func ParseYAML(data []byte) (*Calendar, error) {
+	var content yamlCalendar
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	cal := newCalendar()
+	for _, entry := range content.Holidays {
+		if err := addEntry(cal.holidays, entry); err != nil {
+			return nil, fmt.Errorf("holidays: %w", err)
+		}
+	}
+	for _, entry := range content.Workdays {
+		if err := addEntry(cal.workdays, entry); err != nil {
+			return nil, fmt.Errorf("workdays: %w", err)
+		}
+	}
+	return cal, nil
+}
+
+func addEntry(days map[string]string, entry Entry) error {
+	from, err := time.ParseInLocation(dateLayout, entry.Date, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid date %q, expect 2006-01-02", entry.Date)
+	}
+	to := from
+	if entry.To != "" {
+		if to, err = time.ParseInLocation(dateLayout, entry.To, time.Local); err != nil {
+			return fmt.Errorf("invalid date %q, expect 2006-01-02", entry.To)
+		}
+		if to.Before(from) {
+			return fmt.Errorf("%s is before %s", entry.To, entry.Date)
+		}
+	}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		days[day.Format(dateLayout)] = entry.Name
+	}
+	return nil
+}
+
+// ParseICS 解析 VEVENT 的 DTSTART, DTEND 和 SUMMARY, 每个事件覆盖的日期都是节假日. 不支持 RRULE, 重复的节假日需要逐年列出
+func ParseICS(data []byte) (*Calendar, error) {
+	cal := newCalendar()
+	var event map[string]icsProperty
+	for _, line := range unfoldICS(data) {
+		name, property := parseICSLine(line)
+		switch {
+		case name == "BEGIN" && property.value == "VEVENT":
+			event = make(map[string]icsProperty)
+		case name == "END" && property.value == "VEVENT":
+			if event == nil {
+				return nil, fmt.Errorf("END:VEVENT without BEGIN:VEVENT")
+			}
+			if err := addICSEvent(cal.holidays, event); err != nil {
+				return nil, err
+			}
+			event = nil
+		case event != nil:
+			event[name] = property
+		}
+	}
+	return cal, nil
+}
+
+type icsProperty struct {
+	// 属性参数, e.g. VALUE=DATE, TZID=Asia/Shanghai
+	params map[string]string
+	value  string
+}
+
+// unfoldICS 合并以空格或 tab 开头的续行
+func unfoldICS(data []byte) []string {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func parseICSLine(line string) (string, icsProperty) {
+	property := icsProperty{params: make(map[string]string)}
+	head, value, _ := strings.Cut(line, ":")
+	property.value = value
+	parts := strings.Split(head, ";")
+	for _, param := range parts[1:] {
+		if key, value, ok := strings.Cut(param, "="); ok {
+			property.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), property
+}
+
+func addICSEvent(days map[string]string, event map[string]icsProperty) error {
+	summary := strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\\`, `\`).Replace(event["SUMMARY"].value)
+	start, isDate, err := parseICSTime(event["DTSTART"])
+	if err != nil {
+		return fmt.Errorf("event %q DTSTART: %w", summary, err)
+	}
+	// 没有 DTEND 的全天事件只有一天, DTEND 不包含在事件中
+	end := start.AddDate(0, 0, 1)
+	if !isDate {
+		end = start.Add(time.Second)
+	}
+	if property, ok := event["DTEND"]; ok {
+		if end, _, err = parseICSTime(property); err != nil {
+			return fmt.Errorf("event %q DTEND: %w", summary, err)
+		}
+	}
+	for day := startOfDay(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+		days[day.Format(dateLayout)] = summary
+	}
+	return nil
+}
+
+// parseICSTime 解析 DATE 或 DATE-TIME, 返回本地时间, 以及是否为全天的 DATE
+func parseICSTime(property icsProperty) (time.Time, bool, error) {
+	value := property.value
+	if value == "" {
+		return time.Time{}, false, fmt.Errorf("missing value")
+	}
+	if property.params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t.Local(), false, err
+	}
+	location := time.Local
+	if tzid := property.params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, location)
+	return t.Local(), false, err
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// Holiday day 是否为节假日, 返回节假日名称. cal 为 nil 时没有节假日
+func (cal *Calendar) Holiday(day time.Time) (string, bool) {
+	if cal == nil {
+		return "", false
+	}
+	name, ok := cal.holidays[day.In(time.Local).Format(dateLayout)]
+	return name, ok
+}
+
+// Workday day 是否为调休上班的日期
+func (cal *Calendar) Workday(day time.Time) bool {
+	if cal == nil {
+		return false
+	}
+	_, ok := cal.workdays[day.In(time.Local).Format(dateLayout)]
+	return ok
+}
+
+// Len 节假日和调休上班的天数
+func (cal *Calendar) Len() (int, int) {
+	if cal == nil {
+		return 0, 0
+	}
+	return len(cal.holidays), len(cal.workdays)
+}
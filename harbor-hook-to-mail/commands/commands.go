@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/exyb/harbor-hook-to-mail/config"
+)
+
+// command 子命令, args 不包含子命令名称
+type command struct {
+	usage string
+	run   func(args []string, stdout io.Writer, stderr io.Writer) error
+}
+
+var commands map[string]command
+
+// 在 init 中注册, 避免 newFlagSet 引用 commands 导致初始化循环
+func init() {
+	commands = map[string]command{
+		"encrypt":         {"encrypt [value]: 使用当前 AES 密钥加密, 没有 value 时从标准输入读取", runEncrypt},
+		"decrypt":         {"decrypt <value>: 解密 enc:v2:, v1 密文或展开 ${ENV} 引用", runDecrypt},
+		"reencrypt":       {"reencrypt [--config path] [--write]: 使用当前密钥重新加密配置中的密文", runReencrypt},
+		"validate-config": {"validate-config [--config path]: 校验配置文件", runValidateConfig},
+		"send-test-mail":  {"send-test-mail --app name [--config path]: 通过应用的所有渠道发送测试通知", runSendTestMail},
+		"replay":          {"replay [--config path] <payload.json>: 同步处理保存的 Harbor webhook 请求, - 表示标准输入", runReplay},
+		"stats":           {"stats [--config path] [--date 2006-01-02] [--server url [--auth header]] [--json]: 打印应用的统计", runStats},
+	}
+}
+
+// errUsage 参数错误, 已打印用法
+var errUsage = errors.New("invalid usage")
+
+// Has 是否为子命令, 不是子命令时启动服务
+func Has(name string) bool {
+	_, ok := commands[name]
+	return ok || name == "help" || name == "-h" || name == "--help"
+}
+
+// Run 执行子命令, 返回进程的退出码
+func Run(args []string, stdout io.Writer, stderr io.Writer) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		Usage(stdout)
+		return 0
+	}
+	if err := cmd.run(args[1:], stdout, stderr); err != nil {
+		if !errors.Is(err, errUsage) && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "%s: %v\n", args[0], err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// Usage 打印所有子命令
+func Usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: harbor-hook-to-mail [command]")
+	fmt.Fprintln(w, "没有子命令时启动 webhook 服务")
+	fmt.Fprintln(w)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+}
+
+// newFlagSet 子命令的参数, 所有读取配置的子命令都支持 --config, 默认与服务相同
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", config.DefaultPath(), "配置文件, 默认为 $HOOK_CONFIG 或当前目录的 config.yaml")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: harbor-hook-to-mail %s\n", commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags, configPath
+}
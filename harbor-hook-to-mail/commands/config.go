@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+)
+
+func runValidateConfig(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, configPath := newFlagSet("validate-config", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := routes.ValidateConfig(cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is valid, %d apps\n", *configPath, len(cfg.Hook.Apps))
+	return nil
+}
+
+func runSendTestMail(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, configPath := newFlagSet("send-test-mail", stderr)
+	app := flags.String("app", "", "hook.apps 中的应用")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *app == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return errUsage
+	}
+	cfg, err := Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := routes.UseConfig(cfg); err != nil {
+		return err
+	}
+	if _, ok := cfg.GetApp(*app); !ok {
+		return fmt.Errorf("app %s is not configured in hook.apps", *app)
+	}
+
+	results, err := handlers.CurrentConfig().SendTestNotice(*app)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(stdout, "%s: failed: %v\n", result.Channel, result.Err)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: sent\n", result.Channel)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d channels failed", failed, len(results))
+	}
+	return nil
+}
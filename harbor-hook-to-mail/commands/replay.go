@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+)
+
+func runReplay(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, configPath := newFlagSet("replay", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUsage
+	}
+
+	var payload []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		payload, err = io.ReadAll(stdin)
+	} else {
+		payload, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := routes.UseConfig(cfg); err != nil {
+		return err
+	}
+	record, replayErr := routes.ReplayEvent(payload)
+	if record != nil {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return replayErr
+}
@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+)
+
+// stdin 测试时替换
+var stdin io.Reader = os.Stdin
+
+func runEncrypt(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, _ := newFlagSet("encrypt", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var plaintext string
+	switch flags.NArg() {
+	case 0:
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		plaintext = strings.TrimRight(line, "\r\n")
+	case 1:
+		plaintext = flags.Arg(0)
+	default:
+		flags.Usage()
+		return errUsage
+	}
+
+	ring, err := GetKeyRing()
+	if err != nil {
+		return err
+	}
+	encrypted, err := ring.EncryptSecret(plaintext)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, encrypted)
+	return nil
+}
+
+func runDecrypt(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, _ := newFlagSet("decrypt", stderr)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUsage
+	}
+	plaintext, err := DecryptPassword(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, plaintext)
+	return nil
+}
+
+func runReencrypt(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, configPath := newFlagSet("reencrypt", stderr)
+	write := flags.Bool("write", false, "写回配置文件, 否则输出到标准输出")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(*configPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	ring, err := GetKeyRing()
+	if err != nil {
+		return err
+	}
+	reencrypted, count, err := ring.ReencryptConfig(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "%d values re-encrypted with key %s\n", count, ring.Primary)
+	if !*write {
+		_, err = stdout.Write(reencrypted)
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	return os.WriteFile(*configPath, reencrypted, info.Mode().Perm())
+}
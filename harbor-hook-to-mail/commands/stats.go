@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+)
+
+// 服务进程持有存储的写锁时, 等待这么久后提示使用 --server
+const storeLockTimeout = 2 * time.Second
+
+func runStats(args []string, stdout io.Writer, stderr io.Writer) error {
+	flags, configPath := newFlagSet("stats", stderr)
+	date := flags.String("date", "", "日期 2006-01-02, 默认当天")
+	server := flags.String("server", "", "通过运行中服务的查询接口获取, e.g. http://localhost:8002")
+	auth := flags.String("auth", "", "查询接口的 Authorization, 默认为配置文件中的 hook.auth.secret")
+	asJSON := flags.Bool("json", false, "输出 JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errUsage
+	}
+	day := time.Now()
+	if *date != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", *date, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid date %q", *date)
+		}
+		day = parsed
+	}
+
+	var hookStats []*routes.HookStats
+	var err error
+	if *server != "" {
+		if *auth == "" {
+			*auth = configAuth(*configPath)
+		}
+		hookStats, err = fetchHookStats(strings.TrimSuffix(*server, "/"), *date, *auth)
+	} else {
+		hookStats, err = readHookStats(*configPath, day)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(hookStats)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "APP\tCALLS\tERRORS\tREJECTED\tDUPLICATES\tDEPRECATED")
+	for _, stats := range hookStats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", stats.Name, stats.Calls, stats.Errors, stats.Rejected, stats.Duplicates, stats.Deprecated)
+	}
+	return w.Flush()
+}
+
+// readHookStats 只读打开 store.path 统计
+func readHookStats(configPath string, day time.Time) ([]*routes.HookStats, error) {
+	cfg, err := Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	s, err := store.OpenReadOnly(cfg.Store.Path, storeLockTimeout)
+	if errors.Is(err, store.ErrLocked) {
+		return nil, fmt.Errorf("%w, use --server when the server is running", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return routes.ListHookStats(s, &cfg.HookConfig, day), nil
+}
+
+// configAuth 配置文件中的 hook.auth.secret, 通过 --server 查询时可以没有配置文件
+func configAuth(configPath string) string {
+	cfg, err := Load(configPath)
+	if err != nil {
+		return ""
+	}
+	secret, err := ResolveSecret(cfg.Hook.Auth.Secret)
+	if err != nil {
+		return ""
+	}
+	return secret
+}
+
+// fetchHookStats 通过 /api/apps 获取统计, 指定日期时逐个应用查询
+func fetchHookStats(server string, date string, auth string) ([]*routes.HookStats, error) {
+	var apps []routes.AppStatus
+	if err := getJSON(server+"/api/apps", auth, &apps); err != nil {
+		return nil, err
+	}
+	hookStats := make([]*routes.HookStats, 0, len(apps))
+	for _, app := range apps {
+		stats := app.Today
+		if date != "" {
+			stats = &routes.AppStats{}
+			if err := getJSON(fmt.Sprintf("%s/api/apps/%s/stats?date=%s", server, url.PathEscape(app.Name), date), auth, stats); err != nil {
+				return nil, err
+			}
+		}
+		if stats != nil && stats.HookStats != nil {
+			hookStats = append(hookStats, stats.HookStats)
+		}
+	}
+	return hookStats, nil
+}
+
+func getJSON(u string, auth string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: %s %s", u, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
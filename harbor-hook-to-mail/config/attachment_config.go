@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ByteSize 字节数, 配置中可以写 512KB, 10MB, 1GB 或直接写字节数
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30}, {"G", 1 << 30},
+	{"MB", 1 << 20}, {"M", 1 << 20},
+	{"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(number * float64(multiplier)), nil
+}
+
+func (size *ByteSize) UnmarshalText(text []byte) error {
+	parsed, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*size = parsed
+	return nil
+}
+
+// Attachment 构建日志附件的处理方式
+type Attachment struct {
+	// 附件大小上限, 超过时 gzip 压缩, 压缩后仍然超过时只保留最后 tail-lines 行, 0 表示不限制
+	MaxSize   ByteSize `yaml:"max-size"`
+	TailLines int      `yaml:"tail-lines"`
+	// 匹配 patterns (正则表达式) 的日志行放入邮件正文, 最多 max-lines 行
+	Excerpt struct {
+		Patterns []string `yaml:"patterns"`
+		MaxLines int      `yaml:"max-lines"`
+	} `yaml:"excerpt"`
+}
+
+// 默认的报错日志匹配规则: 日志级别, Maven/Gradle/Ant 构建失败, JUnit 和 go test 的失败用例
+var defaultExcerptPatterns = []string{
+	`\bERROR\b`,
+	`BUILD FAILED|BUILD FAILURE`,
+	`Tests run:.*(Failures|Errors): [1-9]`,
+	`--- FAIL:`,
+}
+
+// ExcerptPatterns 编译报错日志的匹配规则
+func (attachment *Attachment) ExcerptPatterns() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(attachment.Excerpt.Patterns))
+	for _, pattern := range attachment.Excerpt.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("email.attachment.excerpt.patterns: %w", err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func (attachment *Attachment) Validate() error {
+	if attachment.MaxSize < 0 {
+		return fmt.Errorf("email.attachment.max-size: must not be negative")
+	}
+	if attachment.TailLines < 0 {
+		return fmt.Errorf("email.attachment.tail-lines: must not be negative")
+	}
+	if attachment.Excerpt.MaxLines < 0 {
+		return fmt.Errorf("email.attachment.excerpt.max-lines: must not be negative")
+	}
+	_, err := attachment.ExcerptPatterns()
+	return err
+}
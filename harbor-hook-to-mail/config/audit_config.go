@@ -1,33 +1,203 @@
 package config
 
 import (
-	"io/ioutil"
+	"fmt"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
 )
 
+// Harbor webhook 事件类型
+const (
+	EventPushArtifact      = "PUSH_ARTIFACT"
+	EventDeleteArtifact    = "DELETE_ARTIFACT"
+	EventScanningCompleted = "SCANNING_COMPLETED"
+	EventScanningFailed    = "SCANNING_FAILED"
+	EventQuotaExceed       = "QUOTA_EXCEED"
+	EventQuotaWarning      = "QUOTA_WARNING"
+	EventReplication       = "REPLICATION"
+)
+
+// 定时检查的通知方式
+const (
+	// 每个应用单独发送没有构建或存在报错的通知
+	AuditModePerApp = "per-app"
+	// 所有应用汇总为一封邮件
+	AuditModeDigest = "digest"
+	// 同时发送单独的通知和汇总
+	AuditModeBoth = "both"
+)
+
+// AppConfig hook.apps 中的应用, 兼容只写应用名的写法:
+//
+//	apps:
+//	- "demo-ui"
+//	- name: "demo-app"
+//	  channels: ["email", "dingtalk-ops"]
+//	  events: ["PUSH_ARTIFACT", "SCANNING_COMPLETED"]
+//	  lang: en
+//	  expect:
+//	    weekdays: [mon, tue, wed, thu, fri]
+type AppConfig struct {
+	Name string `yaml:"name"`
+	// 通知渠道名称, 为空时只发送邮件
+	Channels []string `yaml:"channels"`
+	// 处理的事件类型, 为空时只处理 PUSH_ARTIFACT
+	Events []string `yaml:"events"`
+	// 覆盖 email.template 的模板目录和语言
+	TemplateDir string `yaml:"template-dir"`
+	Lang        string `yaml:"lang"`
+	// 什么时候预期有构建, 不满足时发送没有收到构建的通知
+	Expect ExpectConfig `yaml:"expect"`
+}
+
+// EventEnabled 应用是否处理该类型的事件
+func (app AppConfig) EventEnabled(eventType string) bool {
+	if len(app.Events) == 0 {
+		return eventType == EventPushArtifact
+	}
+	for _, event := range app.Events {
+		if strings.EqualFold(event, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *AppConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		app.Name = value.Value
+		return nil
+	}
+	type plain AppConfig
+	return value.Decode((*plain)(app))
+}
+
 type HookConfig struct {
 	Hook struct {
 		ContextPath string `yaml:"context-path"`
-		Audit       struct {
+		// Harbor webhook 的 Auth Header 和来源地址限制
+		Auth struct {
+			Secret     string   `yaml:"secret"`
+			AllowCIDRs []string `yaml:"allow-cidrs"`
+		} `yaml:"auth"`
+		Audit struct {
 			InformTime []string `yaml:"inform-time"`
 			InformCron string   `yaml:"inform-cron"`
+			// per-app, digest, both, 默认 per-app
+			Mode   string `yaml:"mode"`
+			Digest struct {
+				// 所有应用都正常时不发送汇总
+				MuteHealthy bool `yaml:"mute-healthy"`
+			} `yaml:"digest"`
 		} `yaml:"audit"`
-		Apps []string `yaml:"apps"`
+		// 节假日日历, 节假日不发送没有收到构建的通知
+		Calendar struct {
+			// .ics 或 .yaml 文件
+			File string `yaml:"file"`
+		} `yaml:"calendar"`
+		// 同一个 tag 的重复和过期事件的检查窗口
+		Dedup struct {
+			TTL time.Duration `yaml:"ttl"`
+		} `yaml:"dedup"`
+		// 构建镜像的匹配规则, 按顺序使用第一个匹配的规则, 未配置时只处理 build-hook 项目
+		Match []MatchRule `yaml:"match"`
+		Apps  []AppConfig `yaml:"apps"`
 	} `yaml:"hook"`
 }
 
-func LoadHookConfig(path string) (*HookConfig, error) {
-	hookConfig := &HookConfig{}
-	hookConfig.Hook.ContextPath = "/hook"
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return hookConfig, err
+// GetApp 按名称查找 hook.apps 中的应用
+func (config *HookConfig) GetApp(name string) (AppConfig, bool) {
+	for _, app := range config.Hook.Apps {
+		if app.Name == name {
+			return app, true
+		}
 	}
+	return AppConfig{Name: name}, false
+}
+
+func (config *HookConfig) defaults() {
+	config.Hook.ContextPath = "/hook"
+	config.Hook.Dedup.TTL = 24 * time.Hour
+	config.Hook.Audit.Mode = AuditModePerApp
+}
 
-	if err := yaml.Unmarshal(data, hookConfig); err != nil {
-		return hookConfig, err
+var eventTypes = []string{EventPushArtifact, EventDeleteArtifact, EventScanningCompleted, EventScanningFailed, EventQuotaExceed, EventQuotaWarning, EventReplication}
+
+// Validate 检查应用, 认证, 去重和定时检查配置
+func (config *HookConfig) Validate() error {
+	hook := &config.Hook
+	if !strings.HasPrefix(hook.ContextPath, "/") {
+		return fmt.Errorf("hook.context-path: must start with /")
+	}
+
+	names := make(map[string]bool)
+	for _, app := range hook.Apps {
+		if app.Name == "" {
+			return fmt.Errorf("hook.apps: app without name")
+		}
+		if names[app.Name] {
+			return fmt.Errorf("hook.apps: duplicate app %s", app.Name)
+		}
+		names[app.Name] = true
+		for _, event := range app.Events {
+			known := false
+			for _, eventType := range eventTypes {
+				known = known || strings.EqualFold(event, eventType)
+			}
+			if !known {
+				return fmt.Errorf("hook.apps: unknown event %q of %s, expect one of %v", event, app.Name, eventTypes)
+			}
+		}
+		if err := app.Expect.Validate(app.Name); err != nil {
+			return err
+		}
+	}
+
+	if _, err := NewArtifactMatcher(hook.Match); err != nil {
+		return err
+	}
+	for i, rule := range hook.Match {
+		for repository, app := range rule.Apps {
+			if app == "" {
+				return fmt.Errorf("hook.match[%d].apps: empty app name for %s", i, repository)
+			}
+		}
+	}
+
+	for _, cidr := range hook.Auth.AllowCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("hook.auth.allow-cidrs: invalid ip or cidr %q", cidr)
+		}
 	}
 
-	return hookConfig, nil
+	if hook.Dedup.TTL < 0 {
+		return fmt.Errorf("hook.dedup.ttl: must not be negative")
+	}
+
+	switch hook.Audit.Mode {
+	case "", AuditModePerApp, AuditModeDigest, AuditModeBoth:
+	default:
+		return fmt.Errorf("hook.audit.mode: unsupported mode %q, expect %s, %s or %s", hook.Audit.Mode, AuditModePerApp, AuditModeDigest, AuditModeBoth)
+	}
+	for _, timeStr := range hook.Audit.InformTime {
+		if _, err := time.ParseInLocation("15:04", timeStr, time.Local); err != nil {
+			return fmt.Errorf("hook.audit.inform-time: invalid time %q, expect HH:MM", timeStr)
+		}
+	}
+	if cronExpr := hook.Audit.InformCron; cronExpr != "" {
+		if _, err := ParseCron(cronExpr); err != nil {
+			return fmt.Errorf("hook.audit.inform-cron: %w", err)
+		}
+	}
+	return nil
+}
+
+// ParseCron 解析带秒的 cron 表达式, 支持 @daily 等描述符
+func ParseCron(expr string) (cron.Schedule, error) {
+	parser := cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+	return parser.Parse(expr)
 }
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 完整的配置文件, 各模块的配置按顶层 key 内嵌, 启动和热加载时由 Load 读取一次
+type Config struct {
+	ServerConfig   `yaml:",inline"`
+	HookConfig     `yaml:",inline"`
+	MailConfig     `yaml:",inline"`
+	NotifyConfig   `yaml:",inline"`
+	RegistryConfig `yaml:",inline"`
+	StoreConfig    `yaml:",inline"`
+	QueueConfig    `yaml:",inline"`
+	OutboxConfig   `yaml:",inline"`
+	LeaderConfig   `yaml:",inline"`
+	WorkConfig     `yaml:",inline"`
+
+	// 配置文件路径
+	Path string `yaml:"-"`
+}
+
+// DefaultPath 默认的配置文件, 优先使用 HOOK_CONFIG, 否则为当前目录的 config.yaml
+func DefaultPath() string {
+	if path := os.Getenv("HOOK_CONFIG"); path != "" {
+		return path
+	}
+	workDir, _ := os.Getwd()
+	return filepath.Join(workDir, "config.yaml")
+}
+
+// Default 所有配置项的默认值
+func Default() *Config {
+	config := &Config{}
+	config.Server.Port = 8002
+	config.HookConfig.defaults()
+	config.MailConfig.defaults()
+	config.StoreConfig.defaults()
+	config.QueueConfig.defaults()
+	config.OutboxConfig.defaults()
+	config.LeaderConfig.defaults()
+	config.WorkConfig.defaults()
+	return config
+}
+
+// Read 读取配置文件并应用 HOOK_ 开头的环境变量, 不校验
+func Read(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	config := Default()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := applyEnv(config); err != nil {
+		return nil, err
+	}
+	config.Path = path
+	return config, nil
+}
+
+// Load 读取并校验配置文件
+func Load(path string) (*Config, error) {
+	config, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Validate 校验所有模块的配置, 返回所有错误
+func (config *Config) Validate() error {
+	errs := make([]error, 0)
+	for _, section := range []interface{ Validate() error }{
+		&config.ServerConfig,
+		&config.HookConfig,
+		&config.MailConfig,
+		&config.NotifyConfig,
+		&config.RegistryConfig,
+		&config.StoreConfig,
+		&config.QueueConfig,
+		&config.OutboxConfig,
+		&config.LeaderConfig,
+		&config.WorkConfig,
+	} {
+		if err := section.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, app := range config.Hook.Apps {
+		for _, name := range app.Channels {
+			if !config.HasChannel(name) {
+				errs = append(errs, fmt.Errorf("hook.apps: app %s uses undefined notify channel %s", app.Name, name))
+			}
+		}
+	}
+	// leader 看到的来源地址是转发的副本, 需要通过 token 信任转发时记录的原始地址
+	if config.LeaderConfig.Enabled() && len(config.Hook.Auth.AllowCIDRs) > 0 && config.Leader.Token == "" {
+		errs = append(errs, fmt.Errorf("leader.token: must not be empty when hook.auth.allow-cidrs is set"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 环境变量覆盖配置项, 名称为 HOOK_ 加上大写的 yaml 路径, - 和 . 替换为 _,
+// e.g. HOOK_EMAIL_SERVER, HOOK_SERVER_PORT, HOOK_HOOK_DEDUP_TTL. 列表用逗号分隔, 不支持 apps, channels 等对象列表
+const envPrefix = "HOOK"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func applyEnv(config *Config) error {
+	return applyEnvValue(reflect.ValueOf(config).Elem(), envPrefix)
+}
+
+func applyEnvValue(value reflect.Value, name string) error {
+	if value.Kind() == reflect.Struct {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			tag := strings.Split(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || tag[0] == "-" {
+				continue
+			}
+			fieldName := name
+			if !(len(tag) > 1 && tag[1] == "inline") {
+				fieldName = name + "_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(tag[0]))
+			}
+			if err := applyEnvValue(value.Field(i), fieldName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	env, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	if err := setEnvValue(value, env); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func setEnvValue(value reflect.Value, env string) error {
+	if unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(env))
+	}
+	switch {
+	case value.Type() == durationType:
+		duration, err := time.ParseDuration(env)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+	case value.Kind() == reflect.String:
+		value.SetString(env)
+	case value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(n))
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		items := make([]string, 0)
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		// 对象列表和 map 只能在配置文件中修改
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
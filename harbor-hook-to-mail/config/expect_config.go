@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/calendar"
+)
+
+// ExpectConfig 应用的构建预期, 没有配置时按 hook.audit 的时间每天检查, 至少收到一次构建:
+//
+//	expect:
+//	  cron: "0 0 12,20 * * *"
+//	  min-builds: 1
+//	  weekdays: [mon, tue, wed, thu, fri]
+type ExpectConfig struct {
+	// 检查时间, 带秒的 cron 表达式, 每次检查统计上一次预期检查之后收到的构建. 为空时按 hook.audit 的时间统计当天的构建
+	Cron string `yaml:"cron"`
+	// 检查窗口内至少收到的构建次数, 默认 1
+	MinBuilds int `yaml:"min-builds"`
+	// 预期有构建的星期, e.g. [mon, tue, wed, thu, fri], 默认每天
+	Weekdays []string `yaml:"weekdays"`
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWeekday 解析星期的英文名称或缩写, 不区分大小写
+func ParseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) >= 3 {
+		if weekday, ok := weekdayNames[name[:3]]; ok && strings.HasPrefix(strings.ToLower(weekday.String()), name) {
+			return weekday, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q, expect mon, tue, wed, thu, fri, sat or sun", name)
+}
+
+// Min 检查窗口内至少收到的构建次数
+func (expect ExpectConfig) Min() int {
+	if expect.MinBuilds <= 0 {
+		return 1
+	}
+	return expect.MinBuilds
+}
+
+// OnWeekday 是否预期在 weekday 有构建
+func (expect ExpectConfig) OnWeekday(weekday time.Weekday) bool {
+	if len(expect.Weekdays) == 0 {
+		return true
+	}
+	for _, name := range expect.Weekdays {
+		if day, err := ParseWeekday(name); err == nil && day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (expect ExpectConfig) Validate(app string) error {
+	if expect.Cron != "" {
+		if _, err := ParseCron(expect.Cron); err != nil {
+			return fmt.Errorf("hook.apps: expect.cron of %s: %w", app, err)
+		}
+	}
+	if expect.MinBuilds < 0 {
+		return fmt.Errorf("hook.apps: expect.min-builds of %s must not be negative", app)
+	}
+	for _, name := range expect.Weekdays {
+		if _, err := ParseWeekday(name); err != nil {
+			return fmt.Errorf("hook.apps: expect.weekdays of %s: %w", app, err)
+		}
+	}
+	return nil
+}
+
+// ExpectedOn 应用在 day 是否预期有构建, 调休上班的日期总是预期有构建, 节假日和 expect.weekdays 之外的日期不预期
+func (app AppConfig) ExpectedOn(day time.Time, cal *calendar.Calendar) bool {
+	if cal.Workday(day) {
+		return true
+	}
+	if _, ok := cal.Holiday(day); ok {
+		return false
+	}
+	return app.Expect.OnWeekday(day.Weekday())
+}
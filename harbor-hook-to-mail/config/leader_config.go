@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// 选主方式
+const (
+	// 单副本, 不选主
+	LeaderNone       = "none"
+	LeaderFile       = "file"
+	LeaderKubernetes = "kubernetes"
+	LeaderRedis      = "redis"
+)
+
+// LeaderConfig 多副本部署时的选主, 只有 leader 打开存储, 处理事件和发送定时检查,
+// 其他副本把 webhook 和查询请求转发给 leader
+type LeaderConfig struct {
+	Leader struct {
+		// none, file, kubernetes, redis, 默认 none
+		Type string `yaml:"type"`
+		// 副本的唯一标识, 默认为主机名
+		ID string `yaml:"id"`
+		// 其他副本转发请求的地址, 默认为 http://<主机名>:<server.port>, k8s 中可以使用 Pod IP
+		Address string `yaml:"address"`
+		// 副本之间转发请求的共享密钥, 配置后 leader 对带有该密钥的转发请求不再检查来源地址
+		Token string `yaml:"token"`
+		// leader 超过 lease-duration 没有续约时其他副本可以接替, 每 retry-period 尝试获取或续约一次
+		LeaseDuration time.Duration `yaml:"lease-duration"`
+		RetryPeriod   time.Duration `yaml:"retry-period"`
+		// 转发请求给 leader 时的 TLS, leader 启用 mTLS 或者使用私有 CA 的证书时需要
+		TLS struct {
+			// 客户端证书, 默认使用 server.tls 的证书
+			CertFile string `yaml:"cert-file"`
+			KeyFile  string `yaml:"key-file"`
+			// 校验 leader 证书的 CA, 系统 CA 和 server.tls.client-ca-file 之外额外信任的
+			CAFile string `yaml:"ca-file"`
+		} `yaml:"tls"`
+		File struct {
+			// 共享存储上的锁文件
+			Path string `yaml:"path"`
+		} `yaml:"file"`
+		Kubernetes struct {
+			// Lease 名称和命名空间, 命名空间默认为 Pod 所在的命名空间
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"kubernetes"`
+		Redis struct {
+			Address  string `yaml:"address"`
+			Password string `yaml:"password"`
+			DB       int    `yaml:"db"`
+			Key      string `yaml:"key"`
+		} `yaml:"redis"`
+	} `yaml:"leader"`
+}
+
+func (config *LeaderConfig) defaults() {
+	config.Leader.Type = LeaderNone
+	config.Leader.LeaseDuration = 15 * time.Second
+	config.Leader.RetryPeriod = 2 * time.Second
+	config.Leader.Kubernetes.Name = "harbor-hook-to-mail"
+	config.Leader.Redis.Key = "harbor-hook-to-mail/leader"
+}
+
+// Enabled 是否需要选主
+func (config *LeaderConfig) Enabled() bool {
+	return config.Leader.Type != "" && config.Leader.Type != LeaderNone
+}
+
+func (config *LeaderConfig) Validate() error {
+	leader := config.Leader
+	switch leader.Type {
+	case "", LeaderNone:
+		return nil
+	case LeaderFile:
+		if leader.File.Path == "" {
+			return fmt.Errorf("leader.file.path: must not be empty")
+		}
+	case LeaderKubernetes:
+		if leader.Kubernetes.Name == "" {
+			return fmt.Errorf("leader.kubernetes.name: must not be empty")
+		}
+	case LeaderRedis:
+		if leader.Redis.Address == "" {
+			return fmt.Errorf("leader.redis.address: must not be empty")
+		}
+		if leader.Redis.Key == "" {
+			return fmt.Errorf("leader.redis.key: must not be empty")
+		}
+	default:
+		return fmt.Errorf("leader.type: unsupported type %q, expect %s, %s, %s or %s", leader.Type, LeaderNone, LeaderFile, LeaderKubernetes, LeaderRedis)
+	}
+	if leader.Address != "" {
+		if u, err := url.Parse(leader.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("leader.address: invalid url %q", leader.Address)
+		}
+	}
+	if (leader.TLS.CertFile == "") != (leader.TLS.KeyFile == "") {
+		return fmt.Errorf("leader.tls: cert-file and key-file must be set together")
+	}
+	if leader.LeaseDuration <= 0 || leader.RetryPeriod <= 0 {
+		return fmt.Errorf("leader.lease-duration and leader.retry-period: must be positive")
+	}
+	if leader.RetryPeriod >= leader.LeaseDuration {
+		return fmt.Errorf("leader.retry-period: must be shorter than lease-duration %s", leader.LeaseDuration)
+	}
+	return nil
+}
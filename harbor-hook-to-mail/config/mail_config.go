@@ -1,42 +1,183 @@
 package config
 
 import (
-	"io/ioutil"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
 
-	"gopkg.in/yaml.v3"
+// 通知结果, 用于按结果选择收件人
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeWarning = "warning"
+	// 截止时间前没有收到构建
+	OutcomeMissing = "missing"
+	// 每天的统计汇总
+	OutcomeSummary = "summary"
 )
 
+var outcomes = []string{OutcomeSuccess, OutcomeFailure, OutcomeWarning, OutcomeMissing, OutcomeSummary}
+
+// MailRoute 按应用和通知结果选择收件人
+type MailRoute struct {
+	// 应用名匹配规则, 支持 * ? [] 通配符, 为空时匹配所有应用
+	Apps []string `yaml:"apps"`
+	// success, failure, warning, missing, summary, 为空时匹配所有结果
+	Outcomes []string `yaml:"outcomes"`
+	Receiver []string `yaml:"receiver"`
+	CC       []string `yaml:"cc"`
+}
+
+func (route *MailRoute) Match(app string, outcome string) bool {
+	return matchAny(route.Apps, app, path.Match) && matchAny(route.Outcomes, outcome, func(pattern, name string) (bool, error) {
+		return strings.EqualFold(pattern, name), nil
+	})
+}
+
+func matchAny(patterns []string, name string, match func(pattern, name string) (bool, error)) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (route *MailRoute) Validate() error {
+	for _, pattern := range route.Apps {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("email.routes: invalid app pattern %q", pattern)
+		}
+	}
+	for _, outcome := range route.Outcomes {
+		known := false
+		for _, name := range outcomes {
+			known = known || strings.EqualFold(outcome, name)
+		}
+		if !known {
+			return fmt.Errorf("email.routes: unknown outcome %q, expect one of %v", outcome, outcomes)
+		}
+	}
+	if len(route.Receiver) == 0 {
+		return fmt.Errorf("email.routes: route for apps %v without receiver", route.Apps)
+	}
+	return nil
+}
+
 type MailConfig struct {
 	Email struct {
+		// 传输方式: smtp (服务器支持时 STARTTLS), plain (明文), starttls, smtps
 		Type   string `yaml:"type"`
 		Server string `yaml:"server"`
 		Port   int    `yaml:"port"`
-		Sender struct {
+		// 认证方式: plain, login, cram-md5, none (不认证, 用于内网中继)
+		Auth string `yaml:"auth"`
+		TLS  struct {
+			// 额外信任的 CA 证书 (PEM)
+			CAFile             string `yaml:"ca-file"`
+			InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+		} `yaml:"tls"`
+		// 连接空闲多久后关闭, 期间的邮件复用同一个连接, 0 表示每封邮件使用新连接
+		KeepAlive time.Duration `yaml:"keep-alive"`
+		// 每条 SMTP 命令的超时时间, 发送邮件内容时按大小延长
+		Timeout time.Duration `yaml:"timeout"`
+		Sender  struct {
+			// 发件人显示名称
+			Name     string `yaml:"name"`
 			Address  string `yaml:"address"`
 			Password string `yaml:"password"`
 		} `yaml:"sender"`
 		Receiver []string `yaml:"receiver"`
 		CC       []string `yaml:"cc"`
-		Body     struct {
+		// 按应用和通知结果选择收件人, 没有匹配的规则时使用 receiver 和 cc
+		Routes []MailRoute `yaml:"routes"`
+		Body   struct {
 			Type    string `yaml:"type"`
 			Subject string `yaml:"subject"`
 			Message string `yaml:"message"`
 		} `yaml:"body"`
 		Attachments []string `yaml:"attachments"`
+		// 构建日志附件的大小限制和报错日志摘录
+		Attachment Attachment `yaml:"attachment"`
+		// 邮件模板目录和语言 (zh/en), 目录中没有的模板使用内置模板
+		Template struct {
+			Dir  string `yaml:"dir"`
+			Lang string `yaml:"lang"`
+		} `yaml:"template"`
 	} `yaml:"email"`
 }
 
+// Recipients 应用某个结果的通知的收件人, 合并所有匹配的规则, 没有匹配时使用默认的 receiver 和 cc
+func (config *MailConfig) Recipients(app string, outcome string) ([]string, []string) {
+	var to, cc []string
+	matched := false
+	for _, route := range config.Email.Routes {
+		if route.Match(app, outcome) {
+			matched = true
+			to = appendUnique(to, route.Receiver...)
+			cc = appendUnique(cc, route.CC...)
+		}
+	}
+	if !matched {
+		return config.Email.Receiver, config.Email.CC
+	}
+	return to, cc
+}
 
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		exists := false
+		for _, item := range list {
+			exists = exists || item == value
+		}
+		if !exists {
+			list = append(list, value)
+		}
+	}
+	return list
+}
 
-func LoadEmailConfig(path string) (*MailConfig, error) {
-	config := &MailConfig{}
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+func (config *MailConfig) defaults() {
+	config.Email.KeepAlive = 30 * time.Second
+	config.Email.Timeout = 30 * time.Second
+	config.Email.Attachment.MaxSize = 10 << 20
+	config.Email.Attachment.TailLines = 5000
+	config.Email.Attachment.Excerpt.Patterns = append([]string{}, defaultExcerptPatterns...)
+	config.Email.Attachment.Excerpt.MaxLines = 50
+}
+
+// Validate 检查邮件服务器, 收件人和附件配置, 传输和认证方式由创建发送实例时检查
+func (config *MailConfig) Validate() error {
+	email := &config.Email
+	if email.Server == "" {
+		return fmt.Errorf("email.server: must not be empty")
+	}
+	if email.Port <= 0 || email.Port > 65535 {
+		return fmt.Errorf("email.port: invalid port %d", email.Port)
+	}
+	if len(email.Receiver) == 0 {
+		return fmt.Errorf("email.receiver: at least one receiver is required")
+	}
+	if email.KeepAlive < 0 {
+		return fmt.Errorf("email.keep-alive: must not be negative")
+	}
+	if email.Timeout <= 0 {
+		return fmt.Errorf("email.timeout: must be positive")
+	}
+	switch strings.ToLower(email.Body.Type) {
+	case "", "html", "text":
+	default:
+		return fmt.Errorf("email.body.type: unsupported type %q, expect html or text", email.Body.Type)
 	}
-	err = yaml.Unmarshal(data, config)
-	if err != nil {
-		return nil, err
+	for _, route := range email.Routes {
+		if err := route.Validate(); err != nil {
+			return err
+		}
 	}
-	return config, nil
+	return email.Attachment.Validate()
 }
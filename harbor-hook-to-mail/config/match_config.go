@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MatchRule 哪些镜像推送是构建事件, 以及如何确定应用:
+//
+//	match:
+//	- project: build-hook
+//	- project: apps
+//	  repository: "team-*/*"
+//	  tag: '^(?P<env>dev|test|prod)-(?P<timestamp>\d{14})$'
+//	  apps:
+//	    team-a/backend: demo-app
+type MatchRule struct {
+	// Harbor 项目和仓库 (不含项目) 的 glob, 与 path.Match 相同, * 不匹配 /, 默认 *
+	Project    string `yaml:"project"`
+	Repository string `yaml:"repository"`
+	// tag 的正则, 为空时匹配所有 tag. 命名分组 app, env, timestamp 分别为应用名, 环境和构建时间
+	Tag string `yaml:"tag"`
+	// timestamp 分组的时间格式, 默认 20060102150405, 按本地时间解析
+	TimestampLayout string `yaml:"timestamp-layout"`
+	// 仓库到应用名的映射, 优先于 tag 中的 app 分组. 都没有时使用仓库名的最后一段
+	Apps map[string]string `yaml:"apps"`
+}
+
+// defaultMatchRules 未配置 hook.match 时只处理 build-hook 项目中的 hook 镜像
+var defaultMatchRules = []MatchRule{{Project: "build-hook"}}
+
+const defaultTimestampLayout = "20060102150405"
+
+// ArtifactMatch 匹配到的构建镜像
+type ArtifactMatch struct {
+	App        string
+	Project    string
+	Repository string
+	Tag        string
+	Env        string
+	// tag 中的构建时间, 没有 timestamp 分组时为零值
+	BuiltAt time.Time
+}
+
+type compiledRule struct {
+	MatchRule
+	tag *regexp.Regexp
+}
+
+// ArtifactMatcher 按顺序使用第一个匹配的规则
+type ArtifactMatcher struct {
+	rules []compiledRule
+}
+
+// NewArtifactMatcher 编译匹配规则, rules 为空时使用默认规则
+func NewArtifactMatcher(rules []MatchRule) (*ArtifactMatcher, error) {
+	if len(rules) == 0 {
+		rules = defaultMatchRules
+	}
+	matcher := &ArtifactMatcher{rules: make([]compiledRule, 0, len(rules))}
+	for i, rule := range rules {
+		for _, pattern := range []string{rule.Project, rule.Repository} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("hook.match[%d]: invalid glob %q", i, pattern)
+			}
+		}
+		compiled := compiledRule{MatchRule: rule}
+		if rule.Tag != "" {
+			tag, err := regexp.Compile(rule.Tag)
+			if err != nil {
+				return nil, fmt.Errorf("hook.match[%d].tag: %w", i, err)
+			}
+			for _, name := range tag.SubexpNames() {
+				switch name {
+				case "", "app", "env", "timestamp":
+				default:
+					return nil, fmt.Errorf("hook.match[%d].tag: unknown group %q, expect app, env or timestamp", i, name)
+				}
+			}
+			compiled.tag = tag
+		}
+		matcher.rules = append(matcher.rules, compiled)
+	}
+	return matcher, nil
+}
+
+// Match 匹配 Harbor 的镜像地址, e.g. harbor.example.com/build-hook/demo-app:test_20240630120000.
+// tag 为空时使用地址中的 tag
+func (matcher *ArtifactMatcher) Match(resourceURL string, tag string) (*ArtifactMatch, bool) {
+	project, repository, urlTag := splitResourceURL(resourceURL)
+	if project == "" || repository == "" {
+		return nil, false
+	}
+	if tag == "" {
+		tag = urlTag
+	}
+	for _, rule := range matcher.rules {
+		if match, ok := rule.match(project, repository, tag); ok {
+			return match, true
+		}
+	}
+	return nil, false
+}
+
+func (rule *compiledRule) match(project string, repository string, tag string) (*ArtifactMatch, bool) {
+	if !globMatch(rule.Project, project) || !globMatch(rule.Repository, repository) {
+		return nil, false
+	}
+	match := &ArtifactMatch{Project: project, Repository: repository, Tag: tag}
+	if rule.tag != nil {
+		groups := rule.tag.FindStringSubmatch(tag)
+		if groups == nil {
+			return nil, false
+		}
+		for i, name := range rule.tag.SubexpNames() {
+			switch name {
+			case "app":
+				match.App = groups[i]
+			case "env":
+				match.Env = groups[i]
+			case "timestamp":
+				layout := rule.TimestampLayout
+				if layout == "" {
+					layout = defaultTimestampLayout
+				}
+				// 时间格式不符时仍然是构建事件, 只是没有构建时间
+				match.BuiltAt, _ = time.ParseInLocation(layout, groups[i], time.Local)
+			}
+		}
+	}
+	if app, ok := rule.Apps[repository]; ok {
+		match.App = app
+	}
+	if match.App == "" {
+		match.App = repository[strings.LastIndex(repository, "/")+1:]
+	}
+	return match, true
+}
+
+func globMatch(pattern string, name string) bool {
+	if pattern == "" {
+		pattern = "*"
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// splitResourceURL 拆分镜像地址中的项目, 仓库 (可以包含 /) 和 tag, 使用 digest 的地址 tag 为空
+func splitResourceURL(resourceURL string) (project string, repository string, tag string) {
+	name := resourceURL
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) < 3 {
+		return "", "", tag
+	}
+	return parts[1], parts[2], tag
+}
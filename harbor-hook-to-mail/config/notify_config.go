@@ -0,0 +1,55 @@
+package config
+
+import "fmt"
+
+// ChannelConfig 通知渠道, type 可选 email, dingtalk, wecom, slack, webhook
+type ChannelConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// 机器人或 webhook 地址
+	URL string `yaml:"url"`
+	// 钉钉机器人加签密钥
+	Secret string `yaml:"secret"`
+	// 通用 webhook 附加的请求头
+	Headers map[string]string `yaml:"headers"`
+	// email 渠道的收件人, 为空时使用 email.receiver 和 email.cc
+	Receiver []string `yaml:"receiver"`
+	CC       []string `yaml:"cc"`
+}
+
+type NotifyConfig struct {
+	Notify struct {
+		Channels []ChannelConfig `yaml:"channels"`
+	} `yaml:"notify"`
+}
+
+// 默认的邮件渠道, 不需要在 notify.channels 中配置
+const DefaultChannel = "email"
+
+// Validate 检查渠道名称, 渠道类型和地址由 notifiers 创建时检查
+func (config *NotifyConfig) Validate() error {
+	names := map[string]bool{DefaultChannel: true}
+	for _, channel := range config.Notify.Channels {
+		if channel.Name == "" {
+			return fmt.Errorf("notify.channels: channel without name")
+		}
+		if channel.Name != DefaultChannel && names[channel.Name] {
+			return fmt.Errorf("notify.channels: duplicate channel %s", channel.Name)
+		}
+		names[channel.Name] = true
+	}
+	return nil
+}
+
+// HasChannel 是否为 email 或 notify.channels 中的渠道
+func (config *NotifyConfig) HasChannel(name string) bool {
+	if name == DefaultChannel {
+		return true
+	}
+	for _, channel := range config.Notify.Channels {
+		if channel.Name == name {
+			return true
+		}
+	}
+	return false
+}
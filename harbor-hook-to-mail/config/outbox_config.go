@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+type OutboxConfig struct {
+	Outbox struct {
+		// 第一次重试的等待时间, 之后每次翻倍, 最长 max-backoff
+		Backoff    time.Duration `yaml:"backoff"`
+		MaxBackoff time.Duration `yaml:"max-backoff"`
+		// 超过 max-age 仍未发送成功的通知标记为失败, 不再重试
+		MaxAge time.Duration `yaml:"max-age"`
+	} `yaml:"outbox"`
+}
+
+func (config *OutboxConfig) defaults() {
+	config.Outbox.Backoff = 30 * time.Second
+	config.Outbox.MaxBackoff = 30 * time.Minute
+	config.Outbox.MaxAge = 24 * time.Hour
+}
+
+func (config *OutboxConfig) Validate() error {
+	if config.Outbox.MaxAge < 0 {
+		return fmt.Errorf("outbox.max-age: must not be negative")
+	}
+	return validateBackoff("outbox", config.Outbox.Backoff, config.Outbox.MaxBackoff)
+}
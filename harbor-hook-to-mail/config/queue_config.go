@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+type QueueConfig struct {
+	Queue struct {
+		// 并发处理的 worker 数量
+		Workers int `yaml:"workers"`
+		// 最多的待处理任务数, 超过时返回 503 让 Harbor 稍后重试
+		Size int `yaml:"size"`
+		// 最多尝试次数, 仍然失败时移入死信列表
+		MaxAttempts int `yaml:"max-attempts"`
+		// 第一次重试的等待时间, 之后每次翻倍, 最长 max-backoff
+		Backoff    time.Duration `yaml:"backoff"`
+		MaxBackoff time.Duration `yaml:"max-backoff"`
+	} `yaml:"queue"`
+}
+
+func (config *QueueConfig) defaults() {
+	config.Queue.Workers = 4
+	config.Queue.Size = 1000
+	config.Queue.MaxAttempts = 5
+	config.Queue.Backoff = 10 * time.Second
+	config.Queue.MaxBackoff = 10 * time.Minute
+}
+
+func (config *QueueConfig) Validate() error {
+	queue := config.Queue
+	if queue.Workers < 1 {
+		return fmt.Errorf("queue.workers: must be at least 1")
+	}
+	if queue.Size < 1 {
+		return fmt.Errorf("queue.size: must be at least 1")
+	}
+	if queue.MaxAttempts < 1 {
+		return fmt.Errorf("queue.max-attempts: must be at least 1")
+	}
+	return validateBackoff("queue", queue.Backoff, queue.MaxBackoff)
+}
+
+func validateBackoff(section string, backoff time.Duration, maxBackoff time.Duration) error {
+	if backoff <= 0 {
+		return fmt.Errorf("%s.backoff: must be positive", section)
+	}
+	if maxBackoff < backoff {
+		return fmt.Errorf("%s.max-backoff: must not be less than backoff %s", section, backoff)
+	}
+	return nil
+}
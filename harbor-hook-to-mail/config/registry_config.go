@@ -1,30 +1,101 @@
 package config
 
 import (
-	"io/ioutil"
-
-	"gopkg.in/yaml.v3"
+	"fmt"
+	"strings"
 )
 
+type RegistryAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// RegistryHost 一个 registry 的连接和凭据, 按 webhook resource_url 中的地址选择
+type RegistryHost struct {
+	// host[:port], 与 resource_url 中的地址一致, e.g. harbor.example.com
+	Host string `yaml:"host"`
+	// http 或 https, 默认 https
+	Scheme string `yaml:"scheme"`
+	// 凭据三选一: 账号密码 (e.g. robot 账号), docker 的 config.json, docker-credential-<name> 凭据助手
+	Auth             RegistryAuth `yaml:"auth"`
+	DockerConfig     string       `yaml:"docker-config"`
+	CredentialHelper string       `yaml:"credential-helper"`
+	TLS              struct {
+		// 额外信任的 CA 证书 (PEM)
+		CAFile             string `yaml:"ca-file"`
+		InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+	} `yaml:"tls"`
+}
+
 type RegistryConfig struct {
+	// 默认的 registry, 只用于 address 相同的地址
 	Registry struct {
 		Address string `yaml:"address"`
-		Auth    struct {
-			Username string `yaml:"username"`
-			Password string `yaml:"password"`
-		} `yaml:"auth"`
+		// http 或 https, 默认 https
+		Scheme string       `yaml:"scheme"`
+		Auth   RegistryAuth `yaml:"auth"`
 	} `yaml:"registry"`
+	// 多个 registry, e.g. 主 Harbor 和灾备 Harbor, 各自的凭据和证书
+	Registries []RegistryHost `yaml:"registries"`
+}
+
+// ForHost 按地址选择 registry, 不区分大小写. 没有匹配时只有 registry.address 使用默认账号,
+// 其他地址匿名访问, 避免把凭据发送给 webhook 中任意的地址
+func (config *RegistryConfig) ForHost(host string) RegistryHost {
+	for _, registry := range config.Registries {
+		if strings.EqualFold(registry.Host, host) {
+			return registry
+		}
+	}
+	registry := RegistryHost{Host: host, Scheme: config.Registry.Scheme}
+	address := config.Registry.Address
+	if _, withoutScheme, ok := strings.Cut(address, "://"); ok {
+		address = withoutScheme
+	}
+	if address != "" && strings.EqualFold(strings.TrimSuffix(address, "/"), host) {
+		registry.Auth = config.Registry.Auth
+	}
+	return registry
+}
+
+func validateScheme(name string, scheme string) error {
+	switch scheme {
+	case "", "http", "https":
+		return nil
+	default:
+		return fmt.Errorf("%s: unsupported scheme %q, expect http or https", name, scheme)
+	}
 }
 
-func LoadRegistryConfig(path string) (*RegistryConfig, error) {
-	config := &RegistryConfig{}
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+func (config *RegistryConfig) Validate() error {
+	if err := validateScheme("registry.scheme", config.Registry.Scheme); err != nil {
+		return err
 	}
-	err = yaml.Unmarshal(data, config)
-	if err != nil {
-		return nil, err
+	hosts := make(map[string]bool)
+	for i, registry := range config.Registries {
+		name := fmt.Sprintf("registries[%d]", i)
+		if registry.Host == "" || strings.Contains(registry.Host, "/") {
+			return fmt.Errorf("%s.host: expect host[:port] without scheme, got %q", name, registry.Host)
+		}
+		if hosts[strings.ToLower(registry.Host)] {
+			return fmt.Errorf("%s.host: duplicate host %s", name, registry.Host)
+		}
+		hosts[strings.ToLower(registry.Host)] = true
+		if err := validateScheme(name+".scheme", registry.Scheme); err != nil {
+			return err
+		}
+		sources := 0
+		for _, configured := range []bool{registry.Auth.Username != "", registry.DockerConfig != "", registry.CredentialHelper != ""} {
+			if configured {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return fmt.Errorf("%s: configure only one of auth, docker-config and credential-helper for %s", name, registry.Host)
+		}
+		if strings.ContainsAny(registry.CredentialHelper, `/\ `) {
+			return fmt.Errorf("%s.credential-helper: expect the helper name, e.g. ecr-login for docker-credential-ecr-login", name)
+		}
 	}
-	return config, nil
+	return nil
 }
@@ -0,0 +1,29 @@
+package config
+
+import "fmt"
+
+type ServerConfig struct {
+	Server struct {
+		Port int `yaml:"port"`
+		// 配置 cert-file 和 key-file 后启用 HTTPS, 配置 client-ca-file 后要求客户端证书
+		TLS struct {
+			CertFile     string `yaml:"cert-file"`
+			KeyFile      string `yaml:"key-file"`
+			ClientCAFile string `yaml:"client-ca-file"`
+		} `yaml:"tls"`
+	} `yaml:"server"`
+}
+
+func (config *ServerConfig) Validate() error {
+	server := config.Server
+	if server.Port <= 0 || server.Port > 65535 {
+		return fmt.Errorf("server.port: invalid port %d", server.Port)
+	}
+	if (server.TLS.CertFile == "") != (server.TLS.KeyFile == "") {
+		return fmt.Errorf("server.tls: cert-file and key-file must be set together")
+	}
+	if server.TLS.ClientCAFile != "" && server.TLS.CertFile == "" {
+		return fmt.Errorf("server.tls.client-ca-file: requires cert-file and key-file")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package config
+
+import "fmt"
+
+type StoreConfig struct {
+	Store struct {
+		// bbolt 数据文件
+		Path string `yaml:"path"`
+		// 记录保留天数, 0 表示不清理
+		RetentionDays int `yaml:"retention-days"`
+	} `yaml:"store"`
+}
+
+func (config *StoreConfig) defaults() {
+	config.Store.Path = "hook.db"
+	config.Store.RetentionDays = 90
+}
+
+func (config *StoreConfig) Validate() error {
+	if config.Store.Path == "" {
+		return fmt.Errorf("store.path: must not be empty")
+	}
+	if config.Store.RetentionDays < 0 {
+		return fmt.Errorf("store.retention-days: must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch 监听配置文件的修改, 返回停止监听的函数.
+// 监听所在目录而不是文件本身, 编辑器替换文件和 k8s ConfigMap 切换 ..data 软链接时都能收到通知
+func Watch(path string, onChange func()) (func(), error) {
+	path = filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	realPath, _ := filepath.EvalSymlinks(path)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentPath, _ := filepath.EvalSymlinks(path)
+				written := filepath.Clean(event.Name) == path && event.Has(fsnotify.Write|fsnotify.Create)
+				// 软链接指向的文件变化
+				relinked := currentPath != "" && currentPath != realPath
+				if !written && !relinked {
+					continue
+				}
+				realPath = currentPath
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[ Config ] Watch %s: %v", path, err)
+			}
+		}
+	}()
+	return func() {
+		watcher.Close()
+		<-done
+	}, nil
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type WorkConfig struct {
+	Work struct {
+		// 从 hook 镜像中取出的文件和压缩后的日志, 每个事件一个子目录
+		Dir string `yaml:"dir"`
+		// 超过 retention 没有修改的事件目录被清理, 0 表示不按时间清理
+		Retention time.Duration `yaml:"retention"`
+		// 目录总大小上限, 超过时从最久没有修改的事件目录开始清理, 0 表示不限制
+		MaxSize ByteSize `yaml:"max-size"`
+		// 清理的检查间隔
+		CleanupInterval time.Duration `yaml:"cleanup-interval"`
+	} `yaml:"work"`
+}
+
+func (config *WorkConfig) defaults() {
+	config.Work.Dir = filepath.Join(os.TempDir(), "harbor-hook-to-mail")
+	config.Work.Retention = 72 * time.Hour
+	config.Work.MaxSize = 1 << 30
+	config.Work.CleanupInterval = 10 * time.Minute
+}
+
+func (config *WorkConfig) Validate() error {
+	work := config.Work
+	if work.Dir == "" {
+		return fmt.Errorf("work.dir: must not be empty")
+	}
+	if work.Retention < 0 {
+		return fmt.Errorf("work.retention: must not be negative")
+	}
+	if work.MaxSize < 0 {
+		return fmt.Errorf("work.max-size: must not be negative")
+	}
+	if work.CleanupInterval <= 0 {
+		return fmt.Errorf("work.cleanup-interval: must be positive")
+	}
+	return nil
+}
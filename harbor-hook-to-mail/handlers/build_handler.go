@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// 旧版本 hook 镜像没有 /build.json, 从 mail.body 中的 "构建结果: SUCCESS" 取出结果
+var mailBodyResultPattern = regexp.MustCompile(`构建结果: ([A-Z_]+)`)
+
+// ParseBuildInfo 解析 /build.json, result 必须存在, 统一为大写
+//
+//	{
+//	  "result": "UNSTABLE",
+//	  "duration": 342,
+//	  "branch": "release/1.2",
+//	  "commit": "9f2c1e7",
+//	  "failed_stage": "Integration Test",
+//	  "url": "https://jenkins.example.com/job/demo-app/128/",
+//	  "tests": {"total": 120, "passed": 117, "failed": 2, "skipped": 1}
+//	}
+func ParseBuildInfo(data []byte) (*store.BuildInfo, error) {
+	info := &store.BuildInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("invalid build.json: %w", err)
+	}
+	info.Result = strings.ToUpper(strings.TrimSpace(info.Result))
+	if info.Result == "" {
+		return nil, fmt.Errorf("invalid build.json: result is required")
+	}
+	if info.Duration < 0 {
+		return nil, fmt.Errorf("invalid build.json: negative duration %d", info.Duration)
+	}
+	return info, nil
+}
+
+// MailBodyResult 从 mail.body 中取出构建结果, 没有时为 UNKNOWN
+func MailBodyResult(mailBody string) string {
+	if matches := mailBodyResultPattern.FindStringSubmatch(mailBody); matches != nil {
+		return matches[1]
+	}
+	return "UNKNOWN"
+}
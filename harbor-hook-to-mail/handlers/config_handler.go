@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+)
+
+// HandlerConfig 处理事件和发送通知使用的配置, 热加载时先完整加载和校验, 再整体替换.
+// 事件处理和通知都是它的方法, 一个事件从头到尾使用同一份配置
+type HandlerConfig struct {
+	Mail *MailConfig
+	// 通知渠道, 密钥已经展开
+	Channels *NotifyConfig
+	Hook     *HookConfig
+	// 已解密密码的 registry 配置
+	Registry *RegistryConfig
+
+	sender *EmailSender
+	// 已创建的通知渠道, 按渠道名称缓存
+	notifiers *sync.Map
+}
+
+// 当前使用的配置, 由 SetHandlerConfig 替换
+var handlerConfig atomic.Pointer[HandlerConfig]
+
+// defaultHandlerConfig 没有加载配置时使用, 没有邮件发送实例
+var defaultHandlerConfig = &HandlerConfig{
+	Mail:      &Default().MailConfig,
+	Channels:  &NotifyConfig{},
+	Hook:      &Default().HookConfig,
+	Registry:  &RegistryConfig{},
+	notifiers: &sync.Map{},
+}
+
+// NewHandlerConfig 按已校验的配置创建通知渠道和邮件发送实例, 解密 registry 密码, 不修改 cfg
+func NewHandlerConfig(cfg *Config) (*HandlerConfig, error) {
+	mail := cfg.MailConfig
+	notify := copyNotifyConfig(&cfg.NotifyConfig)
+	hook := cfg.HookConfig
+	if err := resolveChannelSecrets(notify); err != nil {
+		return nil, err
+	}
+	if err := validateChannels(notify); err != nil {
+		return nil, err
+	}
+	registry, err := DecryptRegistryConfig(cfg.RegistryConfig)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := newMailSender(&mail)
+	if err != nil {
+		return nil, err
+	}
+	return &HandlerConfig{Mail: &mail, Channels: notify, Hook: &hook, Registry: registry, sender: sender, notifiers: &sync.Map{}}, nil
+}
+
+// CurrentConfig 当前使用的配置, 调用方取一次后传给事件处理, 热加载不影响正在处理的事件
+func CurrentConfig() *HandlerConfig {
+	if h := handlerConfig.Load(); h != nil {
+		return h
+	}
+	return defaultHandlerConfig
+}
+
+// mailSender 邮件渠道的发送实例
+func (h *HandlerConfig) mailSender() (*EmailSender, error) {
+	if h.sender == nil {
+		return nil, errors.New("email is not configured")
+	}
+	return h.sender, nil
+}
+
+// copyNotifyConfig 复制渠道配置, 解密后的密钥不写回 cfg
+func copyNotifyConfig(notify *NotifyConfig) *NotifyConfig {
+	copied := &NotifyConfig{}
+	for _, channel := range notify.Notify.Channels {
+		headers := make(map[string]string, len(channel.Headers))
+		for name, value := range channel.Headers {
+			headers[name] = value
+		}
+		channel.Headers = headers
+		copied.Notify.Channels = append(copied.Notify.Channels, channel)
+	}
+	return copied
+}
+
+// validateChannels 创建一次非 email 渠道, 检查渠道类型和地址
+func validateChannels(notify *NotifyConfig) error {
+	for _, channel := range notify.Notify.Channels {
+		if channel.Type == DefaultChannel {
+			continue
+		}
+		if _, err := notifiers.NewNotifier(channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveChannelSecrets 展开渠道地址, 密钥和请求头中的 ${ENV} 引用和 enc:v2: 密文
+func resolveChannelSecrets(notify *NotifyConfig) error {
+	for i := range notify.Notify.Channels {
+		channel := &notify.Notify.Channels[i]
+		var err error
+		if channel.URL, err = ResolveSecret(channel.URL); err != nil {
+			return fmt.Errorf("notify channel %s url: %w", channel.Name, err)
+		}
+		if channel.Secret, err = ResolveSecret(channel.Secret); err != nil {
+			return fmt.Errorf("notify channel %s secret: %w", channel.Name, err)
+		}
+		for name, value := range channel.Headers {
+			if channel.Headers[name], err = ResolveSecret(value); err != nil {
+				return fmt.Errorf("notify channel %s header %s: %w", channel.Name, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetHandlerConfig 替换配置和邮件发送实例, 之后的事件按新配置重新创建通知渠道
+func SetHandlerConfig(h *HandlerConfig) {
+	previous := handlerConfig.Swap(h)
+	if previous != nil && previous.sender != nil && previous.sender != h.sender {
+		// 关闭旧实例复用的连接, 正在发送的邮件发送完成后才会关闭
+		go previous.sender.Close()
+	}
+}
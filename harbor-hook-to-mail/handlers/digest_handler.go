@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"log"
+	"time"
+)
+
+// DigestRow 每日汇总中一个应用的状态
+type DigestRow struct {
+	App string
+	// 当天的构建推送和处理报错次数
+	Calls  int32
+	Errors int32
+	// 最近一次构建
+	LastTag    string
+	LastResult string
+	// 最近一次成功的构建时间, 从未成功时为零值
+	LastSuccess time.Time
+	// 最近连续失败的构建次数
+	FailureStreak int
+	// 节假日或 expect.weekdays 之外的日期, 没有构建不算异常
+	Rest    bool
+	Holiday string
+	// 构建次数不足, 存在报错或最近的构建失败
+	Problem bool
+}
+
+// DigestReport 所有应用的每日汇总
+type DigestReport struct {
+	Rows []DigestRow
+	// 存在问题的应用数量
+	Problems int
+}
+
+// SendDigestNotice 发送每日汇总, 收件人按 summary 结果选择
+func (h *HandlerConfig) SendDigestNotice(data *MailData) error {
+	if err := h.sendStatsNotice(MailKindDigest, data); err != nil {
+		return err
+	}
+
+	log.Printf("Digest notice of %d apps sent successfully!", len(data.Report.Rows))
+	return nil
+}
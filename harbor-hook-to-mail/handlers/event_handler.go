@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+)
+
+// 漏洞等级, 按严重程度从高到低
+var severityOrder = []string{"Critical", "High", "Medium", "Low", "Negligible", "Unknown", "None"}
+
+type ScanSummary struct {
+	Total   int            `json:"total"`
+	Fixable int            `json:"fixable"`
+	Summary map[string]int `json:"summary"`
+}
+
+// ScanReport Harbor 扫描事件中 scan_overview 的单个报告
+type ScanReport struct {
+	ReportID   string       `json:"report_id"`
+	ScanStatus string       `json:"scan_status"`
+	Severity   string       `json:"severity"`
+	Duration   int64        `json:"duration"`
+	Summary    *ScanSummary `json:"summary,omitempty"`
+	StartTime  string       `json:"start_time"`
+	EndTime    string       `json:"end_time"`
+	Scanner    struct {
+		Name    string `json:"name"`
+		Vendor  string `json:"vendor"`
+		Version string `json:"version"`
+	} `json:"scanner"`
+}
+
+type ReplicationResource struct {
+	RegistryName string `json:"registry_name"`
+	RegistryType string `json:"registry_type"`
+	Endpoint     string `json:"endpoint"`
+	Namespace    string `json:"namespace"`
+}
+
+type ReplicationArtifact struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	NameTag string `json:"name_tag"`
+}
+
+// Replication Harbor REPLICATION 事件的 event_data.replication
+type Replication struct {
+	HarborHostname     string                `json:"harbor_hostname"`
+	JobStatus          string                `json:"job_status"`
+	Description        string                `json:"description"`
+	ArtifactType       string                `json:"artifact_type"`
+	TriggerType        string                `json:"trigger_type"`
+	PolicyCreator      string                `json:"policy_creator"`
+	ExecutionTimestamp int64                 `json:"execution_timestamp"`
+	SrcResource        *ReplicationResource  `json:"src_resource,omitempty"`
+	DestResource       *ReplicationResource  `json:"dest_resource,omitempty"`
+	SuccessfulArtifact []ReplicationArtifact `json:"successful_artifact,omitempty"`
+	FailedArtifact     []ReplicationArtifact `json:"failed_artifact,omitempty"`
+}
+
+// ArtifactEvent 从 webhook 请求中整理出的事件信息
+type ArtifactEvent struct {
+	Type        string
+	App         string
+	Namespace   string
+	Repository  string
+	Tag         string
+	Digest      string
+	ResourceURL string
+	Operator    string
+	OccurAt     time.Time
+	// tag 中的环境和构建时间
+	Env     string
+	BuiltAt time.Time
+	// 关联的构建记录
+	RecordID uint64
+}
+
+type SeverityCount struct {
+	Severity string
+	Count    int
+}
+
+// sortedSeverities 按严重程度排序的漏洞数量
+func sortedSeverities(summary map[string]int) []SeverityCount {
+	counts := make([]SeverityCount, 0, len(summary))
+	for severity, count := range summary {
+		counts = append(counts, SeverityCount{Severity: severity, Count: count})
+	}
+	rank := func(severity string) int {
+		for i, s := range severityOrder {
+			if strings.EqualFold(s, severity) {
+				return i
+			}
+		}
+		return len(severityOrder)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return rank(counts[i].Severity) < rank(counts[j].Severity)
+	})
+	return counts
+}
+
+func newEventMailData(event *ArtifactEvent) *MailData {
+	return &MailData{
+		App:         event.App,
+		Time:        event.OccurAt,
+		Namespace:   event.Namespace,
+		Repository:  event.Repository,
+		Tag:         event.Tag,
+		Digest:      event.Digest,
+		ResourceURL: event.ResourceURL,
+		Operator:    event.Operator,
+		Env:         event.Env,
+		BuiltAt:     event.BuiltAt,
+		RecordID:    event.RecordID,
+	}
+}
+
+// sendEventNotice 渲染事件通知并通过应用配置的渠道发送
+func (h *HandlerConfig) sendEventNotice(kind string, data *MailData) error {
+	msg, err := h.RenderMail(kind, data, "html")
+	if err != nil {
+		return err
+	}
+	if err := h.Notify(data.App, msg); err != nil {
+		return err
+	}
+	log.Printf("[ EventHandler ] Notice %q for %s sent successfully", msg.Title, data.App)
+	return nil
+}
+
+// ScanHandler 处理 SCANNING_COMPLETED 和 SCANNING_FAILED 事件
+func (h *HandlerConfig) ScanHandler(event *ArtifactEvent, report *ScanReport) error {
+	data := newEventMailData(event)
+	if report == nil {
+		report = &ScanReport{ScanStatus: "Unknown"}
+	}
+	if report.Summary == nil {
+		report.Summary = &ScanSummary{}
+	}
+	if report.Severity == "" {
+		report.Severity = "None"
+	}
+	data.Scan = report
+	data.Severities = sortedSeverities(report.Summary.Summary)
+
+	kind := strings.ToLower(EventScanningCompleted)
+	if event.Type == EventScanningFailed {
+		kind = strings.ToLower(EventScanningFailed)
+	}
+	return h.sendEventNotice(kind, data)
+}
+
+// DeleteArtifactHandler 处理 DELETE_ARTIFACT 事件
+func (h *HandlerConfig) DeleteArtifactHandler(event *ArtifactEvent) error {
+	return h.sendEventNotice(strings.ToLower(EventDeleteArtifact), newEventMailData(event))
+}
+
+// QuotaHandler 处理 QUOTA_EXCEED 和 QUOTA_WARNING 事件
+func (h *HandlerConfig) QuotaHandler(event *ArtifactEvent, details string) error {
+	data := newEventMailData(event)
+	data.Details = details
+	return h.sendEventNotice(strings.ToLower(event.Type), data)
+}
+
+// ReplicationResult 复制任务失败或者有复制失败的镜像时为 FAILURE, 通知和构建记录使用同一个结果
+func ReplicationResult(replication *Replication) string {
+	if !strings.EqualFold(replication.JobStatus, "Success") || len(replication.FailedArtifact) > 0 {
+		return "FAILURE"
+	}
+	return "SUCCESS"
+}
+
+// ReplicationHandler 处理 REPLICATION 事件, 使用 event 中的应用和时间
+func (h *HandlerConfig) ReplicationHandler(event *ArtifactEvent, replication *Replication) error {
+	return h.sendEventNotice(strings.ToLower(EventReplication), &MailData{
+		App:         event.App,
+		Time:        event.OccurAt,
+		RecordID:    event.RecordID,
+		Result:      ReplicationResult(replication),
+		Replication: replication,
+		Artifacts:   append(append([]ReplicationArtifact{}, replication.FailedArtifact...), replication.SuccessfulArtifact...),
+	})
+}
@@ -2,47 +2,108 @@ package handlers
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/metrics"
+	"github.com/exyb/harbor-hook-to-mail/workdir"
 
 	. "github.com/exyb/harbor-hook-to-mail/utils"
 )
 
-func ImageHandler(namespace string, name string, tag string, resourceURL string) (string, []string, error) {
-	var attachments []string
-	attachments = make([]string, 0)
-	localBuildLog := filepath.Join("/tmp", namespace, name, tag+".build.log")
-	if err := GetFileFromImage(resourceURL, "/build.log", localBuildLog); err != nil {
-		return "", nil, err
-	}
-	attachments = append(attachments, localBuildLog)
+// HookFiles 从 hook 镜像中取出的文件, 镜像中没有的可选文件为空
+type HookFiles struct {
+	MailBody  string
+	BuildLog  string
+	GitCommit string
+	// 可选的构建信息, 有 /build.json 时可以没有 /mail.body
+	BuildJSON string
+}
 
-	localCommitLog := filepath.Join("/tmp", namespace, name, tag+".git_commit.txt")
-	if err := GetFileFromImage(resourceURL, "/git_commit.txt", localCommitLog); err != nil {
-		return "", nil, err
-	}
-	attachments = append(attachments, localCommitLog)
+// Attachments 邮件附件
+func (files *HookFiles) Attachments() []string {
+	return []string{files.BuildLog, files.GitCommit}
+}
 
-	localMailBody := filepath.Join("/tmp", namespace, name, tag+".mail.body")
-	if err := GetFileFromImage(resourceURL, "/mail.body", localMailBody); err != nil {
-		return "", nil, err
+// optional 去掉镜像中可以没有的文件, 返回仍然缺少的文件, /build.json 和 /mail.body 至少要有一个
+func (files *HookFiles) optional(missing []string) []string {
+	required := make([]string, 0, len(missing))
+	for _, file := range missing {
+		switch file {
+		case "/build.json":
+			files.BuildJSON = ""
+		case "/mail.body":
+			files.MailBody = ""
+		default:
+			required = append(required, file)
+		}
 	}
+	if files.BuildJSON == "" && files.MailBody == "" {
+		required = append(required, "/mail.body")
+	}
+	return required
+}
+
+// 取出文件的工作目录, 没有设置时使用系统临时目录
+var workDir atomic.Pointer[workdir.WorkDir]
+
+// SetWorkDir 设置取出文件的工作目录
+func SetWorkDir(w *workdir.WorkDir) {
+	workDir.Store(w)
+}
 
-	return localMailBody, attachments, nil
+func getWorkDir() (*workdir.WorkDir, error) {
+	if w := workDir.Load(); w != nil {
+		return w, nil
+	}
+	w, err := workdir.New(filepath.Join(os.TempDir(), "harbor-hook-to-mail"), workdir.Options{})
+	if err != nil {
+		return nil, err
+	}
+	workDir.CompareAndSwap(nil, w)
+	return workDir.Load(), nil
 }
 
-func GetFileFromImage(imageName string, containerFilePath string, localFilePath string) error {
-	err := PullImage(imageName)
+// ImageHandler 把 hook 镜像中的文件取到事件的目录, recordID 为 0 时 (e.g. replay) 使用新的目录
+func (h *HandlerConfig) ImageHandler(namespace string, name string, tag string, resourceURL string, recordID uint64) (*HookFiles, error) {
+	w, err := getWorkDir()
 	if err != nil {
-		fmt.Println("Failed to pull image:", err)
-		return err
+		return nil, err
+	}
+	dir, err := w.EventDir(namespace, name, tag, recordID)
+	if err != nil {
+		return nil, err
+	}
+	// 附件名保持 <tag>.build.log 等
+	tag = workdir.Sanitize(tag)
+	hookFiles := &HookFiles{
+		MailBody:  filepath.Join(dir, tag+".mail.body"),
+		BuildLog:  filepath.Join(dir, tag+".build.log"),
+		GitCommit: filepath.Join(dir, tag+".git_commit.txt"),
+		BuildJSON: filepath.Join(dir, tag+".build.json"),
 	}
 
-	err = ExtractFileFromImage(imageName, containerFilePath, localFilePath)
+	// 一次遍历镜像各层取出所有文件
+	files := map[string]string{
+		"/build.log":      hookFiles.BuildLog,
+		"/git_commit.txt": hookFiles.GitCommit,
+		"/mail.body":      hookFiles.MailBody,
+		"/build.json":     hookFiles.BuildJSON,
+	}
+	start := time.Now()
+	missing, err := ExtractFilesFromImage(h.Registry, resourceURL, files)
+	metrics.ObserveSince(metrics.ImageExtractSeconds.WithLabelValues(name, metrics.Result(err)), start)
 	if err != nil {
-		fmt.Println("Failed to extract file from image:", err)
-		return err
+		fmt.Println("Failed to extract files from image:", err)
+		return nil, err
+	}
+	missing = hookFiles.optional(missing)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("files %v not found in image %s", missing, resourceURL)
 	}
 
-	fmt.Println("File extracted successfully")
-	return nil
+	fmt.Println("Files extracted successfully")
+	return hookFiles, nil
 }
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+)
+
+// 摘录中单行日志的最大长度, 避免压缩后的 js 或 base64 内容撑大邮件正文
+const maxExcerptLineLength = 500
+
+// BuildLog 处理后的构建日志附件
+type BuildLog struct {
+	// 附件路径, 压缩后为 .gz 文件
+	Path       string
+	Compressed bool
+	// 截断时的总行数和保留的行数
+	Truncated bool
+	Lines     int
+	Kept      int
+	// 匹配报错规则的日志行
+	Excerpt []string
+}
+
+// PrepareBuildLog 摘录报错日志, 日志超过 max-size 时压缩, 压缩后仍然超过时只保留最后 tail-lines 行
+func PrepareBuildLog(path string, attachment Attachment) (*BuildLog, error) {
+	patterns, err := attachment.ExcerptPatterns()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BuildLog{Path: path}
+	excerpt := attachment.Excerpt.MaxLines > 0 && len(patterns) > 0
+	limited := attachment.MaxSize > 0 && info.Size() > int64(attachment.MaxSize)
+	if !excerpt && !limited {
+		return result, nil
+	}
+
+	// 只在需要截断时保留最后 tail-lines 行
+	tailLines := 0
+	if limited {
+		tailLines = attachment.TailLines
+	}
+	tail, err := scanBuildLog(path, patterns, attachment.Excerpt.MaxLines, tailLines, result)
+	if err != nil {
+		return nil, err
+	}
+	if !limited {
+		return result, nil
+	}
+
+	gzPath := path + ".gz"
+	size, err := gzipFile(gzPath, func(w io.Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Path, result.Compressed = gzPath, true
+	if size <= int64(attachment.MaxSize) || attachment.TailLines == 0 {
+		return result, nil
+	}
+
+	// 保留的行数减半直到压缩后不超过上限
+	for kept := len(tail); ; kept /= 2 {
+		lines := tail[len(tail)-kept:]
+		size, err = gzipFile(gzPath, func(w io.Writer) error {
+			if _, err := fmt.Fprintf(w, "... %d lines omitted, last %d lines kept ...\n", result.Lines-kept, kept); err != nil {
+				return err
+			}
+			for _, line := range lines {
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Truncated, result.Kept = true, kept
+		if size <= int64(attachment.MaxSize) || kept <= 1 {
+			return result, nil
+		}
+	}
+}
+
+// scanBuildLog 读取日志, 统计行数, 取出匹配的日志行, 返回最后 tailLines 行 (包含换行符)
+func scanBuildLog(path string, patterns []*regexp.Regexp, maxExcerpt int, tailLines int, result *BuildLog) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tail := make([]string, 0, tailLines)
+	next := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			result.Lines++
+			if len(result.Excerpt) < maxExcerpt && matchAnyPattern(patterns, line) {
+				result.Excerpt = append(result.Excerpt, excerptLine(line))
+			}
+			if tailLines > 0 {
+				// 环形缓冲区
+				if len(tail) < tailLines {
+					tail = append(tail, line)
+				} else {
+					tail[next] = line
+					next = (next + 1) % tailLines
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(tail[next:], tail[:next]...), nil
+}
+
+func matchAnyPattern(patterns []*regexp.Regexp, line string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func excerptLine(line string) string {
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) > maxExcerptLineLength {
+		line = strings.ToValidUTF8(line[:maxExcerptLineLength], "") + " ..."
+	}
+	return line
+}
+
+// gzipFile 将 write 写入的内容压缩到 path, 返回压缩后的大小
+func gzipFile(path string, write func(w io.Writer) error) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	if err := write(gz); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -1,142 +1,160 @@
 package handlers
 
 import (
-	"encoding/base64"
 	"fmt"
+	"html/template"
 	"log"
 	"os"
-	"regexp"
-	"sync"
-	"time"
+	"strings"
 
 	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/store"
 	. "github.com/exyb/harbor-hook-to-mail/utils"
 )
 
-var (
-	mailInstance *EmailSender
-	config       *MailConfig
-	once         sync.Once
-)
-
-func GetMailConfig() *MailConfig {
-	if config != nil {
-		return config
+// newMailSender 解密邮箱密码并创建发送实例, 不修改 config, 不认证时可以不配置密码
+func newMailSender(config *MailConfig) (*EmailSender, error) {
+	password, err := DecryptPassword(config.Email.Sender.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt mail password: %w", err)
 	}
-	configPath := os.Getenv("config_file_path")
-	config, _ = LoadEmailConfig(configPath)
-	return config
+
+	return NewEmailSenderWithOptions(config.Email.Server, config.Email.Port, config.Email.Sender.Address, password, SMTPOptions{
+		Transport:          config.Email.Type,
+		Auth:               config.Email.Auth,
+		Name:               config.Email.Sender.Name,
+		CAFile:             config.Email.TLS.CAFile,
+		InsecureSkipVerify: config.Email.TLS.InsecureSkipVerify,
+		KeepAlive:          config.Email.KeepAlive,
+		Timeout:            config.Email.Timeout,
+	})
 }
 
-func GetMailSender(config *MailConfig) *EmailSender {
-	if mailInstance != nil {
-		return mailInstance
+// readBuildInfo 读取 /build.json 中的构建信息, 旧版本镜像没有时从 mail.body 中取出构建结果
+func readBuildInfo(hookFiles *HookFiles, mailBody []byte) (*store.BuildInfo, error) {
+	if hookFiles.BuildJSON == "" {
+		return &store.BuildInfo{Result: MailBodyResult(string(mailBody))}, nil
+	}
+	data, err := os.ReadFile(hookFiles.BuildJSON)
+	if err != nil {
+		return nil, err
 	}
-	once.Do(func() {
-		// 初始化 instance
+	return ParseBuildInfo(data)
+}
 
-		// Decrypt AES encrypted password
-		encryptedPassword, err := base64.StdEncoding.DecodeString(config.Email.Sender.Password)
+// MailHandler 发送构建详情通知, 返回 /build.json 中的构建信息, 没有时只有 mail.body 中的构建结果
+func (h *HandlerConfig) MailHandler(event *ArtifactEvent, hookFiles *HookFiles) (*store.BuildInfo, error) {
+	var mailBody []byte
+	if hookFiles.MailBody != "" {
+		fmt.Println("Reading mail content from:", hookFiles.MailBody)
+		content, err := os.ReadFile(hookFiles.MailBody)
 		if err != nil {
-			log.Fatalf("Failed to decode mail password from base64: %v", err)
+			fmt.Println("Error reading file:", err)
+			return nil, err
 		}
+		mailBody = content
+	}
+	commit, err := os.ReadFile(hookFiles.GitCommit)
+	if err != nil {
+		fmt.Println("Error reading file:", err)
+		return nil, err
+	}
+	buildInfo, err := readBuildInfo(hookFiles, mailBody)
+	if err != nil {
+		return nil, err
+	}
 
-		decryptedPassword, err := DecryptAES(encryptedPassword)
-		if err != nil {
-			log.Fatalf("Failed to decode mail password: %v", err)
-		}
+	buildLog, err := PrepareBuildLog(hookFiles.BuildLog, h.Mail.Email.Attachment)
+	if err != nil {
+		return buildInfo, fmt.Errorf("failed to prepare build log: %w", err)
+	}
+	if buildLog.Truncated {
+		log.Printf("Build log of %s is too large, keep last %d of %d lines in %s", event.App, buildLog.Kept, buildLog.Lines, buildLog.Path)
+	}
+	hookFiles.BuildLog = buildLog.Path
+
+	data := newEventMailData(event)
+	data.Result = buildInfo.Result
+	data.Log = buildLog
+	data.Commit = strings.TrimSpace(string(commit))
+	data.Body = template.HTML(mailBody)
+	if hookFiles.BuildJSON != "" {
+		data.Build = buildInfo
+	}
 
-		config.Email.Sender.Password = string(decryptedPassword)
+	msg, err := h.RenderMail(MailKindDetail, data, h.Mail.Email.Body.Type)
+	if err != nil {
+		return buildInfo, err
+	}
+	// 发送带附件的邮件
+	msg.Attachments = hookFiles.Attachments()
 
-		mailInstance = NewEmailSender(config.Email.Server, config.Email.Port, config.Email.Sender.Address, config.Email.Sender.Password)
-	})
-	return mailInstance
+	if err := h.Notify(event.App, msg); err != nil {
+		return buildInfo, err
+	}
+	log.Print("Notification sent successfully!")
+	return buildInfo, nil
 }
 
-func MailHandler(appName string, mailBodyFile string, attachments []string) error {
-	// 假设这里有处理逻辑
-	fmt.Println("Reading mail content from:", mailBodyFile)
-	mailBody, err := os.ReadFile(mailBodyFile)
+// sendStatsNotice 发送定时检查的通知, data 中包含当天的统计数据
+func (h *HandlerConfig) sendStatsNotice(kind string, data *MailData) error {
+	msg, err := h.RenderMail(kind, data, "html")
 	if err != nil {
-		fmt.Println("Error reading file:", err)
 		return err
 	}
+	return h.Notify(data.App, msg)
+}
 
-	// 定义正则表达式来匹配 "构建结果: SUCCESS" 或 "构建结果: FAILURE"
-	re := regexp.MustCompile(`构建结果: (SUCCESS|FAILURE)`)
-	// 查找所有匹配项
-	matches := re.FindAllStringSubmatch(string(mailBody), 1)
-	var buildResult string
-	if len(matches) > 0 {
-		if matches[0][1] == "SUCCESS" {
-			buildResult = "成功"
-		} else if matches[0][1] == "FAILURE" {
-			buildResult = "失败"
-		}
-	} else {
-		buildResult = "未知"
+func (h *HandlerConfig) SendWarnNotice(data *MailData) error {
+	// 发送简单文本通知
+	if err := h.sendStatsNotice(MailKindWarn, data); err != nil {
+		return err
 	}
-	config := GetMailConfig()
-	sender := GetMailSender(config)
 
-	// // 发送简单文本邮件
-	// err = sender.SendEmail([]string{config.Email.Receiver.Address}, config.Email.Body.Subject, config.Email.Body.Message)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	// 发送带附件的邮件
-	mailTitle := fmt.Sprintf(config.Email.Body.Subject, appName, time.Now().Format("2006-01-02"), buildResult)
-
-	err = sender.SendEmailWithAttachment(mailTitle, config.Email.Receiver, config.Email.CC, string(mailBody), config.Email.Body.Type, attachments)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Print("Email sent successfully!")
+	log.Printf("Warning notice for %s sent successfully!", data.App)
 	return nil
 }
 
-func SendWarnEmail(appName string) error {
-	config := GetMailConfig()
-
-	sender := GetMailSender(config)
-	mailTitle := fmt.Sprintf("构建警告定时通知 - %s: 应用 %s 成功构建但是存在报错", time.Now().Format("2006-01-02"), appName)
-	// 发送简单文本邮件
-	err := sender.SendEmail(config.Email.Receiver, mailTitle, "")
-	if err != nil {
-		log.Fatal(err)
+func (h *HandlerConfig) SendSuccessNotice(data *MailData) error {
+	// 发送简单文本通知
+	if err := h.sendStatsNotice(MailKindSuccess, data); err != nil {
+		return err
 	}
 
-	log.Printf("Warning email for %s sent successfully!", appName)
+	log.Printf("Success notice for %s sent successfully!\n", data.App)
 	return nil
 }
 
-func SendSuccessEmail(appName string) error {
-	config := GetMailConfig()
-
-	sender := GetMailSender(config)
-	mailTitle := fmt.Sprintf("构建定时通知 - %s: 应用 %s 成功完成构建", time.Now().Format("2006-01-02"), appName)
-	// 发送简单文本邮件
-	err := sender.SendEmail(config.Email.Receiver, mailTitle, "请参考构建环境日志进行详细排查")
-	if err != nil {
-		log.Fatal(err)
+func (h *HandlerConfig) SendFailNotice(data *MailData) error {
+	// 发送简单文本通知
+	if err := h.sendStatsNotice(MailKindFail, data); err != nil {
+		return err
 	}
 
-	log.Printf("Success email for %s sent successfully!\n", appName)
+	log.Printf("Failure notice for %s sent successfully!", data.App)
 	return nil
 }
 
-func SendFailEmail(appName string) error {
-	config := GetMailConfig()
+// ChannelResult 一个渠道的发送结果
+type ChannelResult struct {
+	Channel string
+	Err     error
+}
 
-	sender := GetMailSender(config)
-	mailTitle := fmt.Sprintf("构建失败定时通知 - %s: 应用 %s 没有收到成功构建信息", time.Now().Format("2006-01-02"), appName)
-	// 发送简单文本邮件
-	err := sender.SendEmail(config.Email.Receiver, mailTitle, "请结合前序定时通知邮件和当天首封详情邮件, 并参考构建环境日志进行排查")
+// SendTestNotice 通过应用的每个渠道直接发送测试通知, 不经过 outbox, 返回每个渠道的结果
+func (h *HandlerConfig) SendTestNotice(appName string) ([]ChannelResult, error) {
+	msg, err := h.RenderMail(MailKindTest, &MailData{App: appName, Result: "SUCCESS"}, "html")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	log.Printf("Failure email for %s sent successfully!", appName)
-	return nil
+	msg.App = appName
+	targets := h.Notifiers(appName)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no notify channel available for %s", appName)
+	}
+	results := make([]ChannelResult, 0, len(targets))
+	for _, notifier := range targets {
+		results = append(results, ChannelResult{Channel: notifier.Name(), Err: notifier.Notify(msg)})
+	}
+	return results, nil
 }
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
+)
+
+// getNotifier 按渠道名称获取通知实例, "email" 为默认的邮件渠道
+func (h *HandlerConfig) getNotifier(name string) (notifiers.Notifier, error) {
+	if value, ok := h.notifiers.Load(name); ok {
+		return value.(notifiers.Notifier), nil
+	}
+
+	var notifier notifiers.Notifier
+	if name == DefaultChannel {
+		// 默认渠道按 email.routes 选择收件人
+		sender, err := h.mailSender()
+		if err != nil {
+			return nil, err
+		}
+		notifier = notifiers.NewRoutedEmailNotifier(name, sender, h.Mail.Recipients)
+	} else {
+		channel, ok := h.findChannel(name)
+		if !ok {
+			return nil, fmt.Errorf("notify channel %s is not configured", name)
+		}
+		if channel.Type == DefaultChannel {
+			sender, err := h.mailSender()
+			if err != nil {
+				return nil, err
+			}
+			if len(channel.Receiver) > 0 {
+				notifier = notifiers.NewEmailNotifier(name, sender, channel.Receiver, channel.CC)
+			} else {
+				notifier = notifiers.NewRoutedEmailNotifier(name, sender, h.Mail.Recipients)
+			}
+		} else {
+			var err error
+			if notifier, err = notifiers.NewNotifier(channel); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	value, _ := h.notifiers.LoadOrStore(name, notifier)
+	return value.(notifiers.Notifier), nil
+}
+
+func (h *HandlerConfig) findChannel(name string) (ChannelConfig, bool) {
+	for _, channel := range h.Channels.Notify.Channels {
+		if channel.Name == name {
+			return channel, true
+		}
+	}
+	return ChannelConfig{}, false
+}
+
+// Notifiers 获取应用配置的通知渠道, 没有配置时只发送邮件
+func (h *HandlerConfig) Notifiers(appName string) []notifiers.Notifier {
+	channels := []string{DefaultChannel}
+	if app, ok := h.Hook.GetApp(appName); ok && len(app.Channels) > 0 {
+		channels = app.Channels
+	}
+
+	result := make([]notifiers.Notifier, 0, len(channels))
+	for _, name := range channels {
+		notifier, err := h.getNotifier(name)
+		if err != nil {
+			log.Printf("[ Notify ] Skip channel for %s: %v", appName, err)
+			continue
+		}
+		result = append(result, notifier)
+	}
+	return result
+}
+
+// Notify 通过应用的所有渠道发送通知, 只有全部渠道都失败时才返回错误.
+// 设置了 outbox 时每个渠道保存一条待发送的通知, 由 outbox 在后台发送和重试
+func (h *HandlerConfig) Notify(appName string, msg *notifiers.Message) error {
+	msg.App = appName
+	var errs []error
+	targets := h.Notifiers(appName)
+	mailOutbox := getOutbox()
+	for _, notifier := range targets {
+		if mailOutbox != nil {
+			mail := newOutboxMail(notifier.Name(), msg)
+			if err := mailOutbox.Add(mail); err != nil {
+				log.Printf("[ Notify ] Failed to queue %q via %s for %s: %v", msg.Title, notifier.Name(), appName, err)
+				errs = append(errs, fmt.Errorf("%s: %w", notifier.Name(), err))
+				continue
+			}
+			log.Printf("[ Notify ] Channel %s queued %q for %s as mail %d", notifier.Name(), msg.Title, appName, mail.ID)
+			continue
+		}
+		if err := notifier.Notify(msg); err != nil {
+			log.Printf("[ Notify ] Channel %s failed for %s: %v", notifier.Name(), appName, err)
+			errs = append(errs, fmt.Errorf("%s: %w", notifier.Name(), err))
+			continue
+		}
+		log.Printf("[ Notify ] Channel %s sent %q for %s", notifier.Name(), msg.Title, appName)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no notify channel available for %s", appName)
+	}
+	if len(errs) == len(targets) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
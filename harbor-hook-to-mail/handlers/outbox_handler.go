@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
+	"github.com/exyb/harbor-hook-to-mail/outbox"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// 通知的 outbox, 没有设置时 Notify 直接发送
+var mailOutbox atomic.Pointer[outbox.Outbox]
+
+// SetOutbox 设置通知的 outbox, nil 表示直接发送
+func SetOutbox(o *outbox.Outbox) {
+	mailOutbox.Store(o)
+}
+
+func getOutbox() *outbox.Outbox {
+	return mailOutbox.Load()
+}
+
+func newOutboxMail(channel string, msg *notifiers.Message) *store.Mail {
+	return &store.Mail{
+		App:         msg.App,
+		Channel:     channel,
+		RecordID:    msg.RecordID,
+		Title:       msg.Title,
+		Body:        msg.Body,
+		BodyType:    msg.BodyType,
+		Summary:     msg.Summary,
+		Attachments: msg.Attachments,
+		Outcome:     msg.Outcome,
+	}
+}
+
+// Deliver 通过 mail 保存的渠道发送 outbox 中的通知, outbox 重试时传入当前的配置
+func (h *HandlerConfig) Deliver(mail *store.Mail) error {
+	notifier, err := h.getNotifier(mail.Channel)
+	if err != nil {
+		return err
+	}
+	return notifier.Notify(&notifiers.Message{
+		App:         mail.App,
+		Title:       mail.Title,
+		Body:        mail.Body,
+		BodyType:    mail.BodyType,
+		Summary:     mail.Summary,
+		Attachments: mail.Attachments,
+		Outcome:     mail.Outcome,
+		RecordID:    mail.RecordID,
+	})
+}
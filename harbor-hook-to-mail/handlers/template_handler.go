@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// 通知类型, 对应模板文件 <lang>/<kind>.tmpl, 事件类通知使用小写的事件类型
+const (
+	MailKindDetail  = "detail"
+	MailKindWarn    = "warn"
+	MailKindFail    = "fail"
+	MailKindSuccess = "success"
+	// 所有应用的每日汇总
+	MailKindDigest = "digest"
+	// 命令行 send-test-mail 发送的测试通知
+	MailKindTest = "test"
+
+	defaultLang     = "zh"
+	helpersTemplate = "_helpers.tmpl"
+)
+
+// 内置模板, 每个模板文件定义 subject, summary 和 body 三个子模板
+//
+//go:embed templates/*/*.tmpl
+var embeddedTemplates embed.FS
+
+// MailData 渲染通知模板的数据
+// ExpectWindow 应用构建预期的检查时段, 只在配置了 expect.cron 或 expect.min-builds 时设置
+type ExpectWindow struct {
+	Since     time.Time
+	Until     time.Time
+	MinBuilds int
+}
+
+type MailData struct {
+	Kind string
+	Lang string
+	App  string
+	// 日期 2006-01-02
+	Date string
+	Time time.Time
+
+	Namespace   string
+	Repository  string
+	Tag         string
+	Digest      string
+	ResourceURL string
+	Operator    string
+	// hook.match 中 tag 的环境和构建时间, 没有时为空
+	Env     string
+	BuiltAt time.Time
+
+	// SUCCESS, FAILURE, UNKNOWN 等, 模板中使用 {{ template "result" .Result }} 本地化
+	Result string
+	Commit string
+	// /build.json 中的构建信息, 旧版本镜像为 nil
+	Build *store.BuildInfo
+	// 构建详情邮件的正文 (hook 镜像中的 /mail.body)
+	Body htmltemplate.HTML
+	// 构建日志附件, 包含报错日志摘录, 压缩和截断情况
+	Log *BuildLog
+
+	// 当天的统计数据, 配置了 expect 的应用为检查时段内的统计
+	Calls    int32
+	Errors   int32
+	Rejected int32
+	Window   *ExpectWindow
+
+	Scan        *ScanReport
+	Severities  []SeverityCount
+	Replication *Replication
+	Artifacts   []ReplicationArtifact
+	// 配额事件详情
+	Details string
+
+	// 每日汇总
+	Report *DigestReport
+
+	// 关联的构建记录, 不在模板中使用
+	RecordID uint64
+}
+
+var templateFuncs = map[string]interface{}{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// 秒数格式化为 1h2m3s
+	"seconds": func(seconds int64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+}
+
+// templateSources 模板查找顺序: 应用模板目录, email.template.dir, 内置模板
+func templateSources(lang string, appDir string, globalDir string) []fs.FS {
+	sources := make([]fs.FS, 0, 4)
+	for _, dir := range []string{appDir, globalDir} {
+		if dir != "" {
+			sources = append(sources, os.DirFS(filepath.Join(dir, lang)))
+		}
+	}
+	sources = append(sources, embeddedLang(lang))
+	if lang != defaultLang {
+		sources = append(sources, embeddedLang(defaultLang))
+	}
+	return sources
+}
+
+func embeddedLang(lang string) fs.FS {
+	sub, err := fs.Sub(embeddedTemplates, "templates/"+lang)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// loadMailTemplate 加载通知模板, 同一目录中的 _helpers.tmpl 会覆盖内置的公共模板
+func loadMailTemplate(kind string, lang string, appDir string, globalDir string) (*mailTemplate, error) {
+	name := kind + ".tmpl"
+	for _, source := range templateSources(lang, appDir, globalDir) {
+		content, err := fs.ReadFile(source, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parts := make([]string, 0, 3)
+		for _, helpers := range []fs.FS{embeddedLang(defaultLang), embeddedLang(lang), source} {
+			if data, err := fs.ReadFile(helpers, helpersTemplate); err == nil {
+				parts = append(parts, string(data))
+			}
+		}
+		parts = append(parts, string(content))
+
+		tmpl := &mailTemplate{
+			text: texttemplate.New(kind).Funcs(templateFuncs),
+			html: htmltemplate.New(kind).Funcs(templateFuncs),
+		}
+		for _, part := range parts {
+			if _, err := tmpl.text.Parse(part); err != nil {
+				return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+			}
+			if _, err := tmpl.html.Parse(part); err != nil {
+				return nil, fmt.Errorf("failed to parse template %s: %w", name, err)
+			}
+		}
+		return tmpl, nil
+	}
+	return nil, fmt.Errorf("template %s not found for lang %s", name, lang)
+}
+
+func (tmpl *mailTemplate) executeText(name string, data *MailData) (string, error) {
+	if tmpl.text.Lookup(name) == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func (tmpl *mailTemplate) executeHTML(name string, data *MailData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.html.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// TemplateOptions 模板的目录和语言
+type TemplateOptions struct {
+	Lang   string
+	AppDir string
+	Dir    string
+	// email.body.subject, 只用于构建详情邮件
+	Subject string
+}
+
+// RenderMail 按应用的模板目录和语言渲染通知, bodyType 为 text 时正文不做 html 转义
+func (h *HandlerConfig) RenderMail(kind string, data *MailData, bodyType string) (*notifiers.Message, error) {
+	app, _ := h.Hook.GetApp(data.App)
+	return RenderMailWith(kind, data, bodyType, TemplateOptions{
+		Lang:    firstNonEmpty(app.Lang, h.Mail.Email.Template.Lang),
+		AppDir:  app.TemplateDir,
+		Dir:     h.Mail.Email.Template.Dir,
+		Subject: h.Mail.Email.Body.Subject,
+	})
+}
+
+// RenderMailWith 使用指定的模板目录渲染通知, options.Lang 为空时使用 defaultLang
+func RenderMailWith(kind string, data *MailData, bodyType string, options TemplateOptions) (*notifiers.Message, error) {
+	lang := firstNonEmpty(options.Lang, defaultLang)
+	data.Kind, data.Lang = kind, lang
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+	if data.Date == "" {
+		data.Date = data.Time.Format("2006-01-02")
+	}
+
+	tmpl, err := loadMailTemplate(kind, lang, options.AppDir, options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := tmpl.executeText("subject", data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render subject of %s: %w", kind, err)
+	}
+	if kind == MailKindDetail && options.AppDir == "" && options.Subject != "" {
+		if subject, err = renderConfigSubject(options.Subject, tmpl, data); err != nil {
+			return nil, err
+		}
+	}
+
+	summary, err := tmpl.executeText("summary", data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render summary of %s: %w", kind, err)
+	}
+
+	var body string
+	if strings.EqualFold(bodyType, "text") {
+		body, err = tmpl.executeText("body", data)
+	} else {
+		bodyType = "html"
+		body, err = tmpl.executeHTML("body", data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to render body of %s: %w", kind, err)
+	}
+
+	return &notifiers.Message{
+		App:      data.App,
+		Title:    subject,
+		Body:     body,
+		BodyType: bodyType,
+		Summary:  summary,
+		Outcome:  MailOutcome(kind, data.Result),
+		RecordID: data.RecordID,
+	}, nil
+}
+
+// MailOutcome 通知类型和结果对应的 email.routes 结果
+func MailOutcome(kind string, result string) string {
+	switch kind {
+	case MailKindWarn:
+		return OutcomeWarning
+	case MailKindFail:
+		return OutcomeMissing
+	case MailKindSuccess, MailKindDigest:
+		return OutcomeSummary
+	case "scanning_failed", "quota_exceed":
+		return OutcomeFailure
+	case "quota_warning":
+		return OutcomeWarning
+	}
+	switch result {
+	case "", "SUCCESS":
+		return OutcomeSuccess
+	case "FAILURE":
+		return OutcomeFailure
+	default:
+		return OutcomeWarning
+	}
+}
+
+// renderConfigSubject 兼容 email.body.subject, 包含 {{ 时作为模板, 否则按 app, date, result 格式化
+func renderConfigSubject(subject string, tmpl *mailTemplate, data *MailData) (string, error) {
+	if !strings.Contains(subject, "{{") {
+		var result bytes.Buffer
+		if err := tmpl.text.ExecuteTemplate(&result, "result", data.Result); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(subject, data.App, data.Date, result.String()), nil
+	}
+
+	subjectTmpl, err := tmpl.text.Clone()
+	if err != nil {
+		return "", err
+	}
+	if _, err := subjectTmpl.New("config-subject").Parse(subject); err != nil {
+		return "", fmt.Errorf("failed to parse email.body.subject: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := subjectTmpl.ExecuteTemplate(&buf, "config-subject", data); err != nil {
+		return "", fmt.Errorf("failed to render email.body.subject: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
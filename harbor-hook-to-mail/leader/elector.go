@@ -0,0 +1,171 @@
+package leader
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Record 锁的持有者
+type Record struct {
+	ID string `json:"id"`
+	// 其他副本转发请求的地址
+	Address string `json:"address"`
+}
+
+// Lock 选主使用的锁, 同一时间只有一个副本持有
+type Lock interface {
+	// Acquire 获取或续约锁, ttl 内没有续约时其他副本可以获取. 返回当前的持有者, ID 与 self 相同时表示持有锁, 未知时返回零值
+	Acquire(ctx context.Context, self Record, ttl time.Duration) (Record, error)
+	// Release 释放自己持有的锁, 其他副本不需要等待过期
+	Release(ctx context.Context, self Record) error
+}
+
+type Options struct {
+	LeaseDuration time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Elector 定期获取或续约锁, 成为 leader 和失去 leader 时调用回调
+type Elector struct {
+	lock    Lock
+	self    Record
+	options Options
+	// 成为 leader 时调用, 返回错误时释放锁, 稍后重试
+	OnStartedLeading func() error
+	// 失去 leader 或停止时调用
+	OnStoppedLeading func()
+
+	mutex     sync.RWMutex
+	leader    Record
+	leading   bool
+	lastRenew time.Time
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewElector(lock Lock, self Record, options Options) *Elector {
+	return &Elector{lock: lock, self: self, options: options}
+}
+
+// Start 在后台开始选主
+func (e *Elector) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.done = make(chan struct{})
+	go e.run(ctx)
+}
+
+func (e *Elector) run(ctx context.Context) {
+	defer close(e.done)
+	ticker := time.NewTicker(e.options.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		e.tryAcquire(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) tryAcquire(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.options.RetryPeriod)
+	defer cancel()
+	holder, err := e.lock.Acquire(ctx, e.self, e.options.LeaseDuration)
+	if err != nil {
+		log.Printf("[ Leader ] Failed to acquire lock: %v", err)
+		// 续约失败超过 lease-duration - retry-period 时主动退出, 保证其他副本接替前已经停止
+		if e.IsLeader() && time.Since(e.lastRenew) > e.options.LeaseDuration-e.options.RetryPeriod {
+			log.Printf("[ Leader ] %s lost the lease after %s without renewal", e.self.ID, time.Since(e.lastRenew).Round(time.Second))
+			e.stopLeading()
+		}
+		return
+	}
+
+	e.mutex.Lock()
+	changed := e.leader != holder
+	e.leader = holder
+	e.mutex.Unlock()
+	if changed && holder.ID != "" && holder.ID != e.self.ID {
+		log.Printf("[ Leader ] Current leader is %s (%s)", holder.ID, holder.Address)
+	}
+
+	if holder.ID != e.self.ID {
+		if e.IsLeader() {
+			log.Printf("[ Leader ] %s is no longer the leader", e.self.ID)
+			e.stopLeading()
+		}
+		return
+	}
+	e.lastRenew = time.Now()
+	if e.IsLeader() {
+		return
+	}
+
+	log.Printf("[ Leader ] %s became the leader", e.self.ID)
+	if e.OnStartedLeading != nil {
+		if err := e.OnStartedLeading(); err != nil {
+			log.Printf("[ Leader ] Failed to start leading, release the lock: %v", err)
+			e.release()
+			return
+		}
+	}
+	e.mutex.Lock()
+	e.leading = true
+	e.mutex.Unlock()
+}
+
+func (e *Elector) stopLeading() {
+	e.mutex.Lock()
+	e.leading = false
+	e.mutex.Unlock()
+	if e.OnStoppedLeading != nil {
+		e.OnStoppedLeading()
+	}
+}
+
+func (e *Elector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.options.RetryPeriod)
+	defer cancel()
+	if err := e.lock.Release(ctx, e.self); err != nil {
+		log.Printf("[ Leader ] Failed to release lock: %v", err)
+	}
+	e.mutex.Lock()
+	e.leader = Record{}
+	e.mutex.Unlock()
+}
+
+// Stop 停止选主, 是 leader 时先停止再释放锁
+func (e *Elector) Stop() {
+	if e.cancel == nil {
+		return
+	}
+	e.cancel()
+	<-e.done
+	if e.IsLeader() {
+		e.stopLeading()
+		e.release()
+	}
+}
+
+// IsLeader 是否为 leader, 只有 OnStartedLeading 成功后才是 leader
+func (e *Elector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leading
+}
+
+// Leader 最近一次观察到的 leader, 未知时返回 false
+func (e *Elector) Leader() (Record, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leader, e.leader.ID != ""
+}
+
+// Self 当前副本
+func (e *Elector) Self() Record {
+	return e.self
+}
@@ -0,0 +1,80 @@
+//go:build unix
+
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// FileLock 共享存储上的文件锁, 持有锁的进程退出后锁自动释放, 锁文件中保存持有者的地址
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (l *FileLock) Acquire(ctx context.Context, self Record, ttl time.Duration) (Record, error) {
+	if l.file != nil {
+		return self, nil
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return Record{}, fmt.Errorf("failed to lock %s: %w", l.path, err)
+		}
+		return readHolder(file)
+	}
+
+	data, err := json.Marshal(self)
+	if err == nil {
+		if err = file.Truncate(0); err == nil {
+			if _, err = file.WriteAt(data, 0); err == nil {
+				err = file.Sync()
+			}
+		}
+	}
+	if err != nil {
+		file.Close()
+		return Record{}, fmt.Errorf("failed to write lock file: %w", err)
+	}
+	l.file = file
+	return self, nil
+}
+
+// readHolder 读取其他进程写入的持有者, 正在写入时返回零值
+func readHolder(file *os.File) (Record, error) {
+	var holder Record
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return holder, fmt.Errorf("failed to read lock file: %w", err)
+	}
+	if len(data) > 0 && json.Unmarshal(data, &holder) != nil {
+		return Record{}, nil
+	}
+	return holder, nil
+}
+
+func (l *FileLock) Release(ctx context.Context, self Record) error {
+	if l.file == nil {
+		return nil
+	}
+	file := l.file
+	l.file = nil
+	file.Truncate(0)
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	return file.Close()
+}
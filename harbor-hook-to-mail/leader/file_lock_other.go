@@ -0,0 +1,24 @@
+//go:build !unix
+
+package leader
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// FileLock 依赖 flock, 只支持 unix 系统
+type FileLock struct{}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{}
+}
+
+func (l *FileLock) Acquire(ctx context.Context, self Record, ttl time.Duration) (Record, error) {
+	return Record{}, errors.New("file lock is not supported on this platform")
+}
+
+func (l *FileLock) Release(ctx context.Context, self Record) error {
+	return nil
+}
@@ -0,0 +1,145 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	// Lease 中保存 leader 地址的注解
+	addressAnnotation = "harbor-hook-to-mail/leader-address"
+)
+
+// KubernetesLock 使用 coordination.k8s.io/v1 Lease, 需要 ServiceAccount 有 leases 的 get, create, update 权限
+type KubernetesLock struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+
+	// 按 Lease 的持有者和续约时间是否变化判断过期, 不依赖各节点的时钟一致
+	observed   string
+	observedAt time.Time
+}
+
+// NewKubernetesLock 使用 Pod 的 ServiceAccount 访问 API server, namespace 为空时使用 Pod 所在的命名空间
+func NewKubernetesLock(name string, namespace string) (*KubernetesLock, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("not running in kubernetes: %w", err)
+	}
+	config.Timeout = 10 * time.Second
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	if namespace == "" {
+		data, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	return &KubernetesLock{Client: client, Namespace: namespace, Name: name}, nil
+}
+
+func (l *KubernetesLock) Acquire(ctx context.Context, self Record, ttl time.Duration) (Record, error) {
+	now := time.Now()
+	leases := l.Client.CoordinationV1().Leases(l.Namespace)
+	current, err := leases.Get(ctx, l.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		created := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Name: l.Name, Namespace: l.Namespace}}
+		l.hold(created, self, ttl, now)
+		if _, err := leases.Create(ctx, created, metav1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				// 其他副本同时创建, 下次获取时再判断
+				return Record{}, nil
+			}
+			return Record{}, fmt.Errorf("failed to create lease %s/%s: %w", l.Namespace, l.Name, err)
+		}
+		return self, nil
+	}
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to get lease %s/%s: %w", l.Namespace, l.Name, err)
+	}
+
+	holder := Record{Address: current.Annotations[addressAnnotation]}
+	if current.Spec.HolderIdentity != nil {
+		holder.ID = *current.Spec.HolderIdentity
+	}
+	observed := holder.ID
+	if current.Spec.RenewTime != nil {
+		observed += "@" + current.Spec.RenewTime.UTC().Format(time.RFC3339Nano)
+	}
+	if observed != l.observed {
+		l.observed, l.observedAt = observed, now
+	}
+	var duration time.Duration
+	if current.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*current.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if holder.ID != "" && holder.ID != self.ID && now.Before(l.observedAt.Add(duration)) {
+		return holder, nil
+	}
+
+	if holder.ID != self.ID {
+		transitions := int32(1)
+		if current.Spec.LeaseTransitions != nil {
+			transitions += *current.Spec.LeaseTransitions
+		}
+		current.Spec.LeaseTransitions = &transitions
+		current.Spec.AcquireTime = &metav1.MicroTime{Time: now}
+	}
+	l.hold(current, self, ttl, now)
+	if _, err := leases.Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		if apierrors.IsConflict(err) {
+			// Lease 已被其他副本修改
+			return Record{}, nil
+		}
+		return Record{}, fmt.Errorf("failed to update lease %s/%s: %w", l.Namespace, l.Name, err)
+	}
+	return self, nil
+}
+
+func (l *KubernetesLock) hold(current *coordinationv1.Lease, self Record, ttl time.Duration, now time.Time) {
+	if current.Spec.AcquireTime == nil {
+		current.Spec.AcquireTime = &metav1.MicroTime{Time: now}
+	}
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	current.Spec.HolderIdentity = &self.ID
+	current.Spec.LeaseDurationSeconds = &seconds
+	current.Spec.RenewTime = &metav1.MicroTime{Time: now}
+	if current.Annotations == nil {
+		current.Annotations = make(map[string]string)
+	}
+	current.Annotations[addressAnnotation] = self.Address
+}
+
+func (l *KubernetesLock) Release(ctx context.Context, self Record) error {
+	leases := l.Client.CoordinationV1().Leases(l.Namespace)
+	current, err := leases.Get(ctx, l.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get lease %s/%s: %w", l.Namespace, l.Name, err)
+	}
+	if current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != self.ID {
+		return nil
+	}
+	current.Spec.HolderIdentity = nil
+	delete(current.Annotations, addressAnnotation)
+	if _, err := leases.Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update lease %s/%s: %w", l.Namespace, l.Name, err)
+	}
+	return nil
+}
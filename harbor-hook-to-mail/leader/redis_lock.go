@@ -0,0 +1,66 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 锁不存在或者由自己持有时设置并续约, 返回当前的持有者
+var acquireScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current == false or current == ARGV[1] then
+  redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+  return ARGV[1]
+end
+return current`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+// RedisLock 使用 Redis key 的过期时间作为租约, 值为持有者的 JSON
+type RedisLock struct {
+	Key string
+
+	client *redis.Client
+}
+
+func NewRedisLock(address string, password string, db int, key string) *RedisLock {
+	return &RedisLock{
+		Key:    key,
+		client: redis.NewClient(&redis.Options{Addr: address, Password: password, DB: db}),
+	}
+}
+
+func (l *RedisLock) Acquire(ctx context.Context, self Record, ttl time.Duration) (Record, error) {
+	value, err := json.Marshal(self)
+	if err != nil {
+		return Record{}, err
+	}
+	current, err := acquireScript.Run(ctx, l.client, []string{l.Key}, string(value), ttl.Milliseconds()).Text()
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to acquire redis lock %s: %w", l.Key, err)
+	}
+	var holder Record
+	if err := json.Unmarshal([]byte(current), &holder); err != nil {
+		return Record{}, fmt.Errorf("invalid lock value %q", current)
+	}
+	return holder, nil
+}
+
+func (l *RedisLock) Release(ctx context.Context, self Record) error {
+	value, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	if err := releaseScript.Run(ctx, l.client, []string{l.Key}, string(value)).Err(); err != nil {
+		return fmt.Errorf("failed to release redis lock %s: %w", l.Key, err)
+	}
+	return nil
+}
@@ -1,60 +1,99 @@
 package main
 
 import (
-	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 
+	"github.com/exyb/harbor-hook-to-mail/commands"
+	"github.com/exyb/harbor-hook-to-mail/config"
 	"github.com/exyb/harbor-hook-to-mail/routes"
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 )
 
 func main() {
-	mainDir, _ := os.Getwd()
-	os.Setenv("config_file_path", filepath.Join(mainDir, "config.yaml"))
+	// 子命令用于运维检查和排查问题, 没有子命令时启动服务
+	if len(os.Args) > 1 && commands.Has(os.Args[1]) {
+		os.Exit(commands.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	configPath := flag.String("config", config.DefaultPath(), "配置文件, 默认为 $HOOK_CONFIG 或当前目录的 config.yaml")
+	flag.Parse()
 
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, "work_path", mainDir)
-	ctx = context.WithValue(ctx, "config_file_path", filepath.Join(mainDir, "config.yaml"))
+	// 启动时加载并校验一次, 配置错误直接退出
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("[ Config ] %v", err)
+	}
 
 	// 设置信号处理器
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-signalChan
-		fmt.Println("Received an interrupt, saving map to file...")
-		if err := routes.SaveMapToFile(); err != nil {
-			fmt.Printf("Error saving map to file: %v\n", err)
+		fmt.Println("Received an interrupt, closing store...")
+		if err := routes.Close(); err != nil {
+			fmt.Printf("Error closing store: %v\n", err)
 		}
 		os.Exit(0)
 	}()
 
 	// 处理 web 请求
 	r := gin.Default()
-	routes.SetupRouter(r)
-
-	r.Use(func(c *gin.Context) {
-		c.Set("ctx", ctx)
-		c.Next()
-	})
-
-	config := viper.New()
-	config.SetConfigFile("config.yaml")
-	config.SetConfigType("yaml")
-	if err := config.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			log.Println("config file not found")
-		} else {
-			log.Fatalln(err)
+	routes.SetupRouter(r, cfg)
+
+	// 配置文件修改后重新加载, 校验失败时保留当前配置
+	if _, err := config.Watch(*configPath, func() {
+		log.Printf("[ Config ] %s changed, reloading", *configPath)
+		if err := routes.ReloadConfig(*configPath); err != nil {
+			log.Printf("[ Config ] Rejected invalid config, keep current: %v", err)
 		}
+	}); err != nil {
+		log.Printf("[ Config ] Failed to watch %s, hot reload disabled: %v", *configPath, err)
+	}
+
+	port := fmt.Sprintf(":%d", cfg.Server.Port)
+	if cfg.Server.TLS.CertFile == "" {
+		r.Run(port)
+		return
+	}
+
+	// 启用 TLS, 配置了 client-ca-file 时要求客户端证书 (mTLS)
+	tlsConfig, err := newServerTLSConfig(cfg.Server.TLS.ClientCAFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	server := &http.Server{
+		Addr:      port,
+		Handler:   r,
+		TLSConfig: tlsConfig,
 	}
+	if err := server.ListenAndServeTLS(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile); err != nil {
+		log.Fatalln(err)
+	}
+}
 
-	port := ":" + config.GetString("server.port")
+func newServerTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
 
-	r.Run(port)
+	caData, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificate found in client ca file %s", clientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
 }
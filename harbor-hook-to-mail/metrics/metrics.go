@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "harbor_hook"
+
+var (
+	// HookCalls 收到的构建推送, 包括重复和过期的请求, 与 HookStats.Calls 一致
+	HookCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "calls_total",
+		Help:      "Build hook webhook calls received per app.",
+	}, []string{"app"})
+
+	HookDuplicates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicates_total",
+		Help:      "Duplicate build hook webhook calls (Harbor retries) per app.",
+	}, []string{"app"})
+
+	HookDeprecated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deprecated_total",
+		Help:      "Build hook webhook calls older than the last processed one per app.",
+	}, []string{"app"})
+
+	HookErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "Build hook webhook calls that failed to process per app.",
+	}, []string{"app"})
+
+	HookRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_total",
+		Help:      "Webhook calls rejected by auth or source address checks per app.",
+	}, []string{"app"})
+
+	// ImageExtractSeconds 从 registry 拉取 hook 镜像并取出文件的耗时
+	ImageExtractSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_extract_seconds",
+		Help:      "Time spent pulling hook image layers and extracting files.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"app", "result"})
+
+	// SMTPSendSeconds 发送一封邮件的耗时
+	SMTPSendSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "smtp_send_seconds",
+		Help:      "Time spent sending a mail over SMTP.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"result"})
+)
+
+// Result 耗时指标的 result 标签
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveSince 记录从 start 开始的耗时
+func ObserveSince(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
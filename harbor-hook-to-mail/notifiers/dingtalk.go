@@ -0,0 +1,53 @@
+package notifiers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DingTalkNotifier 钉钉群机器人, 配置了 secret 时使用加签方式
+type DingTalkNotifier struct {
+	name   string
+	url    string
+	secret string
+}
+
+func (n *DingTalkNotifier) Name() string {
+	return n.name
+}
+
+func (n *DingTalkNotifier) Notify(msg *Message) error {
+	payload := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"title": msg.Title,
+			"text":  fmt.Sprintf("### %s\n\n%s", msg.Title, msg.Text()),
+		},
+	}
+	body, err := postJSON(n.signedURL(time.Now()), payload, nil)
+	if err != nil {
+		return err
+	}
+	return checkRobotResponse(body)
+}
+
+func (n *DingTalkNotifier) signedURL(now time.Time) string {
+	if n.secret == "" {
+		return n.url
+	}
+	timestamp := fmt.Sprintf("%d", now.UnixMilli())
+	mac := hmac.New(sha256.New, []byte(n.secret))
+	mac.Write([]byte(timestamp + "\n" + n.secret))
+	sign := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	separator := "?"
+	if strings.Contains(n.url, "?") {
+		separator = "&"
+	}
+	return fmt.Sprintf("%s%stimestamp=%s&sign=%s", n.url, separator, timestamp, sign)
+}
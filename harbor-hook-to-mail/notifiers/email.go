@@ -0,0 +1,51 @@
+package notifiers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/metrics"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+)
+
+// Recipients 按应用和通知结果返回收件人和抄送
+type Recipients func(app string, outcome string) ([]string, []string)
+
+type EmailNotifier struct {
+	name       string
+	sender     *EmailSender
+	recipients Recipients
+}
+
+func NewEmailNotifier(name string, sender *EmailSender, to []string, cc []string) *EmailNotifier {
+	return NewRoutedEmailNotifier(name, sender, func(string, string) ([]string, []string) {
+		return to, cc
+	})
+}
+
+// NewRoutedEmailNotifier 每条通知按 recipients 选择收件人
+func NewRoutedEmailNotifier(name string, sender *EmailSender, recipients Recipients) *EmailNotifier {
+	return &EmailNotifier{name: name, sender: sender, recipients: recipients}
+}
+
+func (n *EmailNotifier) Name() string {
+	return n.name
+}
+
+func (n *EmailNotifier) Notify(msg *Message) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveSince(metrics.SMTPSendSeconds.WithLabelValues(metrics.Result(err)), start)
+	}()
+
+	to, cc := n.recipients(msg.App, msg.Outcome)
+	if len(to) == 0 {
+		return fmt.Errorf("no receiver for %s (%s)", msg.App, msg.Outcome)
+	}
+	bodyType := msg.BodyType
+	if bodyType == "" {
+		// 简单文本邮件也需要抄送
+		bodyType = "text"
+	}
+	return n.sender.SendEmailWithAttachment(msg.Title, to, cc, msg.Body, bodyType, msg.Attachments)
+}
@@ -0,0 +1,112 @@
+package notifiers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+)
+
+// Message 一条通知, 邮件使用 Body 和附件, 聊天机器人使用 Title 和 Summary
+type Message struct {
+	App   string
+	Title string
+	// 邮件正文, BodyType 为 html 或 text
+	Body     string
+	BodyType string
+	// 聊天机器人使用的简短文本 (markdown)
+	Summary     string
+	Attachments []string
+	// success, failure, warning, missing, summary, 邮件按结果选择收件人
+	Outcome string
+	// 关联的构建记录, 通知发送结束后更新记录的通知状态
+	RecordID uint64
+}
+
+// Text 聊天机器人发送的正文
+func (msg *Message) Text() string {
+	if msg.Summary == "" {
+		return msg.Title
+	}
+	return msg.Summary
+}
+
+type Notifier interface {
+	// Name 渠道名称, 对应 notify.channels[].name
+	Name() string
+	Notify(msg *Message) error
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewNotifier 根据渠道配置创建聊天机器人或 webhook 通知, email 渠道由 NewEmailNotifier 创建
+func NewNotifier(channel ChannelConfig) (Notifier, error) {
+	if channel.URL == "" {
+		return nil, fmt.Errorf("channel %s: url is required", channel.Name)
+	}
+	switch strings.ToLower(channel.Type) {
+	case "dingtalk":
+		return &DingTalkNotifier{name: channel.Name, url: channel.URL, secret: channel.Secret}, nil
+	case "wecom":
+		return &WeComNotifier{name: channel.Name, url: channel.URL}, nil
+	case "slack":
+		return &SlackNotifier{name: channel.Name, url: channel.URL}, nil
+	case "webhook":
+		return &WebhookNotifier{name: channel.Name, url: channel.URL, headers: channel.Headers}, nil
+	default:
+		return nil, fmt.Errorf("channel %s: unsupported type %q", channel.Name, channel.Type)
+	}
+}
+
+// postJSON 发送 JSON 请求, 返回 2xx 响应的内容
+func postJSON(url string, payload interface{}, headers map[string]string) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	return body, nil
+}
+
+// robotResponse 钉钉和企业微信机器人的返回结果
+type robotResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func checkRobotResponse(body []byte) error {
+	var resp robotResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid robot response %s: %w", body, err)
+	}
+	if resp.ErrCode != 0 {
+		return fmt.Errorf("robot error %d: %s", resp.ErrCode, resp.ErrMsg)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package notifiers
+
+import (
+	"fmt"
+)
+
+// SlackNotifier Slack 兼容的 incoming webhook (Mattermost, Rocket.Chat 等)
+type SlackNotifier struct {
+	name string
+	url  string
+}
+
+func (n *SlackNotifier) Name() string {
+	return n.name
+}
+
+func (n *SlackNotifier) Notify(msg *Message) error {
+	text := fmt.Sprintf("*%s*", msg.Title)
+	if msg.Summary != "" {
+		text += "\n" + msg.Summary
+	}
+	_, err := postJSON(n.url, map[string]string{"text": text}, nil)
+	return err
+}
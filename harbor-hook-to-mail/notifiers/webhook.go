@@ -0,0 +1,38 @@
+package notifiers
+
+import (
+	"time"
+)
+
+// WebhookNotifier 通用 JSON webhook, 将整条消息 POST 到指定地址
+type WebhookNotifier struct {
+	name    string
+	url     string
+	headers map[string]string
+}
+
+type webhookPayload struct {
+	App      string    `json:"app"`
+	Title    string    `json:"title"`
+	Summary  string    `json:"summary"`
+	Body     string    `json:"body"`
+	BodyType string    `json:"body_type"`
+	Time     time.Time `json:"time"`
+}
+
+func (n *WebhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *WebhookNotifier) Notify(msg *Message) error {
+	payload := webhookPayload{
+		App:      msg.App,
+		Title:    msg.Title,
+		Summary:  msg.Summary,
+		Body:     msg.Body,
+		BodyType: msg.BodyType,
+		Time:     time.Now(),
+	}
+	_, err := postJSON(n.url, payload, n.headers)
+	return err
+}
@@ -0,0 +1,29 @@
+package notifiers
+
+import (
+	"fmt"
+)
+
+// WeComNotifier 企业微信群机器人
+type WeComNotifier struct {
+	name string
+	url  string
+}
+
+func (n *WeComNotifier) Name() string {
+	return n.name
+}
+
+func (n *WeComNotifier) Notify(msg *Message) error {
+	payload := map[string]interface{}{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"content": fmt.Sprintf("### %s\n%s", msg.Title, msg.Text()),
+		},
+	}
+	body, err := postJSON(n.url, payload, nil)
+	if err != nil {
+		return err
+	}
+	return checkRobotResponse(body)
+}
@@ -0,0 +1,142 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/queue"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// Sender 发送一条通知, 返回错误时按退避时间重试
+type Sender func(mail *store.Mail) error
+
+type Options struct {
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// 超过 MaxAge 仍未发送成功时标记为失败, 0 表示一直重试
+	MaxAge time.Duration
+	// 检查到期通知的间隔
+	PollInterval time.Duration
+}
+
+// Outbox 通知先保存到存储再由后台发送, 发送失败时重试, 重启后继续发送未完成的通知
+type Outbox struct {
+	// 通知发送成功或最终失败后调用
+	OnFinish func(mail *store.Mail)
+
+	store   *store.Store
+	send    Sender
+	options Options
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(s *store.Store, send Sender, options Options) *Outbox {
+	if options.PollInterval <= 0 {
+		options.PollInterval = time.Second
+	}
+	return &Outbox{
+		store:   s,
+		send:    send,
+		options: options,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start 启动后台发送
+func (o *Outbox) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.wg.Add(1)
+	go o.run(ctx)
+}
+
+// Stop 停止后台发送, 等待正在发送的通知完成
+func (o *Outbox) Stop() {
+	if o.cancel != nil {
+		o.cancel()
+	}
+	o.wg.Wait()
+}
+
+// Add 保存通知并通知后台发送
+func (o *Outbox) Add(mail *store.Mail) error {
+	if err := o.store.AddMail(mail); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *Outbox) run(ctx context.Context) {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		mails, err := o.store.Mails(store.MailPending)
+		if err != nil {
+			log.Printf("[ Outbox ] Failed to list pending mails: %v", err)
+		}
+		for i := range mails {
+			if ctx.Err() != nil {
+				return
+			}
+			if mails[i].NextAttempt.After(time.Now()) {
+				continue
+			}
+			o.deliver(&mails[i])
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) deliver(mail *store.Mail) {
+	err := o.handle(mail)
+	mail.Attempts++
+	now := time.Now()
+	if err == nil {
+		mail.Status, mail.LastError, mail.SentAt = store.MailSent, "", now
+		log.Printf("[ Outbox ] Mail %d %q sent via %s for %s", mail.ID, mail.Title, mail.Channel, mail.App)
+	} else {
+		mail.LastError = err.Error()
+		if o.options.MaxAge > 0 && now.Sub(mail.CreatedAt) >= o.options.MaxAge {
+			mail.Status = store.MailFailed
+			log.Printf("[ Outbox ] Mail %d %q via %s for %s failed %d times in %s, give up: %v", mail.ID, mail.Title, mail.Channel, mail.App, mail.Attempts, o.options.MaxAge, err)
+		} else {
+			delay := queue.Backoff(mail.Attempts, o.options.Backoff, o.options.MaxBackoff)
+			mail.NextAttempt = now.Add(delay)
+			log.Printf("[ Outbox ] Mail %d %q via %s for %s failed, retry in %s: %v", mail.ID, mail.Title, mail.Channel, mail.App, delay, err)
+		}
+	}
+	if err := o.store.UpdateMail(mail); err != nil {
+		log.Printf("[ Outbox ] Failed to update mail %d: %v", mail.ID, err)
+	}
+	if mail.Status != store.MailPending && o.OnFinish != nil {
+		o.OnFinish(mail)
+	}
+}
+
+// handle 调用 send, panic 作为失败处理
+func (o *Outbox) handle(mail *store.Mail) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return o.send(mail)
+}
@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// ErrQueueFull 待处理的任务数达到上限
+var ErrQueueFull = store.ErrQueueFull
+
+// Handler 处理一个任务, 返回错误时按退避时间重试
+type Handler func(job *store.Job) error
+
+type Options struct {
+	Workers     int
+	Size        int
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// 检查到期任务的间隔
+	PollInterval time.Duration
+}
+
+// Queue 持久化在存储中的任务队列, 固定数量的 worker 处理, 重启后继续处理未完成的任务
+type Queue struct {
+	// 任务多次失败移入死信列表后调用
+	OnDead func(job *store.Job)
+
+	store   *store.Store
+	handler Handler
+	options Options
+
+	jobs chan store.Job
+	wake chan struct{}
+
+	mu       sync.Mutex
+	inflight map[uint64]bool
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func New(s *store.Store, handler Handler, options Options) *Queue {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 1
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = time.Second
+	}
+	return &Queue{
+		store:    s,
+		handler:  handler,
+		options:  options,
+		jobs:     make(chan store.Job),
+		wake:     make(chan struct{}, 1),
+		inflight: make(map[uint64]bool),
+	}
+}
+
+// Start 启动 worker 和调度
+func (q *Queue) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	for i := 0; i < q.options.Workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	q.wg.Add(1)
+	go q.dispatch(ctx)
+}
+
+// Stop 停止调度, 等待正在处理的任务完成, 未处理的任务在下次启动时继续
+func (q *Queue) Stop() {
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.wg.Wait()
+}
+
+// Enqueue 保存任务并通知调度
+func (q *Queue) Enqueue(job *store.Job) error {
+	if err := q.store.AddJobLimited(job, q.options.Size); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Backoff 第 attempts 次失败后的等待时间
+func Backoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (q *Queue) dispatch(ctx context.Context) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		jobs, err := q.store.Jobs(store.JobPending)
+		if err != nil {
+			log.Printf("[ Queue ] Failed to list pending jobs: %v", err)
+		}
+		now := time.Now()
+		for _, job := range jobs {
+			if job.NextAttempt.After(now) || !q.markInflight(job.ID) {
+				continue
+			}
+			select {
+			case q.jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) markInflight(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inflight[id] {
+		return false
+	}
+	q.inflight[id] = true
+	return true
+}
+
+func (q *Queue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-q.jobs:
+			q.process(&job)
+			q.mu.Lock()
+			delete(q.inflight, job.ID)
+			q.mu.Unlock()
+		}
+	}
+}
+
+func (q *Queue) process(job *store.Job) {
+	err := q.handle(job)
+	if err == nil {
+		if err := q.store.DeleteJob(job.ID); err != nil {
+			log.Printf("[ Queue ] Failed to delete job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= q.options.MaxAttempts {
+		job.State = store.JobDead
+		log.Printf("[ Queue ] Job %d (%s for %s) failed %d times, moved to dead letters: %v", job.ID, job.Type, job.App, job.Attempts, err)
+	} else {
+		delay := Backoff(job.Attempts, q.options.Backoff, q.options.MaxBackoff)
+		job.NextAttempt = time.Now().Add(delay)
+		log.Printf("[ Queue ] Job %d (%s for %s) failed, retry in %s: %v", job.ID, job.Type, job.App, delay, err)
+	}
+	if err := q.store.UpdateJob(job); err != nil {
+		log.Printf("[ Queue ] Failed to update job %d: %v", job.ID, err)
+	}
+	if job.State == store.JobDead && q.OnDead != nil {
+		q.OnDead(job)
+	}
+}
+
+// handle 调用 handler, panic 作为失败处理
+func (q *Queue) handle(job *store.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return q.handler(job)
+}
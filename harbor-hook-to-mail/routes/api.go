@@ -0,0 +1,315 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+)
+
+// AppStats 应用一天的统计和构建结果
+type AppStats struct {
+	*HookStats
+	Date string `json:"date"`
+	// 当天是否处理过构建推送
+	Built bool `json:"built"`
+	// 当天最后一次构建是否成功
+	Succeeded   bool               `json:"succeeded"`
+	LastBuild   *store.BuildRecord `json:"last_build,omitempty"`
+	LastSuccess *store.BuildRecord `json:"last_success,omitempty"`
+}
+
+// AppStatus /api/apps 中的应用
+type AppStatus struct {
+	Name string `json:"name"`
+	// 是否在 hook.apps 中, 否则只是存储中有记录
+	Configured bool      `json:"configured"`
+	Channels   []string  `json:"channels,omitempty"`
+	Events     []string  `json:"events,omitempty"`
+	Today      *AppStats `json:"today"`
+}
+
+// 请求开始时读取的存储, 处理过程中切换 leader 时仍使用同一个存储
+const apiStoreKey = "hook-api-store"
+
+type apiHandler struct {
+	store      func() *store.Store
+	hookConfig func() *HookConfig
+}
+
+// RegisterAPI 注册只读的构建状态查询接口, middlewares 用于认证, e.g. APIAuthHandler
+//
+//	GET /api/apps
+//	GET /api/apps/:app/stats?date=2006-01-02
+//	GET /api/apps/:app/builds?since=&until=&status=&type=&limit=
+//	GET /api/jobs?state=pending|dead&app=
+//	GET /api/outbox?status=pending|sent|failed&app=
+//	GET /api/outbox/:id
+func RegisterAPI(r gin.IRouter, s *store.Store, hookConfig func() *HookConfig, middlewares ...gin.HandlerFunc) {
+	registerAPI(r, func() *store.Store { return s }, hookConfig, middlewares...)
+}
+
+// registerAPI 每次请求时取当前的存储, middlewares 在查询之前执行
+func registerAPI(r gin.IRouter, s func() *store.Store, hookConfig func() *HookConfig, middlewares ...gin.HandlerFunc) {
+	h := &apiHandler{store: s, hookConfig: hookConfig}
+	api := r.Group("/api", middlewares...)
+	api.Use(h.requireStore)
+	api.GET("/apps", h.listApps)
+	api.GET("/apps/:app/stats", h.appStats)
+	api.GET("/apps/:app/builds", h.appBuilds)
+	api.GET("/jobs", h.listJobs)
+	api.GET("/outbox", h.listMails)
+	api.GET("/outbox/:id", h.getMail)
+}
+
+// requireStore 存储未打开时返回 503, 例如正在切换 leader
+func (h *apiHandler) requireStore(c *gin.Context) {
+	s := h.store()
+	if s == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "store is not open"})
+		return
+	}
+	c.Set(apiStoreKey, s)
+	c.Next()
+}
+
+func requestStore(c *gin.Context) *store.Store {
+	return c.MustGet(apiStoreKey).(*store.Store)
+}
+
+// isBuild 实际处理过的构建推送, 不包括重复, 过期和被拒绝的请求
+func isBuild(record *store.BuildRecord) bool {
+	return record.Type == EventPushArtifact &&
+		(record.Status == store.StatusProcessed || record.Status == store.StatusFailed)
+}
+
+func isSuccessfulBuild(record *store.BuildRecord) bool {
+	return isBuild(record) && record.Status == store.StatusProcessed && record.Result == "SUCCESS"
+}
+
+func (h *apiHandler) dayStats(s *store.Store, app string, day time.Time) (*AppStats, error) {
+	since := startOfDay(day)
+	until := since.AddDate(0, 0, 1)
+	stats := &AppStats{
+		HookStats: countHookStats(s, app, since, until),
+		Date:      since.Format("2006-01-02"),
+	}
+
+	records, err := s.List(app, since, until)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if isBuild(&records[i]) {
+			stats.Built = true
+			stats.Succeeded = isSuccessfulBuild(&records[i])
+			break
+		}
+	}
+
+	if stats.LastBuild, err = s.Last(app, isBuild); err != nil {
+		return nil, err
+	}
+	if stats.LastSuccess, err = s.Last(app, isSuccessfulBuild); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// knownApp 配置中的应用或存储中有记录的应用
+func (h *apiHandler) knownApp(s *store.Store, app string) bool {
+	for _, name := range appNames(s, h.hookConfig()) {
+		if name == app {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *apiHandler) listApps(c *gin.Context) {
+	s, hookConfig := requestStore(c), h.hookConfig()
+	now := time.Now()
+	apps := make([]AppStatus, 0)
+	for _, name := range appNames(s, hookConfig) {
+		status := AppStatus{Name: name}
+		if app, ok := hookConfig.GetApp(name); ok {
+			status.Configured = true
+			status.Channels = app.Channels
+			status.Events = app.Events
+		}
+		stats, err := h.dayStats(s, name, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		status.Today = stats
+		apps = append(apps, status)
+	}
+	c.JSON(http.StatusOK, apps)
+}
+
+func (h *apiHandler) appStats(c *gin.Context) {
+	s, app := requestStore(c), c.Param("app")
+	if !h.knownApp(s, app) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("app %s not found", app)})
+		return
+	}
+
+	day := time.Now()
+	if date := c.Query("date"); date != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid date %q, expect 2006-01-02", date)})
+			return
+		}
+		day = parsed
+	}
+
+	stats, err := h.dayStats(s, app, day)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func (h *apiHandler) appBuilds(c *gin.Context) {
+	s, app := requestStore(c), c.Param("app")
+	if !h.knownApp(s, app) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("app %s not found", app)})
+		return
+	}
+
+	now := time.Now()
+	since, until := startOfDay(now), time.Time{}
+	var err error
+	if value := c.Query("since"); value != "" {
+		if since, err = parseQueryTime(value, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if value := c.Query("until"); value != "" {
+		if until, err = parseQueryTime(value, now); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q", value)})
+			return
+		}
+	}
+
+	records, err := s.List(app, since, until)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status, eventType := c.Query("status"), c.Query("type")
+	builds := make([]store.BuildRecord, 0, len(records))
+	for _, record := range records {
+		if status != "" && !strings.EqualFold(record.Status, status) {
+			continue
+		}
+		if eventType != "" && !strings.EqualFold(record.Type, eventType) {
+			continue
+		}
+		builds = append(builds, record)
+	}
+	// 只返回最近的 limit 条
+	if limit > 0 && len(builds) > limit {
+		builds = builds[len(builds)-limit:]
+	}
+	c.JSON(http.StatusOK, builds)
+}
+
+// listJobs 待处理的任务或死信列表
+func (h *apiHandler) listJobs(c *gin.Context) {
+	state := c.DefaultQuery("state", store.JobPending)
+	if state != store.JobPending && state != store.JobDead {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid state %q, expect %s or %s", state, store.JobPending, store.JobDead)})
+		return
+	}
+	jobs, err := requestStore(c).Jobs(state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if app := c.Query("app"); app != "" {
+		filtered := make([]store.Job, 0, len(jobs))
+		for _, job := range jobs {
+			if job.App == app {
+				filtered = append(filtered, job)
+			}
+		}
+		jobs = filtered
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// listMails outbox 中的通知和发送状态, 不包含正文
+func (h *apiHandler) listMails(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && status != store.MailPending && status != store.MailSent && status != store.MailFailed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid status %q, expect %s, %s or %s", status, store.MailPending, store.MailSent, store.MailFailed)})
+		return
+	}
+	mails, err := requestStore(c).Mails(status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	app := c.Query("app")
+	filtered := make([]store.Mail, 0, len(mails))
+	for _, mail := range mails {
+		if app == "" || mail.App == app {
+			mail.Body = ""
+			filtered = append(filtered, mail)
+		}
+	}
+	c.JSON(http.StatusOK, filtered)
+}
+
+// getMail 一条通知的完整内容和发送状态
+func (h *apiHandler) getMail(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid id %q", c.Param("id"))})
+		return
+	}
+	mail, err := requestStore(c).GetMail(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if mail == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("mail %d not found", id)})
+		return
+	}
+	c.JSON(http.StatusOK, mail)
+}
+
+// parseQueryTime 支持 RFC3339, 本地时间 2006-01-02 或 2006-01-02 15:04:05, 以及相对当前时间的 24h, 30m 等
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expect RFC3339, 2006-01-02 or duration like 24h", value)
+}
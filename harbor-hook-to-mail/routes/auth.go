@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// 无法识别应用的拒绝请求数
+var unattributedRejected int32
+
+// 被拒绝的请求最多读取的请求体, 只用于识别应用, 超过时不再识别
+const maxRejectedBodySize = 64 << 10
+
+// authCheck 校验请求, 失败时返回状态码和原因
+type authCheck func(c *gin.Context) (int, string)
+
+// newAuthCheck 按 hook.auth 校验 Auth Header 和来源地址, 未配置时不做限制
+func newAuthCheck(hookConfig *HookConfig) (authCheck, error) {
+	resolved, err := ResolveSecret(hookConfig.Hook.Auth.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("hook.auth.secret: %w", err)
+	}
+	secret := []byte(resolved)
+	allowNets, err := parseCIDRs(hookConfig.Hook.Auth.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) (int, string) {
+		// 使用连接的来源地址, 不信任 X-Forwarded-For, 只有其他副本转发的请求使用转发时记录的地址
+		remoteIP := net.ParseIP(hookRemoteIP(c))
+		if len(allowNets) > 0 && !containsIP(allowNets, remoteIP) {
+			return http.StatusForbidden, fmt.Sprintf("source %s is not allowed", hookRemoteIP(c))
+		}
+		if len(secret) > 0 && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), secret) != 1 {
+			return http.StatusUnauthorized, "invalid auth header"
+		}
+		return 0, ""
+	}, nil
+}
+
+// HookAuthHandler 校验 Harbor webhook 的 Auth Header 和来源地址, 未配置时不做限制
+func HookAuthHandler(hookConfig *HookConfig) (gin.HandlerFunc, error) {
+	check, err := newAuthCheck(hookConfig)
+	if err != nil {
+		return nil, err
+	}
+	return func(c *gin.Context) {
+		if status, reason := check(c); status != 0 {
+			rejectHookRequest(c, hookConfig, status, reason)
+			return
+		}
+		c.Next()
+	}, nil
+}
+
+// APIAuthHandler 查询接口使用与 webhook 相同的认证, 拒绝的请求不计入应用的统计
+func APIAuthHandler(hookConfig *HookConfig) (gin.HandlerFunc, error) {
+	check, err := newAuthCheck(hookConfig)
+	if err != nil {
+		return nil, err
+	}
+	return func(c *gin.Context) {
+		if status, reason := check(c); status != 0 {
+			log.Printf("[ API ] [ rejected request ] %s %s from %s, reason: %s", c.Request.Method, c.Request.URL.Path, hookRemoteIP(c), reason)
+			c.AbortWithStatusJSON(status, gin.H{"error": reason})
+			return
+		}
+		c.Next()
+	}, nil
+}
+
+func rejectHookRequest(c *gin.Context, hookConfig *HookConfig, status int, reason string) {
+	appName := ""
+	var webhookRequest WebhookRequest
+	// 未认证的请求, 限制读取的大小
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRejectedBodySize)
+	if body, err := c.GetRawData(); err == nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if json.Unmarshal(body, &webhookRequest) == nil {
+			if match, ok := matchArtifact(&webhookRequest); ok {
+				appName = match.App
+			}
+		}
+	}
+
+	// 只统计配置中的应用, 避免伪造的请求创建新的统计项
+	if _, ok := hookConfig.GetApp(appName); ok {
+		addHookRejected(&webhookRequest, appName, reason)
+	} else {
+		atomic.AddInt32(&unattributedRejected, 1)
+	}
+	log.Printf("[ WebHandler ] [ rejected request ] from %s, app: %q, reason: %s", hookRemoteIP(c), appName, reason)
+	c.AbortWithStatusJSON(status, gin.H{"error": reason})
+}
+
+// UnattributedRejected 无法识别应用的拒绝请求数
+func UnattributedRejected() int32 {
+	return atomic.LoadInt32(&unattributedRejected)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allow-cidrs entry %q", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow-cidrs entry %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// dedupKey 同一个应用同一个 tag 的同类事件使用相同的 key, 没有 tag 的事件不去重
+func dedupKey(record *store.BuildRecord) string {
+	if record.Tag == "" {
+		return ""
+	}
+	return record.Type + "/" + record.App + "/" + record.Tag
+}
+
+// dedupEvent 检查 Harbor 重试的重复事件和乱序到达的过期事件, 返回丢弃时的记录状态和原因.
+// 接受的事件同时返回 undo, 没能加入处理队列时调用, 撤销去重记录使 Harbor 的重试可以被接受
+func dedupEvent(record *store.BuildRecord) (string, string, func()) {
+	undo := func() {}
+	key, s := dedupKey(record), getBuildStore()
+	if key == "" || s == nil {
+		return "", "", undo
+	}
+	digest := record.Digest
+	if digest == "" {
+		digest = record.ResourceURL
+	}
+
+	ttl := getHookConfig().Hook.Dedup.TTL
+	entry := store.DedupEntry{
+		Digest:   digest,
+		OccurAt:  record.OccurAt,
+		SeenAt:   record.ReceivedAt,
+		RecordID: record.ID,
+	}
+	if entry.SeenAt.IsZero() {
+		entry.SeenAt = time.Now()
+	}
+	verdict, prev, err := s.Dedup(key, entry, ttl)
+	if err != nil {
+		// 去重失败时继续处理, 宁可重复通知也不丢失事件
+		log.Printf("[ WebHandler ] Failed to check duplicate for %s: %v", key, err)
+		return "", "", undo
+	}
+
+	switch verdict {
+	case store.DedupDuplicate:
+		return store.StatusDuplicate, fmt.Sprintf("duplicate of record %d: %s@%s already received at %s within %s",
+			prev.RecordID, record.Tag, shortDigest(digest), prev.SeenAt.Format(time.RFC3339), ttl), undo
+	case store.DedupStale:
+		return store.StatusDeprecated, fmt.Sprintf("stale: %s@%s occurred at %s, but record %d (%s) of the same tag occurred later at %s",
+			record.Tag, shortDigest(digest), record.OccurAt.Format(time.RFC3339), prev.RecordID, shortDigest(prev.Digest), prev.OccurAt.Format(time.RFC3339)), undo
+	}
+	return "", "", func() {
+		if err := s.UndoDedup(key, entry, prev); err != nil {
+			log.Printf("[ WebHandler ] Failed to undo duplicate check for %s: %v", key, err)
+		}
+	}
+}
+
+func shortDigest(digest string) string {
+	if len(digest) > 19 {
+		return digest[:19]
+	}
+	return digest
+}
@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/calendar"
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// BuildDigest 汇总 hook.apps 中每个应用在 day 当天的构建和最近的构建结果, 节假日和不预期构建的日期没有构建不算异常
+func BuildDigest(s *store.Store, hookConfig *HookConfig, cal *calendar.Calendar, day time.Time) (*handlers.DigestReport, error) {
+	since := startOfDay(day)
+	until := since.AddDate(0, 0, 1)
+	report := &handlers.DigestReport{Rows: make([]handlers.DigestRow, 0, len(hookConfig.Hook.Apps))}
+	for _, app := range hookConfig.Hook.Apps {
+		hookStats := countHookStats(s, app.Name, since, until)
+		row := handlers.DigestRow{App: app.Name, Calls: hookStats.Calls, Errors: hookStats.Errors, Rest: !app.ExpectedOn(day, cal)}
+		row.Holiday, _ = cal.Holiday(day)
+
+		// 从最近的构建往前找到最近一次成功的构建, 之前的都是连续失败
+		var lastBuild *store.BuildRecord
+		lastSuccess, err := s.Last(app.Name, func(record *store.BuildRecord) bool {
+			if !isBuild(record) || !record.ReceivedAt.Before(until) {
+				return false
+			}
+			if lastBuild == nil {
+				copied := *record
+				lastBuild = &copied
+			}
+			if isSuccessfulBuild(record) {
+				return true
+			}
+			row.FailureStreak++
+			return false
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find last build of %s: %w", app.Name, err)
+		}
+		if lastBuild != nil {
+			row.LastTag, row.LastResult = lastBuild.Tag, lastBuild.Result
+		}
+		if lastSuccess != nil {
+			row.LastSuccess = lastSuccess.ReceivedAt
+		}
+
+		row.Problem = (!row.Rest && int(row.Calls) < app.Expect.Min()) || row.Errors > 0 || row.FailureStreak > 0
+		if row.Problem {
+			report.Problems++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report, nil
+}
+
+// informDigest 发送当天所有应用的汇总, muteHealthy 为 true 时所有应用都正常则不发送
+func informDigest(muteHealthy bool) error {
+	s := getBuildStore()
+	if s == nil {
+		return fmt.Errorf("build store is not opened")
+	}
+	now := time.Now()
+	report, err := BuildDigest(s, getHookConfig(), getCalendar(), now)
+	if err != nil {
+		return err
+	}
+	if muteHealthy && report.Problems == 0 {
+		log.Printf("All %d apps are healthy today, digest muted", len(report.Rows))
+		return nil
+	}
+	return handlers.CurrentConfig().SendDigestNotice(&handlers.MailData{Time: now, Report: report})
+}
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// resolveEvent 按事件类型和 hookConfig 确定应用并创建事件记录, webhook 和 replay 共用同一套规则.
+// 请求无效时返回错误; 被忽略时返回原因, 应用在 hook.apps 中时同时返回记录, 保存为 ignored
+func resolveEvent(hookConfig *HookConfig, webhookRequest *WebhookRequest) (*store.BuildRecord, string, error) {
+	eventType := webhookRequest.Type
+	if _, ok := eventProcessors[eventType]; !ok {
+		return nil, fmt.Sprintf("unsupported event type %s", eventType), nil
+	}
+
+	switch eventType {
+	case EventPushArtifact:
+		if len(webhookRequest.EventData.Resources) == 0 {
+			return nil, "", fmt.Errorf("no resources found")
+		}
+		match, ok := matchArtifact(webhookRequest)
+		if !ok {
+			return nil, fmt.Sprintf("%s does not match hook.match", webhookRequest.EventData.Resources[0].ResourceURL), nil
+		}
+		if app, _ := hookConfig.GetApp(match.App); !app.EventEnabled(eventType) {
+			return nil, fmt.Sprintf("%s disabled for %s", eventType, match.App), nil
+		}
+		record := newBuildRecord(webhookRequest, match.App)
+		record.Env, record.BuiltAt = match.Env, match.BuiltAt
+		return record, "", nil
+	case EventReplication:
+		replication := webhookRequest.EventData.Replication
+		if replication == nil {
+			return nil, "", fmt.Errorf("no replication found")
+		}
+		record, ignored := newAppRecord(hookConfig, webhookRequest, replicationApp(replication))
+		if record != nil {
+			record.Result = handlers.ReplicationResult(replication)
+		}
+		return record, ignored, nil
+	default:
+		record, ignored := newAppRecord(hookConfig, webhookRequest, newArtifactEvent(webhookRequest).App)
+		return record, ignored, nil
+	}
+}
+
+// newAppRecord 只处理 hook.apps 中开启了该事件的应用, 其他应用返回忽略的原因, 不在配置中时没有记录
+func newAppRecord(hookConfig *HookConfig, webhookRequest *WebhookRequest, appName string) (*store.BuildRecord, string) {
+	eventType := webhookRequest.Type
+	app, ok := hookConfig.GetApp(appName)
+	if !ok {
+		return nil, fmt.Sprintf("%s disabled for %q", eventType, appName)
+	}
+	record := newBuildRecord(webhookRequest, appName)
+	if !app.EventEnabled(eventType) {
+		return record, fmt.Sprintf("%s disabled for %q", eventType, appName)
+	}
+	return record, ""
+}
+
+func newArtifactEvent(webhookRequest *WebhookRequest) *handlers.ArtifactEvent {
+	repository := webhookRequest.EventData.Repository
+	event := &handlers.ArtifactEvent{
+		Type:       webhookRequest.Type,
+		App:        repository.Name,
+		Namespace:  repository.Namespace,
+		Repository: repository.Name,
+		Operator:   webhookRequest.Operator,
+		OccurAt:    time.Unix(webhookRequest.OccurAt, 0),
+	}
+	if len(webhookRequest.EventData.Resources) > 0 {
+		resource := webhookRequest.EventData.Resources[0]
+		event.Tag = resource.Tag
+		event.Digest = resource.Digest
+		event.ResourceURL = resource.ResourceURL
+		// 匹配 hook.match 的仓库使用规则中的应用名, e.g. 扫描应用仓库的镜像
+		if match, ok := matchArtifact(webhookRequest); ok {
+			event.App = match.App
+		} else if event.App == "" {
+			event.App = getAppName(resource.ResourceURL)
+		}
+	}
+	return event
+}
+
+// newRecordEvent 队列中处理的事件, 通知发送结束后更新 record 的通知状态
+func newRecordEvent(webhookRequest *WebhookRequest, record *store.BuildRecord) *handlers.ArtifactEvent {
+	event := newArtifactEvent(webhookRequest)
+	event.App, event.RecordID = record.App, record.ID
+	event.Env, event.BuiltAt = record.Env, record.BuiltAt
+	return event
+}
+
+// eventProcessors 队列中按事件类型处理 webhook 请求, record 为请求对应的事件记录
+var eventProcessors = map[string]eventProcessor{
+	EventPushArtifact:      processPushArtifact,
+	EventScanningCompleted: processScanning,
+	EventScanningFailed:    processScanning,
+	EventDeleteArtifact:    processDeleteArtifact,
+	EventQuotaExceed:       processQuota,
+	EventQuotaWarning:      processQuota,
+	EventReplication:       processReplication,
+}
+
+// eventProcessor 使用 h 中的通知和 registry 配置处理一个事件
+type eventProcessor func(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord) error
+
+// notifyResult 记录通知的发送结果, 通知写入 outbox 后为 MailPending, 发送结束后由 outbox 更新
+func notifyResult(record *store.BuildRecord, err error) error {
+	if err != nil {
+		record.MailStatus, record.MailError = store.MailFailed, err.Error()
+		return err
+	}
+	record.MailStatus, record.MailError = store.MailSent, ""
+	if mailOutbox.Load() != nil {
+		record.MailStatus = store.MailPending
+	}
+	return nil
+}
+
+func processScanning(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord) error {
+	var report *handlers.ScanReport
+	if len(webhookRequest.EventData.Resources) > 0 {
+		for _, overview := range webhookRequest.EventData.Resources[0].ScanOverview {
+			report = &overview
+			break
+		}
+	}
+	return notifyResult(record, h.ScanHandler(newRecordEvent(webhookRequest, record), report))
+}
+
+func processDeleteArtifact(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord) error {
+	return notifyResult(record, h.DeleteArtifactHandler(newRecordEvent(webhookRequest, record)))
+}
+
+func processQuota(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord) error {
+	details := webhookRequest.EventData.CustomAttributes["Details"]
+	return notifyResult(record, h.QuotaHandler(newRecordEvent(webhookRequest, record), details))
+}
+
+// replicationApp 复制的镜像对应的应用, name_tag 形如 "demo-app [1 item(s) in total]"
+func replicationApp(replication *handlers.Replication) string {
+	appName := ""
+	artifacts := append(append([]handlers.ReplicationArtifact{}, replication.FailedArtifact...), replication.SuccessfulArtifact...)
+	if len(artifacts) > 0 && len(strings.Fields(artifacts[0].NameTag)) > 0 {
+		appName = strings.Fields(artifacts[0].NameTag)[0]
+		if i := strings.LastIndex(appName, "/"); i >= 0 {
+			appName = appName[i+1:]
+		}
+		appName = strings.Split(appName, ":")[0]
+	}
+	return appName
+}
+
+func processReplication(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord) error {
+	err := h.ReplicationHandler(newRecordEvent(webhookRequest, record), webhookRequest.EventData.Replication)
+	return notifyResult(record, err)
+}
@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/calendar"
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/robfig/cron/v3"
+)
+
+// 向前查找上一次预期检查的最长天数, 超过时从当天零点开始统计
+const maxExpectLookback = 31
+
+var (
+	// 当前的节假日日历, 随配置热加载替换, nil 表示没有节假日
+	holidayCalendar *calendar.Calendar
+	expectCron      *cron.Cron
+)
+
+// loadCalendar 读取 hook.calendar.file, 没有配置时返回 nil
+func loadCalendar(hookConfig *HookConfig) (*calendar.Calendar, error) {
+	path := hookConfig.Hook.Calendar.File
+	if path == "" {
+		return nil, nil
+	}
+	cal, err := calendar.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("hook.calendar.file: %w", err)
+	}
+	return cal, nil
+}
+
+func getCalendar() *calendar.Calendar {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return holidayCalendar
+}
+
+func setCalendar(cal *calendar.Calendar) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	holidayCalendar = cal
+}
+
+// ExpectResult 一次构建预期检查的结果
+type ExpectResult struct {
+	*HookStats
+	// 统计的时段 [Since, Until)
+	Since     time.Time
+	Until     time.Time
+	MinBuilds int
+	// Until 当天是否预期有构建, 节假日和 expect.weekdays 之外的日期为 false
+	Expected bool
+	// 节假日名称
+	Holiday string
+}
+
+// Missing 预期有构建但是收到的构建次数不足
+func (result *ExpectResult) Missing() bool {
+	return result.Expected && int(result.Calls) < result.MinBuilds
+}
+
+// CheckExpectation 按应用的构建预期统计 now 之前的构建. 配置了 expect.cron 时统计上一次预期检查之后的构建, 否则统计当天的构建
+func CheckExpectation(s *store.Store, app AppConfig, cal *calendar.Calendar, now time.Time) (*ExpectResult, error) {
+	since := startOfDay(now)
+	if app.Expect.Cron != "" {
+		schedule, err := ParseCron(app.Expect.Cron)
+		if err != nil {
+			return nil, err
+		}
+		since = previousCheck(app, cal, schedule, now)
+	}
+	return newExpectResult(app, countHookStats(s, app.Name, since, now), since, now, cal), nil
+}
+
+func newExpectResult(app AppConfig, hookStats *HookStats, since time.Time, until time.Time, cal *calendar.Calendar) *ExpectResult {
+	result := &ExpectResult{
+		HookStats: hookStats,
+		Since:     since,
+		Until:     until,
+		MinBuilds: app.Expect.Min(),
+		Expected:  app.ExpectedOn(until, cal),
+	}
+	result.Holiday, _ = cal.Holiday(until)
+	return result
+}
+
+// previousCheck 上一次预期有构建的检查时间, 跳过节假日和 expect.weekdays 之外的日期
+func previousCheck(app AppConfig, cal *calendar.Calendar, schedule cron.Schedule, now time.Time) time.Time {
+	// 当前这次检查的触发时间不晚于 now, 按秒取整后排除
+	until := now.Truncate(time.Second)
+	for day := 0; day < maxExpectLookback; day++ {
+		chunkEnd := until.AddDate(0, 0, -day)
+		var previous time.Time
+		for t := schedule.Next(chunkEnd.AddDate(0, 0, -1).Add(-time.Second)); t.Before(chunkEnd); t = schedule.Next(t) {
+			if app.ExpectedOn(t, cal) {
+				previous = t
+			}
+		}
+		if !previous.IsZero() {
+			return previous
+		}
+	}
+	return startOfDay(now)
+}
+
+// newExpectMailData 定时检查通知的数据, 配置了 expect 的应用附带检查时段
+func newExpectMailData(app AppConfig, result *ExpectResult) *handlers.MailData {
+	data := newStatsMailData(result.HookStats)
+	if app.Expect.Cron != "" || result.MinBuilds > 1 {
+		data.Window = &handlers.ExpectWindow{Since: result.Since, Until: result.Until, MinBuilds: result.MinBuilds}
+	}
+	return data
+}
+
+// checkAppExpectation 按 expect.cron 检查一个应用
+func checkAppExpectation(name string) {
+	s := getBuildStore()
+	if s == nil {
+		return
+	}
+	app, ok := getHookConfig().GetApp(name)
+	if !ok {
+		return
+	}
+	result, err := CheckExpectation(s, app, getCalendar(), time.Now())
+	if err != nil {
+		log.Printf("[ Expect ] Failed to check %s: %v", name, err)
+		return
+	}
+	if err := informHookStats(app, result); err != nil {
+		log.Printf("[ Expect ] Failed to inform %s: %v", name, err)
+	}
+}
+
+// scheduleExpectations 为配置了 expect.cron 的应用启动检查, 没有时返回 nil
+func scheduleExpectations(hookConfig *HookConfig) *cron.Cron {
+	var c *cron.Cron
+	for _, app := range hookConfig.Hook.Apps {
+		if app.Expect.Cron == "" {
+			continue
+		}
+		schedule, err := ParseCron(app.Expect.Cron)
+		if err != nil {
+			log.Printf("[ Expect ] Invalid expect.cron of %s: %v", app.Name, err)
+			continue
+		}
+		if c == nil {
+			c = cron.New(cron.WithSeconds())
+		}
+		name := app.Name
+		c.Schedule(schedule, cron.FuncJob(func() { checkAppExpectation(name) }))
+		log.Printf("[ Expect ] Check %s at %q, at least %d builds", name, app.Expect.Cron, app.Expect.Min())
+	}
+	if c != nil {
+		c.Start()
+	}
+	return c
+}
+
+// expectations 应用的构建预期, 用于判断热加载后是否需要重新调度
+func expectations(hookConfig *HookConfig) map[string]ExpectConfig {
+	result := make(map[string]ExpectConfig)
+	for _, app := range hookConfig.Hook.Apps {
+		result[app.Name] = app.Expect
+	}
+	return result
+}
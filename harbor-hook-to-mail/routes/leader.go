@@ -0,0 +1,249 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/leader"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// 副本之间转发请求的 header
+const (
+	forwardedByHeader     = "X-Hook-Forwarded-By"
+	forwardTokenHeader    = "X-Hook-Forward-Token"
+	forwardRemoteIPHeader = "X-Hook-Remote-IP"
+	// 转发请求的原始来源地址
+	forwardedRemoteIPKey = "hook-forwarded-remote-ip"
+)
+
+var (
+	// 单副本部署时为 nil
+	elector *leader.Elector
+	// 副本之间转发请求的共享密钥
+	forwardToken string
+	// 转发请求给 leader 的 transport, 带有客户端证书
+	forwardTransport http.RoundTripper
+	// 启动时的配置, 成为 leader 时使用
+	leaderConfig *Config
+	leaderMutex  sync.Mutex
+
+	errNotLeader = errors.New("not the leader")
+)
+
+// isLeader 单副本部署时总是 leader
+func isLeader() bool {
+	return elector == nil || elector.IsLeader()
+}
+
+// startElector 按 leader 配置创建锁并开始选主
+func startElector(cfg *Config) error {
+	options := cfg.Leader
+	token, err := ResolveSecret(options.Token)
+	if err != nil {
+		return fmt.Errorf("leader.token: %w", err)
+	}
+	lock, err := newLeaderLock(cfg)
+	if err != nil {
+		return err
+	}
+	transport, err := newForwardTransport(cfg)
+	if err != nil {
+		return err
+	}
+
+	self := leader.Record{ID: options.ID, Address: options.Address}
+	if self.ID == "" || self.Address == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname for leader.id: %w", err)
+		}
+		if self.ID == "" {
+			self.ID = hostname
+		}
+		if self.Address == "" {
+			scheme := "http"
+			if cfg.Server.TLS.CertFile != "" {
+				scheme = "https"
+			}
+			self.Address = fmt.Sprintf("%s://%s:%d", scheme, hostname, cfg.Server.Port)
+		}
+	}
+
+	forwardToken = token
+	forwardTransport = transport
+	leaderConfig = cfg
+	elector = leader.NewElector(lock, self, leader.Options{
+		LeaseDuration: options.LeaseDuration,
+		RetryPeriod:   options.RetryPeriod,
+	})
+	elector.OnStartedLeading = func() error {
+		return startLeading(leaderConfig)
+	}
+	elector.OnStoppedLeading = func() {
+		if err := stopLeading(); err != nil {
+			log.Printf("[ Leader ] Failed to close store: %v", err)
+		}
+	}
+	log.Printf("[ Leader ] Start %s election as %s (%s)", options.Type, self.ID, self.Address)
+	elector.Start()
+	return nil
+}
+
+func newLeaderLock(cfg *Config) (leader.Lock, error) {
+	options := cfg.Leader
+	switch options.Type {
+	case LeaderFile:
+		return leader.NewFileLock(options.File.Path), nil
+	case LeaderKubernetes:
+		return leader.NewKubernetesLock(options.Kubernetes.Name, options.Kubernetes.Namespace)
+	case LeaderRedis:
+		password, err := ResolveSecret(options.Redis.Password)
+		if err != nil {
+			return nil, fmt.Errorf("leader.redis.password: %w", err)
+		}
+		return leader.NewRedisLock(options.Redis.Address, password, options.Redis.DB, options.Redis.Key), nil
+	}
+	return nil, fmt.Errorf("unsupported leader type %q", options.Type)
+}
+
+// newForwardTransport 转发请求给 leader 的 transport. 客户端证书默认使用 server.tls 的证书,
+// leader 配置了 server.tls.client-ca-file 时可以通过校验; 同时信任该 CA 签发的 leader 证书
+func newForwardTransport(cfg *Config) (*http.Transport, error) {
+	options := cfg.Leader.TLS
+	certFile, keyFile := options.CertFile, options.KeyFile
+	if certFile == "" {
+		certFile, keyFile = cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("leader.tls: failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, caFile := range []string{options.CAFile, cfg.Server.TLS.ClientCAFile} {
+		if caFile == "" {
+			continue
+		}
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("leader.tls: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("leader.tls: no certificate found in %s", caFile)
+		}
+	}
+	tlsConfig.RootCAs = pool
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// startLeading 打开存储, 启动队列, 通知发送, 工作目录清理和定时检查, 继续处理上一个 leader 未完成的任务
+func startLeading(cfg *Config) error {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+
+	if err := openBuildStore(cfg.StoreConfig); err != nil {
+		return err
+	}
+	startOutbox(cfg.OutboxConfig)
+	startJobQueue(cfg.QueueConfig)
+	startWorkDirCleanup()
+	log.Println("Print content of today's stats afer loaded from store")
+	PrintHookStatsMap()
+	scheduleInformers(getHookConfig())
+	return nil
+}
+
+// stopLeading 停止定时检查, 队列和通知发送, 关闭存储, 未处理完的任务和通知由下一个 leader 继续.
+// 队列和 outbox 等待正在处理的任务完成后才关闭存储, 之后仍在处理的请求得到 store.ErrClosed
+func stopLeading() error {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+
+	stopInformers()
+	stopWorkDirCleanup()
+	if q := jobQueue.Swap(nil); q != nil {
+		q.Stop()
+	}
+	stopOutbox()
+	s := buildStore.Swap(nil)
+	if s == nil {
+		return nil
+	}
+	return s.Close()
+}
+
+// leaderGate 不是 leader 时把请求转发给 leader. leader 收到带有正确 token 的转发请求时, 记录原始的来源地址
+func leaderGate(c *gin.Context) {
+	if elector == nil {
+		c.Next()
+		return
+	}
+	forwardedBy := c.GetHeader(forwardedByHeader)
+	if elector.IsLeader() {
+		if forwardedBy != "" && forwardToken != "" &&
+			subtle.ConstantTimeCompare([]byte(c.GetHeader(forwardTokenHeader)), []byte(forwardToken)) == 1 {
+			c.Set(forwardedRemoteIPKey, c.GetHeader(forwardRemoteIPHeader))
+		}
+		c.Next()
+		return
+	}
+
+	current, ok := elector.Leader()
+	if !ok || forwardedBy != "" {
+		// 没有 leader 或者转发的目标也不是 leader, Harbor 会稍后重试
+		log.Printf("[ Leader ] No leader to handle %s %s", c.Request.Method, c.Request.URL.Path)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "no leader available"})
+		return
+	}
+	target, err := url.Parse(current.Address)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("invalid leader address %q", current.Address)})
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = forwardTransport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("[ Leader ] Failed to forward %s to %s: %v", r.URL.Path, current.ID, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, `{"error": "failed to forward to leader %s"}`, current.ID)
+	}
+	c.Request.Header.Set(forwardedByHeader, elector.Self().ID)
+	c.Request.Header.Set(forwardRemoteIPHeader, c.RemoteIP())
+	if forwardToken != "" {
+		c.Request.Header.Set(forwardTokenHeader, forwardToken)
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+	c.Abort()
+}
+
+// hookRemoteIP 请求的来源地址, 其他副本转发的请求使用转发时记录的地址
+func hookRemoteIP(c *gin.Context) string {
+	if ip := c.GetString(forwardedRemoteIPKey); ip != "" {
+		return ip
+	}
+	return c.RemoteIP()
+}
@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/metrics"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var lastSuccessDesc = prometheus.NewDesc(
+	"harbor_hook_seconds_since_last_success",
+	"Seconds since the last successful build of the app, -1 if it never succeeded.",
+	[]string{"app"}, nil,
+)
+
+// buildCollector 采集时从存储中计算各应用距离最近一次成功构建的时间, 重启后不会丢失
+type buildCollector struct {
+	store      func() *store.Store
+	hookConfig func() *HookConfig
+}
+
+// NewBuildCollector 距离最近一次成功构建的秒数
+func NewBuildCollector(s *store.Store, hookConfig func() *HookConfig) prometheus.Collector {
+	return newBuildCollector(func() *store.Store { return s }, hookConfig)
+}
+
+// newBuildCollector 每次采集时取当前的存储, 不是 leader 时存储未打开, 不输出
+func newBuildCollector(s func() *store.Store, hookConfig func() *HookConfig) prometheus.Collector {
+	return &buildCollector{store: s, hookConfig: hookConfig}
+}
+
+func (collector *buildCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSuccessDesc
+}
+
+func (collector *buildCollector) Collect(ch chan<- prometheus.Metric) {
+	s := collector.store()
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	for _, app := range appNames(s, collector.hookConfig()) {
+		seconds := float64(-1)
+		last, err := s.Last(app, isSuccessfulBuild)
+		if err != nil {
+			log.Printf("[ Metrics ] Failed to read last success of %s: %v", app, err)
+			continue
+		}
+		if last != nil {
+			seconds = now.Sub(last.ReceivedAt).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, seconds, app)
+	}
+}
+
+// RegisterMetrics 注册 /metrics
+func RegisterMetrics(r gin.IRouter, s *store.Store, hookConfig func() *HookConfig) {
+	if s != nil {
+		prometheus.MustRegister(NewBuildCollector(s, hookConfig))
+	}
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
+// registerMetrics 注册 /metrics, 存储随 leader 切换打开和关闭
+func registerMetrics(r gin.IRouter, s func() *store.Store, hookConfig func() *HookConfig) {
+	var registered prometheus.AlreadyRegisteredError
+	if err := prometheus.Register(newBuildCollector(s, hookConfig)); err != nil && !errors.As(err, &registered) {
+		log.Printf("[ Metrics ] Failed to register build collector: %v", err)
+	}
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
+// observeHookEvent 按事件的处理结果更新计数, 与 HookStats 的统计口径一致
+func observeHookEvent(record *store.BuildRecord) {
+	if record.Status == store.StatusRejected {
+		metrics.HookRejected.WithLabelValues(record.App).Inc()
+		return
+	}
+	if record.Type != EventPushArtifact || record.Status == store.StatusIgnored {
+		return
+	}
+	metrics.HookCalls.WithLabelValues(record.App).Inc()
+	switch record.Status {
+	case store.StatusFailed:
+		metrics.HookErrors.WithLabelValues(record.App).Inc()
+	case store.StatusDuplicate:
+		metrics.HookDuplicates.WithLabelValues(record.App).Inc()
+	case store.StatusDeprecated:
+		metrics.HookDeprecated.WithLabelValues(record.App).Inc()
+	}
+}
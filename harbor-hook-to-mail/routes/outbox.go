@@ -0,0 +1,54 @@
+package routes
+
+import (
+	"log"
+	"sync/atomic"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/outbox"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+var mailOutbox atomic.Pointer[outbox.Outbox]
+
+// startOutbox 启动通知的后台发送, 继续发送上次未完成的通知
+func startOutbox(outboxConfig OutboxConfig) {
+	options := outboxConfig.Outbox
+	o := outbox.New(getBuildStore(), deliverMail, outbox.Options{
+		Backoff:    options.Backoff,
+		MaxBackoff: options.MaxBackoff,
+		MaxAge:     options.MaxAge,
+	})
+	o.OnFinish = finishMail
+	o.Start()
+	mailOutbox.Store(o)
+	handlers.SetOutbox(o)
+	log.Printf("[ Outbox ] Started, max age %s", options.MaxAge)
+}
+
+// deliverMail 每次发送和重试都使用当前的渠道配置, 热加载后的渠道地址和密钥立即生效
+func deliverMail(mail *store.Mail) error {
+	return handlers.CurrentConfig().Deliver(mail)
+}
+
+// finishMail 通知发送结束后按所有渠道的发送结果更新关联的构建记录
+func finishMail(mail *store.Mail) {
+	s := getBuildStore()
+	if mail.RecordID == 0 || s == nil {
+		return
+	}
+	if err := s.UpdateRecordMailStatus(mail.App, mail.RecordID); err != nil {
+		log.Printf("[ Outbox ] Failed to update record %d for %s: %v", mail.RecordID, mail.App, err)
+	}
+}
+
+// stopOutbox 停止后台发送, 之后的通知直接发送
+func stopOutbox() {
+	o := mailOutbox.Swap(nil)
+	if o == nil {
+		return
+	}
+	handlers.SetOutbox(nil)
+	o.Stop()
+}
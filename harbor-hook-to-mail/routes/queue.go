@@ -0,0 +1,122 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/queue"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+)
+
+var jobQueue atomic.Pointer[queue.Queue]
+
+// startJobQueue 启动事件处理队列, 继续处理上次未完成的任务
+func startJobQueue(queueConfig QueueConfig) {
+	options := queueConfig.Queue
+	q := queue.New(getBuildStore(), processJob, queue.Options{
+		Workers:     options.Workers,
+		Size:        options.Size,
+		MaxAttempts: options.MaxAttempts,
+		Backoff:     options.Backoff,
+		MaxBackoff:  options.MaxBackoff,
+	})
+	q.OnDead = func(job *store.Job) {
+		finishHookEvent(job.Record, store.StatusFailed, errors.New(job.LastError))
+	}
+	q.Start()
+	jobQueue.Store(q)
+	log.Printf("[ Queue ] Started %d workers", options.Workers)
+}
+
+// enqueueEvent 丢弃重复和过期的事件, 其余事件加入处理队列, 立即返回 202
+func enqueueEvent(c *gin.Context, webhookRequest *WebhookRequest, record *store.BuildRecord) {
+	status, reason, undoDedup := dedupEvent(record)
+	if status != "" {
+		log.Printf("[ WebHandler ] [ %s request ] from %s: %s", status, record.App, reason)
+		record.DropReason = reason
+		finishHookEvent(record, status, nil)
+		c.JSON(http.StatusOK, gin.H{"status": status, "reason": reason})
+		return
+	}
+
+	payload, err := json.Marshal(webhookRequest)
+	q := jobQueue.Load()
+	if err == nil && q == nil {
+		// 刚失去 leader, 队列已经停止
+		err = errNotLeader
+	}
+	if err == nil {
+		record.Status = store.StatusQueued
+		err = q.Enqueue(&store.Job{App: record.App, Type: record.Type, Record: record, Payload: payload})
+	}
+	if err != nil {
+		log.Printf("[ WebHandler ] Failed to enqueue %s for %s: %v", record.Type, record.App, err)
+		// 没有加入队列的事件不算收到过, Harbor 重试时重新去重
+		undoDedup()
+		finishHookEvent(record, store.StatusFailed, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, queue.ErrQueueFull) || errors.Is(err, errNotLeader) || errors.Is(err, store.ErrClosed) {
+			// Harbor 会稍后重试
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	updateHookEvent(record)
+	c.JSON(http.StatusAccepted, gin.H{"status": "queued"})
+}
+
+// processJob 处理队列中的任务, 失败时返回错误由队列重试
+func processJob(job *store.Job) error {
+	var webhookRequest WebhookRequest
+	if err := json.Unmarshal(job.Payload, &webhookRequest); err != nil {
+		return err
+	}
+	if job.Record == nil {
+		job.Record = newBuildRecord(&webhookRequest, job.App)
+	}
+	if err := processEvent(handlers.CurrentConfig(), &webhookRequest, job.Record, false); err != nil {
+		log.Printf("[ WebHandler ] Failed to handle %s for %s (attempt %d): %v", job.Type, job.App, job.Attempts+1, err)
+		return err
+	}
+	return nil
+}
+
+// processEvent 按事件类型使用 h 处理, 队列中的任务和 replay 共用. 队列中处理失败时保存错误等待重试,
+// replay 只处理一次, 失败时直接结束
+func processEvent(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord, replay bool) error {
+	processor, ok := eventProcessors[record.Type]
+	if !ok {
+		return fmt.Errorf("unsupported event type %s", record.Type)
+	}
+	if err := processor(h, webhookRequest, record); err != nil {
+		if replay {
+			finishHookEvent(record, store.StatusFailed, err)
+			return err
+		}
+		record.Error = err.Error()
+		updateHookEvent(record)
+		return err
+	}
+	record.Error = ""
+	finishHookEvent(record, store.StatusProcessed, nil)
+	return nil
+}
+
+// updateHookEvent 保存处理中的事件记录
+func updateHookEvent(record *store.BuildRecord) {
+	s := getBuildStore()
+	if record.ID == 0 || s == nil {
+		return
+	}
+	if err := s.Update(record); err != nil {
+		log.Printf("[ Store ] Failed to update record %d for %s: %v", record.ID, record.App, err)
+	}
+}
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/exyb/harbor-hook-to-mail/calendar"
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/gin-gonic/gin"
+)
+
+var reloadMutex sync.Mutex
+
+// loadedConfig 校验通过, 等待替换的配置
+type loadedConfig struct {
+	hook     *HookConfig
+	auth     gin.HandlerFunc
+	apiAuth  gin.HandlerFunc
+	handler  *handlers.HandlerConfig
+	calendar *calendar.Calendar
+	matcher  *ArtifactMatcher
+}
+
+// loadConfig 解密密钥并创建认证和通知渠道, 不修改当前配置
+func loadConfig(cfg *Config) (*loadedConfig, error) {
+	// 重新读取密钥文件, 轮换密钥后新的 enc:v2 密文可以直接解密
+	keyRing, err := LoadKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	SetKeyRing(keyRing)
+
+	newHookConfig := cfg.HookConfig
+	authHandler, err := HookAuthHandler(&newHookConfig)
+	if err != nil {
+		return nil, err
+	}
+	apiAuthHandler, err := APIAuthHandler(&newHookConfig)
+	if err != nil {
+		return nil, err
+	}
+	handlerConfig, err := handlers.NewHandlerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cal, err := loadCalendar(&newHookConfig)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := NewArtifactMatcher(newHookConfig.Hook.Match)
+	if err != nil {
+		return nil, err
+	}
+	return &loadedConfig{hook: &newHookConfig, auth: authHandler, apiAuth: apiAuthHandler, handler: handlerConfig, calendar: cal, matcher: matcher}, nil
+}
+
+func (loaded *loadedConfig) apply() {
+	setHookConfig(loaded.hook)
+	hookAuth.Store(loaded.auth)
+	apiAuth.Store(loaded.apiAuth)
+	handlers.SetHandlerConfig(loaded.handler)
+	setCalendar(loaded.calendar)
+	artifactMatcher.Store(loaded.matcher)
+}
+
+// ValidateConfig 校验配置, 包括密钥能否解密和通知渠道能否创建, 不修改当前配置
+func ValidateConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	_, err := loadConfig(cfg)
+	return err
+}
+
+// UseConfig 校验并使用配置, 不启动定时检查, 用于命令行
+func UseConfig(cfg *Config) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	loaded, err := loadConfig(cfg)
+	if err != nil {
+		return err
+	}
+	loaded.apply()
+	return openWorkDir(cfg.WorkConfig)
+}
+
+// ReloadConfig 重新加载配置文件, 所有配置都校验通过后才会替换, 否则保留当前配置并返回错误
+func ReloadConfig(path string) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	cfg, err := Load(path)
+	if err != nil {
+		return err
+	}
+	loaded, err := loadConfig(cfg)
+	if err != nil {
+		return err
+	}
+	newHookConfig := loaded.hook
+
+	oldHookConfig := getHookConfig()
+	if oldHookConfig.Hook.ContextPath != newHookConfig.Hook.ContextPath {
+		log.Printf("[ Config ] hook.context-path changed to %s, restart to take effect", newHookConfig.Hook.ContextPath)
+		newHookConfig.Hook.ContextPath = oldHookConfig.Hook.ContextPath
+	}
+	loaded.apply()
+
+	// 调度不变时不重新调度, 避免重复通知. 不是 leader 时没有调度, 成为 leader 时使用最新的配置
+	if isLeader() && (!reflect.DeepEqual(oldHookConfig.Hook.Audit, newHookConfig.Hook.Audit) || !reflect.DeepEqual(expectations(oldHookConfig), expectations(newHookConfig))) {
+		log.Printf("[ Config ] Reschedule informers, inform-time: %v, inform-cron: %q", newHookConfig.Hook.Audit.InformTime, newHookConfig.Hook.Audit.InformCron)
+		scheduleInformers(newHookConfig)
+	}
+	log.Printf("[ Config ] Reloaded %s, %d apps", path, len(newHookConfig.Hook.Apps))
+	return nil
+}
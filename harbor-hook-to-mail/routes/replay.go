@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// ReplayEvent 同步处理保存的 Harbor webhook 请求, 不经过认证, 去重和处理队列, 不保存记录, 通知直接发送.
+// 与 webhook 使用相同的规则确定应用, 会被忽略的事件返回错误. 返回处理后的事件记录, 处理失败时记录中包含错误
+func ReplayEvent(payload []byte) (*store.BuildRecord, error) {
+	var webhookRequest WebhookRequest
+	if err := json.Unmarshal(payload, &webhookRequest); err != nil {
+		return nil, fmt.Errorf("invalid webhook payload: %w", err)
+	}
+	record, ignored, err := resolveEvent(getHookConfig(), &webhookRequest)
+	if err != nil {
+		return nil, err
+	}
+	if ignored != "" {
+		return nil, errors.New(ignored)
+	}
+	return record, processEvent(handlers.CurrentConfig(), &webhookRequest, record, true)
+}
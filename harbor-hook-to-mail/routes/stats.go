@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/store"
+)
+
+// HookStats 应用当天的统计, 由当天的构建记录计算
+type HookStats struct {
+	Name string `json:"name"`
+	// 收到的构建推送, 包括重复和过期的请求
+	Calls  int32 `json:"calls"`
+	Errors int32 `json:"errors"`
+	// 认证或来源地址校验失败的请求
+	Rejected   int32 `json:"rejected"`
+	Duplicates int32 `json:"duplicates"`
+	Deprecated int32 `json:"deprecated"`
+}
+
+// buildStore 只有 leader 打开, 失去 leader 时为 nil. 每个请求和任务只读取一次,
+// 之后存储被关闭时返回 store.ErrClosed
+var buildStore atomic.Pointer[store.Store]
+
+// openBuildStore 打开构建记录存储
+func openBuildStore(storeConfig StoreConfig) error {
+	retention := time.Duration(storeConfig.Store.RetentionDays) * 24 * time.Hour
+	s, err := store.Open(storeConfig.Store.Path, retention)
+	if err != nil {
+		return err
+	}
+	buildStore.Store(s)
+	go s.RunRetention(time.Hour)
+	return nil
+}
+
+func getBuildStore() *store.Store {
+	return buildStore.Load()
+}
+
+// Close 停止处理队列和通知发送, 关闭构建记录存储, 未处理完的任务和通知在下次启动时继续.
+// 多副本部署时同时释放 leader
+func Close() error {
+	if elector != nil {
+		elector.Stop()
+		elector = nil
+		return nil
+	}
+	return stopLeading()
+}
+
+func newBuildRecord(webhookRequest *WebhookRequest, appName string) *store.BuildRecord {
+	record := &store.BuildRecord{
+		App:     appName,
+		Type:    webhookRequest.Type,
+		Status:  store.StatusReceived,
+		OccurAt: time.Unix(webhookRequest.OccurAt, 0),
+	}
+	if len(webhookRequest.EventData.Resources) > 0 {
+		resource := webhookRequest.EventData.Resources[0]
+		record.Tag = resource.Tag
+		record.Digest = resource.Digest
+		record.ResourceURL = resource.ResourceURL
+	}
+	return record
+}
+
+// recordHookEvent 保存收到的事件, 存储未打开或失败时不影响请求处理
+func recordHookEvent(record *store.BuildRecord) {
+	s := getBuildStore()
+	if s == nil {
+		return
+	}
+	if err := s.Add(record); err != nil {
+		log.Printf("[ Store ] Failed to add record for %s: %v", record.App, err)
+	}
+}
+
+// finishHookEvent 更新事件的处理结果
+func finishHookEvent(record *store.BuildRecord, status string, err error) {
+	record.Status = status
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.ProcessedAt = time.Now()
+	observeHookEvent(record)
+	s := getBuildStore()
+	if record.ID == 0 || s == nil {
+		return
+	}
+	if err := s.Update(record); err != nil {
+		log.Printf("[ Store ] Failed to update record %d for %s: %v", record.ID, record.App, err)
+	}
+}
+
+func addHookRejected(webhookRequest *WebhookRequest, appName string, reason string) {
+	record := newBuildRecord(webhookRequest, appName)
+	recordHookEvent(record)
+	finishHookEvent(record, store.StatusRejected, errors.New(reason))
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// countHookStats 统计应用在 [since, until) 内的构建记录
+func countHookStats(s *store.Store, app string, since time.Time, until time.Time) *HookStats {
+	hookStats := &HookStats{Name: app}
+	records, err := s.List(app, since, until)
+	if err != nil {
+		log.Printf("[ Store ] Failed to list records of %s: %v", app, err)
+		return hookStats
+	}
+	for _, record := range records {
+		if record.Status == store.StatusRejected {
+			hookStats.Rejected++
+			continue
+		}
+		if record.Type != EventPushArtifact || record.Status == store.StatusIgnored {
+			continue
+		}
+		hookStats.Calls++
+		switch record.Status {
+		case store.StatusFailed:
+			hookStats.Errors++
+		case store.StatusDuplicate:
+			hookStats.Duplicates++
+		case store.StatusDeprecated:
+			hookStats.Deprecated++
+		}
+	}
+	return hookStats
+}
+
+// appNames 配置中的应用和存储中有记录的应用
+func appNames(s *store.Store, hookConfig *HookConfig) []string {
+	names := make(map[string]bool)
+	for _, app := range hookConfig.Hook.Apps {
+		names[app.Name] = true
+	}
+	apps, err := s.Apps()
+	if err != nil {
+		log.Printf("[ Store ] Failed to list apps: %v", err)
+	}
+	for _, app := range apps {
+		names[app] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// listHookStats 配置中的应用和存储中有记录的应用当天的统计
+func listHookStats() []*HookStats {
+	s := getBuildStore()
+	if s == nil {
+		return nil
+	}
+	return ListHookStats(s, getHookConfig(), time.Now())
+}
+
+// ListHookStats 配置中的应用和存储中有记录的应用某一天的统计, 不在配置中的应用只返回当天有记录的
+func ListHookStats(s *store.Store, hookConfig *HookConfig, day time.Time) []*HookStats {
+	since := startOfDay(day)
+	until := since.AddDate(0, 0, 1)
+	hookStatsList := make([]*HookStats, 0)
+	for _, name := range appNames(s, hookConfig) {
+		hookStats := countHookStats(s, name, since, until)
+		// 存储中的应用只在当天有记录时通知, 避免已移除的应用每天收到告警
+		if _, ok := hookConfig.GetApp(name); !ok && hookStats.Calls == 0 && hookStats.Rejected == 0 {
+			continue
+		}
+		hookStatsList = append(hookStatsList, hookStats)
+	}
+	return hookStatsList
+}
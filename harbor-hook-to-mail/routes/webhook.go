@@ -1,13 +1,11 @@
 package routes
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
-	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -16,88 +14,96 @@ import (
 
 	. "github.com/exyb/harbor-hook-to-mail/config"
 	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
 	"github.com/robfig/cron/v3"
 	"golang.org/x/exp/rand"
 
 	"github.com/gin-gonic/gin"
 )
 
-type Once struct {
-	Sign       string
-	CreateTime string
-}
+var (
+	// 配置热加载时整体替换, 读写都需要持有 configMutex
+	configMutex sync.RWMutex
+	hookConfig  = &Default().HookConfig
+	// 当前的 webhook 和查询接口的认证, 随配置热加载替换
+	hookAuth atomic.Value
+	apiAuth  atomic.Value
+	// 当前的构建镜像匹配规则, 随配置热加载替换
+	artifactMatcher atomic.Value
+
+	informMutex  sync.Mutex
+	informCron   *cron.Cron
+	informCancel context.CancelFunc
+)
 
-type HookStats struct {
-	Name   string
-	Calls  int32
-	Errors int32
-	Once   Once
+// inform-time 检查最近一次通知的日期
+const exactInformKey = "inform/exact-time"
+
+type WebhookResource struct {
+	Digest      string `json:"digest"`
+	Tag         string `json:"tag"`
+	ResourceURL string `json:"resource_url"`
+	// 扫描事件, key 为报告的 mime type
+	ScanOverview map[string]handlers.ScanReport `json:"scan_overview,omitempty"`
 }
 
-var (
-	hookStatsMap      sync.Map
-	hookConfig        *HookConfig
-	hookStatsJsonFile = "stats.json"
-)
+type WebhookRepository struct {
+	DateCreated  int64  `json:"date_created"`
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	RepoFullName string `json:"repo_full_name"`
+	RepoType     string `json:"repo_type"`
+}
 
-// var (
-// 	hookStatsMap = make(map[string]*HookStats, 3)
-// )
+type WebhookEventData struct {
+	Resources  []WebhookResource `json:"resources"`
+	Repository WebhookRepository `json:"repository"`
+	// 配额事件的详情
+	CustomAttributes map[string]string     `json:"custom_attributes,omitempty"`
+	Replication      *handlers.Replication `json:"replication,omitempty"`
+}
 
 type WebhookRequest struct {
-	Type      string `json:"type"`
-	OccurAt   int64  `json:"occur_at"`
-	Operator  string `json:"operator"`
-	EventData struct {
-		Resources []struct {
-			Digest      string `json:"digest"`
-			Tag         string `json:"tag"`
-			ResourceURL string `json:"resource_url"`
-		} `json:"resources"`
-		Repository struct {
-			DateCreated  int64  `json:"date_created"`
-			Name         string `json:"name"`
-			Namespace    string `json:"namespace"`
-			RepoFullName string `json:"repo_full_name"`
-			RepoType     string `json:"repo_type"`
-		} `json:"repository"`
-	} `json:"event_data"`
+	Type      string           `json:"type"`
+	OccurAt   int64            `json:"occur_at"`
+	Operator  string           `json:"operator"`
+	EventData WebhookEventData `json:"event_data"`
 }
 
-func SetupRouter(r *gin.Engine) {
+// SetupRouter 使用启动时加载并校验过的配置注册路由. 单副本时直接启动存储, 队列和定时检查,
+// 多副本时成为 leader 后才启动, 其他副本把请求转发给 leader
+func SetupRouter(r *gin.Engine, cfg *Config) {
 	// /hook/{app,ui,...}
 	// r.POST("/hook/*", wrappedHookHandler)
 	// r.POST("/hook/{backend,front,core}", wrappedHookHandler)
-	hookConfig := getHookConfig()
-	for _, app := range hookConfig.Hook.Apps {
-		getOrCreateHookStats(app)
+	if err := UseConfig(cfg); err != nil {
+		log.Fatalf("Failed to setup config: %v", err)
 	}
+	hookConfig := getHookConfig()
 
-	if err := LoadMapFromFile(); err != nil {
-		log.Fatalf("Failed to load map from file: %v", err)
+	if cfg.LeaderConfig.Enabled() {
+		if err := startElector(cfg); err != nil {
+			log.Fatalf("[ Leader ] %v", err)
+		}
+	} else if err := startLeading(cfg); err != nil {
+		log.Fatalf("[ Store ] %v", err)
 	}
-	log.Println("Print content of saved stats afer loaded from file")
-	PrintHookStatsMap()
 
-	r.POST(hookConfig.Hook.ContextPath, webHookHandler)
+	r.POST(hookConfig.Hook.ContextPath, leaderGate, hookAuthHandler, newWebHookHandler(getHookConfig))
+	registerAPI(r, getBuildStore, getHookConfig, leaderGate, apiAuthHandler)
+	registerMetrics(r, getBuildStore, getHookConfig)
 	// hookGroup := r.Group("/hook")
 	// {
 	// 	hookGroup.POST("/:app", wrappedHookHandler)
 	// }
-
-	go resetStatCounters()
-	go informHookStatsByCronExpr()
-	go informHookStatsByExactTime()
-	go saveHookStatsToFile()
-
 }
 
-// PrintHookStatsMap 打印 sync.Map 的内容
+// PrintHookStatsMap 打印各应用当天的统计
 func PrintHookStatsMap() {
-	hookStatsMap.Range(func(key, value interface{}) bool {
-		fmt.Printf("%s: %v\n", key, value)
-		return true
-	})
+	for _, stats := range listHookStats() {
+		fmt.Printf("%s: %v\n", stats.Name, *stats)
+	}
+	fmt.Printf("unattributed rejected: %d\n", UnattributedRejected())
 }
 
 func PrintMap(mapObject map[string]interface{}) bool {
@@ -108,15 +114,6 @@ func PrintMap(mapObject map[string]interface{}) bool {
 	return false
 }
 
-func saveHookStatsToFile() {
-	for {
-		if err := SaveMapToFile(); err != nil {
-			fmt.Printf("Error saving map to file: %v\n", err)
-		}
-		time.Sleep(time.Minute * 1)
-	}
-}
-
 func getAppName(path string) string {
 	parts := strings.Split(strings.Split(path, ":")[0], "/")
 	if len(parts) < 3 {
@@ -125,193 +122,40 @@ func getAppName(path string) string {
 	return parts[len(parts)-1]
 }
 
-func getTimeFromTag(tagName string) string {
-	parts := strings.Split(tagName, "_")
-	if len(parts) < 2 {
-		return time.Now().Format("20060102150405")
-	}
-	return parts[len(parts)-1]
-}
-
-func getHookConfigFromPath(configFilePath string) *HookConfig {
-	if hookConfig != nil {
-		return hookConfig
-	}
-	hookConfig, err := LoadHookConfig(configFilePath)
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-	return hookConfig
-}
-
-func getHookConfig() *HookConfig {
-	if hookConfig != nil {
-		return hookConfig
-	}
-	configFilePath := os.Getenv("config_file_path")
-	return getHookConfigFromPath(configFilePath)
-}
-
-func getOrCreateHookStats(app string) *HookStats {
-	var stats *HookStats
-	value, ok := hookStatsMap.Load(app)
-	// load previous status Result
-
-	if !ok {
-		stats = &HookStats{
-			Name:   app,
-			Calls:  0,
-			Errors: 0,
-			Once: Once{
-				Sign:       "",
-				CreateTime: "20060101000000",
-			},
-		}
-		_, _ = hookStatsMap.LoadOrStore(app, stats)
-		return stats
-	}
-	// 第一次是一个 结构体, 第二次就是具体对象了
-	hookStats, ok := value.(*HookStats)
-	if ok {
-		return hookStats
-	}
-	// 类型断言, 从 any 转为 map
-	data, ok := value.(map[string]interface{})
-	if ok {
-		// 类型转换
-		hookStats, err := convertToHookStats(data)
-		if err != nil {
-			fmt.Println("Error converting to HookStats:", err)
-			return nil
-		}
-
-		return &hookStats
-	}
-	return nil
-
-}
-
-func convertToHookStats(data map[string]interface{}) (HookStats, error) {
-	onceMap, ok := data["Once"].(map[string]interface{})
-	if !ok {
-		return HookStats{}, fmt.Errorf("invalid type for Once field")
+// matchArtifact 按 hook.match 匹配请求中的第一个镜像
+func matchArtifact(webhookRequest *WebhookRequest) (*ArtifactMatch, bool) {
+	if len(webhookRequest.EventData.Resources) == 0 {
+		return nil, false
 	}
-
-	createTime, ok := onceMap["CreateTime"].(string)
+	matcher, ok := artifactMatcher.Load().(*ArtifactMatcher)
 	if !ok {
-		return HookStats{}, fmt.Errorf("invalid type for CreateTime field")
-	}
-
-	sign, ok := onceMap["Sign"].(string)
-	if !ok {
-		return HookStats{}, fmt.Errorf("invalid type for Sign field")
-	}
-
-	once := Once{
-		CreateTime: createTime,
-		Sign:       sign,
-	}
-
-	return HookStats{
-		Name:   data["Name"].(string),
-		Calls:  int32(data["Calls"].(float64)),
-		Errors: int32(data["Errors"].(float64)),
-		Once:   once,
-	}, nil
-}
-
-func SaveMapToFile() error {
-	data := make(map[string]interface{})
-
-	// 将 sync.Map 的内容复制到普通 map
-	hookStatsMap.Range(func(key, value interface{}) bool {
-		data[key.(string)] = value
-		return true
-	})
-
-	// 序列化为 JSON
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-	// 写入文件
-	return ioutil.WriteFile(hookStatsJsonFile, jsonData, 0644)
-}
-
-// LoadMapFromFile 从文件中读取并恢复到 sync.Map
-func LoadMapFromFile() error {
-	file, err := os.Open(hookStatsJsonFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // 文件不存在不是错误
-		}
-		return err
-	}
-	defer file.Close()
-
-	jsonData, err := ioutil.ReadAll(file)
-	if err != nil {
-		return err
-	}
-
-	data := make(map[string]interface{})
-	if err := json.Unmarshal(jsonData, &data); err != nil {
-		return err
-	}
-
-	// 将数据恢复到 sync.Map
-	for key, value := range data {
-		data, ok := value.(map[string]interface{})
-		if ok {
-			// 类型转换
-			hookStats, err := convertToHookStats(data)
-			if err != nil {
-				fmt.Println("Error converting to HookStats:", err)
-				return nil
-			}
-
-			hookStatsMap.Store(key, &hookStats)
-		}
-	}
-
-	return nil
-}
-func getHookSign(app string) Once {
-	stats := getOrCreateHookStats(app)
-	return stats.Once
-}
-
-func setHookSign(app string, sign string, createTime string) {
-	stats := getOrCreateHookStats(app)
-	stats.Once = Once{
-		Sign:       sign,
-		CreateTime: createTime,
+		// 未加载配置时使用默认规则
+		matcher, _ = NewArtifactMatcher(nil)
 	}
+	resource := webhookRequest.EventData.Resources[0]
+	return matcher.Match(resource.ResourceURL, resource.Tag)
 }
 
-func updateHookStats(app string, callsInc int32, errorsInc int32) {
-	stats := getOrCreateHookStats(app)
-	atomic.AddInt32(&stats.Calls, callsInc)
-	atomic.AddInt32(&stats.Errors, errorsInc)
-	hookStatsMap.Store(app, stats)
+func getHookConfig() *HookConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return hookConfig
 }
 
-func addHookCalls(app string, callsInc int32) {
-	stats := getOrCreateHookStats(app)
-	atomic.AddInt32(&stats.Calls, callsInc)
-	hookStatsMap.Store(app, stats)
+func setHookConfig(config *HookConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	hookConfig = config
 }
 
-func addHookErrors(app string, errorsInc int32) {
-	stats := getOrCreateHookStats(app)
-	atomic.AddInt32(&stats.Errors, errorsInc)
-	hookStatsMap.Store(app, stats)
+// hookAuthHandler 使用当前配置的认证处理 webhook 请求
+func hookAuthHandler(c *gin.Context) {
+	hookAuth.Load().(gin.HandlerFunc)(c)
 }
 
-func resetHookStats(app string) {
-	stats := getOrCreateHookStats(app)
-	atomic.StoreInt32(&stats.Calls, 0)
-	atomic.StoreInt32(&stats.Errors, 0)
+// apiAuthHandler 使用当前配置的认证处理查询接口的请求
+func apiAuthHandler(c *gin.Context) {
+	apiAuth.Load().(gin.HandlerFunc)(c)
 }
 
 // func wrappedHookHandler(c *gin.Context) {
@@ -332,142 +176,106 @@ func resetHookStats(app string) {
 // }
 // }
 
-func webHookHandler(c *gin.Context) {
-	var webhookRequest WebhookRequest
-	if err := c.ShouldBindJSON(&webhookRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	if len(webhookRequest.EventData.Resources) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no resources found"})
-		return
-	}
-
-	resourceURL := webhookRequest.EventData.Resources[0].ResourceURL
-
-	appName := getAppName(resourceURL)
-
-	if appName != "" && strings.Contains(resourceURL, "/build-hook/") {
-		addHookCalls(appName, 1)
-	} else {
-		return
-	}
+// newWebHookHandler 按 hookConfig 返回的当前配置确定事件的应用, 保存记录后加入处理队列
+func newWebHookHandler(hookConfig func() *HookConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var webhookRequest WebhookRequest
+		if err := c.ShouldBindJSON(&webhookRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	// harbor可能会重试多次
-	savedSign := getHookSign(appName)
-	currentCreateTime := getTimeFromTag(resourceURL)
-	// savedCreatedTime
-	currentSign, _ := json.Marshal(webhookRequest.EventData)
-	if savedSign.Sign != string(currentSign) {
-		if currentCreateTime > savedSign.CreateTime {
-			setHookSign(appName, string(currentSign), currentCreateTime)
-		} else {
-			log.Printf("[ WebHandler ] [ deprecated request ] from %s: %v", appName, resourceURL)
-			log.Printf("[ WebHandler ] [ deprecated request ] current sign: %s", currentSign)
-			log.Printf("[ WebHandler ] [ deprecated request ] saved sign: %s", savedSign)
-			log.Printf("[ WebHandler ] [ deprecated request ] currentCreateTime %s, saved createTime: %s", currentCreateTime, savedSign.CreateTime)
-			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		record, ignored, err := resolveEvent(hookConfig(), &webhookRequest)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-	} else {
-		log.Printf("[ WebHandler ] [ duplicate request ] from %s: %v", appName, resourceURL)
-		log.Printf("[ WebHandler ] [ duplicate request ] current sign: %s", currentSign)
-		log.Printf("[ WebHandler ] [ duplicate request ] saved sign: %s", savedSign)
-		c.JSON(http.StatusOK, gin.H{"status": "success"})
-		return
+		if ignored != "" {
+			log.Printf("[ WebHandler ] [ ignored request ] %s", ignored)
+			if record != nil {
+				recordHookEvent(record)
+				finishHookEvent(record, store.StatusIgnored, nil)
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+			return
+		}
+		recordHookEvent(record)
+		enqueueEvent(c, &webhookRequest, record)
 	}
+}
 
+// processPushArtifact 从 hook 镜像中取出文件, 发送构建详情邮件
+func processPushArtifact(h *handlers.HandlerConfig, webhookRequest *WebhookRequest, record *store.BuildRecord) error {
+	appName := record.App
+	resourceURL := webhookRequest.EventData.Resources[0].ResourceURL
 	namespace := webhookRequest.EventData.Repository.Namespace
 	// overwrite by appName
 	// name := webhookRequest.EventData.Repository.Name
 	tag := webhookRequest.EventData.Resources[0].Tag
 
-	mailBodyFile, attachments, err := handlers.ImageHandler(namespace, appName, tag, resourceURL)
+	hookFiles, err := h.ImageHandler(namespace, appName, tag, resourceURL, record.ID)
 	if err != nil {
-		addHookErrors(appName, 1)
-		c.JSON(http.StatusInternalServerError, gin.H{"Process image error": err.Error()})
-		return
+		return fmt.Errorf("process image error: %w", err)
 	}
 
-	if err := handlers.MailHandler(appName, mailBodyFile, attachments); err != nil {
-		addHookErrors(appName, 1)
-		c.JSON(http.StatusInternalServerError, gin.H{"Send mail error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
-}
-
-func resetStatCounters() {
-	var once sync.Once
-	resetHookStatsFunc := func() {
-		var wg sync.WaitGroup
-		hookStatsMap.Range(func(key, value interface{}) bool {
-			wg.Add(1)
-			hookStats, _ := value.(*HookStats)
-			go func(hookStats *HookStats) {
-				if err := resetSingleHookState(hookStats); err != nil {
-					log.Printf("[ ResetCounter ] Error handling hook stats for %s: %v", hookStats.Name, err)
-				}
-				wg.Done()
-			}(hookStats)
-			//清理 stats.json文件
-			if err := SaveMapToFile(); err != nil {
-				fmt.Printf("Error saving map to file: %v\n", err)
-			}
-			return true
-		})
-		wg.Wait()
+	event := newRecordEvent(webhookRequest, record)
+	buildInfo, err := h.MailHandler(event, hookFiles)
+	if buildInfo != nil {
+		record.Result = buildInfo.Result
+		if hookFiles.BuildJSON != "" {
+			record.Build = buildInfo
+		}
 	}
-
-	for {
-		now := time.Now()
-
-		nextResetTime := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-		resetDuration := nextResetTime.Sub(now)
-
-		log.Printf("[ ResetCounter ] Current time: %s\n", now.Format(time.RFC3339))
-		log.Printf("[ ResetCounter ] Next reset time: %s\n", nextResetTime.Format(time.RFC3339))
-		log.Printf("[ ResetCounter ] Waiting %.2f hours and %.2f minutes before reset statistics", math.Floor(resetDuration.Hours()), (resetDuration % time.Hour).Minutes())
-
-		time.Sleep(resetDuration)
-		log.Printf("[ ResetCounter ] Reset all stats counter now")
-		once.Do(resetHookStatsFunc)
+	if err := notifyResult(record, err); err != nil {
+		return fmt.Errorf("send mail error: %w", err)
 	}
-
+	return nil
 }
 
 func hookStatsInformerFunc() {
+	audit := getHookConfig().Hook.Audit
+	if audit.Mode == AuditModeDigest || audit.Mode == AuditModeBoth {
+		if err := informDigest(audit.Digest.MuteHealthy); err != nil {
+			log.Printf("Error informing digest: %v", err)
+		}
+		if audit.Mode == AuditModeDigest {
+			return
+		}
+	}
+
 	var wg sync.WaitGroup
 	jitterTime := time.Duration(rand.Intn(10)) * time.Second
-	hookStatsMap.Range(func(key, value interface{}) bool {
+	hookConfig := getHookConfig()
+	now := time.Now()
+	for _, hookStats := range listHookStats() {
+		app, _ := hookConfig.GetApp(hookStats.Name)
+		if app.Expect.Cron != "" {
+			// 按应用自己的 expect.cron 检查
+			continue
+		}
+		result := newExpectResult(app, hookStats, startOfDay(now), now, getCalendar())
 		wg.Add(1)
-		hookStats, _ := value.(*HookStats)
-		go func(hookStats *HookStats) {
+		go func(app AppConfig, result *ExpectResult) {
 			time.Sleep(jitterTime)
-			if err := informHookStats(hookStats); err != nil {
-				log.Printf("Error informing hook stats for %s: %v", hookStats.Name, err)
+			if err := informHookStats(app, result); err != nil {
+				log.Printf("Error informing hook stats for %s: %v", app.Name, err)
 			}
 			wg.Done()
-		}(hookStats)
-		return true
-	})
+		}(app, result)
+	}
 	wg.Wait()
 }
 
-func informHookStatsByExactTime() {
-	var once sync.Once
-	config := getHookConfig()
-
-	informTimeList := config.Hook.Audit.InformTime
+func informHookStatsByExactTime(ctx context.Context, informTimes []string) {
+	informTimeList := append([]string{}, informTimes...)
 	sort.Strings(informTimeList)
 	for {
 		now := time.Now()
 		for i, timeStr := range informTimeList {
 			criticalTime, err := time.ParseInLocation("15:04", timeStr, time.Local)
 			if err != nil {
-				log.Fatalf("[ InformByExactTime ] Error parsing time string %s, err: %v", timeStr, err)
+				log.Printf("[ InformByExactTime ] Error parsing time string %s, err: %v", timeStr, err)
+				return
 			}
 			criticalTime = time.Date(now.Year(), now.Month(), now.Day(), criticalTime.Hour(), criticalTime.Minute(), 0, 0, time.Local)
 
@@ -476,14 +284,17 @@ func informHookStatsByExactTime() {
 			if now.Before(criticalTime) || now.Equal(criticalTime) {
 				waitTime := criticalTime.Sub(now)
 				log.Printf("[ InformByExactTime ] Waiting %.2f hours and %.2f minutes before inform trigger", math.Floor(waitTime.Hours()), (waitTime % time.Hour).Minutes())
-				time.Sleep(waitTime)
+				if !sleepContext(ctx, waitTime) {
+					log.Printf("[ InformByExactTime ] Schedule of %v stopped", informTimeList)
+					return
+				}
 				log.Printf("[ InformByExactTime ] Inform critical time %s has passed, trigger inform", timeStr)
-				once.Do(hookStatsInformerFunc)
+				informOncePerDay()
 			} else {
 				// 如果当前时间大于最大的时间, 则执行一次
 				if i == len(informTimeList)-1 {
 					log.Printf("[ InformByExactTime ] inform at least once after %s", timeStr)
-					once.Do(hookStatsInformerFunc)
+					informOncePerDay()
 				} else {
 					log.Printf("[ InformByExactTime ] ignore validation for %s, wait for next inform time", timeStr)
 				}
@@ -494,65 +305,146 @@ func informHookStatsByExactTime() {
 		nextDayTime := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
 		waitDuration := nextDayTime.Sub(now)
 		log.Printf("[ InformByExactTime ] Waiting %.2f hours and %.2f minutes before new daily routine", math.Floor(waitDuration.Hours()), (waitDuration % time.Hour).Minutes())
-		time.Sleep(waitDuration)
+		if !sleepContext(ctx, waitDuration) {
+			log.Printf("[ InformByExactTime ] Schedule of %v stopped", informTimeList)
+			return
+		}
 	}
 
 }
 
-func informHookStatsByCronExpr() {
-	config := getHookConfig()
-	cronExpr := config.Hook.Audit.InformCron
-
-	if len(cronExpr) > 0 {
-		c := cron.New(cron.WithSeconds()) // 启用秒级精度
+// sleepContext 等待 d, ctx 取消时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
 
-		// 解析cron表达式并添加任务
-		_, err := c.AddFunc(cronExpr, hookStatsInformerFunc)
-		if err != nil {
-			fmt.Println("解析cron表达式时出错:", err)
-			return
+// informOncePerDay 按 inform-time 的检查每天只通知一次, 通知日期保存在存储中, 重启和重新调度后不会重复通知
+func informOncePerDay() {
+	today := time.Now().Format("2006-01-02")
+	var informed string
+	s := getBuildStore()
+	if s != nil {
+		if _, err := s.GetState(exactInformKey, &informed); err != nil {
+			log.Printf("[ InformByExactTime ] Failed to read last inform date: %v", err)
+		}
+	}
+	if informed == today {
+		log.Printf("[ InformByExactTime ] Already informed today, skip")
+		return
+	}
+	hookStatsInformerFunc()
+	if s != nil {
+		if err := s.PutState(exactInformKey, today); err != nil {
+			log.Printf("[ InformByExactTime ] Failed to save last inform date: %v", err)
 		}
+	}
+}
 
-		// 启动cron调度器
-		c.Start()
+func informHookStatsByCronExpr(cronExpr string) *cron.Cron {
+	if len(cronExpr) == 0 {
+		return nil
 	}
+
+	c := cron.New(cron.WithSeconds()) // 启用秒级精度
+
+	// 解析cron表达式并添加任务
+	_, err := c.AddFunc(cronExpr, hookStatsInformerFunc)
+	if err != nil {
+		fmt.Println("解析cron表达式时出错:", err)
+		return nil
+	}
+
+	// 启动cron调度器
+	c.Start()
+	return c
 }
 
-func resetSingleHookState(hookStats *HookStats) error {
+// scheduleInformers 按配置启动定时检查, 已有的调度会先停止
+func scheduleInformers(hookConfig *HookConfig) {
+	informMutex.Lock()
+	defer informMutex.Unlock()
+	stopInformersLocked()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	informCancel = cancel
+	informCron = informHookStatsByCronExpr(hookConfig.Hook.Audit.InformCron)
+	expectCron = scheduleExpectations(hookConfig)
+	go informHookStatsByExactTime(ctx, hookConfig.Hook.Audit.InformTime)
+}
 
-	// if err := informHookStats(hookStats); err != nil {
-	// 	log.Printf("Inform for hook failed %v", err)
-	// 	return err
-	// }
+// InformersScheduled 是否有定时检查在运行, 只有 leader 调度
+func InformersScheduled() bool {
+	informMutex.Lock()
+	defer informMutex.Unlock()
+	return informCancel != nil
+}
 
-	// 重置统计计数
-	resetHookStats(hookStats.Name)
-	log.Printf("Hook stats reset for %s\n", hookStats.Name)
-	return nil
+// stopInformers 停止所有定时检查
+func stopInformers() {
+	informMutex.Lock()
+	defer informMutex.Unlock()
+	stopInformersLocked()
+}
+
+func stopInformersLocked() {
+	if informCron != nil {
+		informCron.Stop()
+		informCron = nil
+	}
+	if informCancel != nil {
+		informCancel()
+		informCancel = nil
+	}
+	if expectCron != nil {
+		expectCron.Stop()
+		expectCron = nil
+	}
+}
+
+func newStatsMailData(hookStats *HookStats) *handlers.MailData {
+	return &handlers.MailData{
+		App:      hookStats.Name,
+		Calls:    hookStats.Calls,
+		Errors:   hookStats.Errors,
+		Rejected: hookStats.Rejected,
+	}
 }
 
-func informHookStats(hookStats *HookStats) error {
-	if hookStats.Calls == 0 {
-		log.Printf("No hook calls received today for %s\n", hookStats.Name)
-		// 发送没有收到构建的失败邮件
-		if err := handlers.SendFailEmail(hookStats.Name); err != nil {
-			log.Printf("Failed to send failure email: %v", err)
+// informHookStats 收到的构建不足时发送没有构建的通知, 存在报错时发送警告, 节假日和不预期构建的日期不发送没有构建的通知
+func informHookStats(app AppConfig, result *ExpectResult) error {
+	h := handlers.CurrentConfig()
+	data := newExpectMailData(app, result)
+	switch {
+	case result.Missing():
+		log.Printf("%d hook calls received for %s since %s, expect at least %d\n", result.Calls, result.Name, result.Since.Format(time.RFC3339), result.MinBuilds)
+		// 发送没有收到构建的失败通知
+		if err := h.SendFailNotice(data); err != nil {
+			log.Printf("Failed to send failure notice: %v", err)
 			return err
 		}
-	} else if hookStats.Errors > 0 {
-		log.Printf("There were %d hook call errors today for %s", hookStats.Errors, hookStats.Name)
-		// 发送失败邮件
-		if err := handlers.SendWarnEmail(hookStats.Name); err != nil {
-			log.Printf("Failed to send warning email: %v", err)
+	case result.Errors > 0:
+		log.Printf("There were %d hook call errors today for %s", result.Errors, result.Name)
+		// 发送警告通知
+		if err := h.SendWarnNotice(data); err != nil {
+			log.Printf("Failed to send warning notice: %v", err)
 			return err
 		}
 		// } else {
 		// 	// 处理成功, 也发送邮件, 详情邮件在触发的时候已经发过了
 		// 	log.Printf("Hook calls successful today for %s\n", hookStats.Name)
-		// 	if err := handlers.SendSuccessEmail(hookStats.Name); err != nil {
+		// 	if err := handlers.SendSuccessNotice(newStatsMailData(hookStats)); err != nil {
 		// 		log.Printf("Failed to send warning email: %v", err)
 		// 		return err
 		// 	}
+	case int(result.Calls) < result.MinBuilds:
+		log.Printf("[ Expect ] %d hook calls received for %s, builds are not expected on %s %s, skip", result.Calls, result.Name, result.Until.Format("2006-01-02 Mon"), result.Holiday)
 	}
 	return nil
 }
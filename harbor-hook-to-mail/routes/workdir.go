@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"log"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/exyb/harbor-hook-to-mail/workdir"
+)
+
+// 最近一小时内修改的事件目录可能还在处理, 超过大小上限时也保留
+const workDirMinAge = time.Hour
+
+var eventWorkDir *workdir.WorkDir
+
+// openWorkDir 创建取出镜像文件的工作目录, 修改 work 需要重启
+func openWorkDir(workConfig WorkConfig) error {
+	if eventWorkDir != nil {
+		return nil
+	}
+	options := workConfig.Work
+	w, err := workdir.New(options.Dir, workdir.Options{
+		Retention: options.Retention,
+		MaxSize:   int64(options.MaxSize),
+		Interval:  options.CleanupInterval,
+		MinAge:    workDirMinAge,
+	})
+	if err != nil {
+		return err
+	}
+	w.InUse = pendingAttachments
+	eventWorkDir = w
+	handlers.SetWorkDir(w)
+	return nil
+}
+
+// pendingAttachments 待发送通知的附件不能清理
+func pendingAttachments() ([]string, error) {
+	s := getBuildStore()
+	if s == nil {
+		return nil, nil
+	}
+	mails, err := s.Mails(store.MailPending)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, mail := range mails {
+		files = append(files, mail.Attachments...)
+	}
+	return files, nil
+}
+
+// startWorkDirCleanup 只由 leader 清理, 其他副本不处理事件
+func startWorkDirCleanup() {
+	if eventWorkDir == nil {
+		return
+	}
+	eventWorkDir.Start()
+	log.Printf("[ WorkDir ] Cleaning up %s", eventWorkDir.Root())
+}
+
+func stopWorkDirCleanup() {
+	if eventWorkDir != nil {
+		eventWorkDir.Stop()
+	}
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 去重结果
+const (
+	DedupAccepted  = "accepted"
+	DedupDuplicate = "duplicate"
+	// 同一个 tag 已经处理过更新的推送
+	DedupStale = "stale"
+)
+
+var dedupBucket = []byte("dedup")
+
+// DedupEntry 去重窗口内最近一次接受的事件
+type DedupEntry struct {
+	Digest   string    `json:"digest"`
+	OccurAt  time.Time `json:"occur_at"`
+	SeenAt   time.Time `json:"seen_at"`
+	RecordID uint64    `json:"record_id"`
+}
+
+// Dedup 在一个事务中检查并记录事件, 并发请求中同一个事件只会被接受一次.
+// key 对应 ttl 内接受过的事件时, digest 相同为重复事件, 发生时间更早为过期事件, 否则接受并替换.
+// 返回结果和之前接受的事件
+func (s *Store) Dedup(key string, entry DedupEntry, ttl time.Duration) (string, *DedupEntry, error) {
+	if entry.SeenAt.IsZero() {
+		entry.SeenAt = time.Now()
+	}
+	verdict := DedupAccepted
+	var prev *DedupEntry
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dedupBucket)
+		if data := bucket.Get([]byte(key)); data != nil {
+			prev = &DedupEntry{}
+			if err := json.Unmarshal(data, prev); err != nil {
+				return err
+			}
+			if entry.SeenAt.Sub(prev.SeenAt) < ttl {
+				switch {
+				case prev.Digest == entry.Digest:
+					verdict = DedupDuplicate
+					return nil
+				case entry.OccurAt.Before(prev.OccurAt):
+					verdict = DedupStale
+					return nil
+				}
+			}
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
+	return verdict, prev, err
+}
+
+// UndoDedup 撤销 Dedup 接受的 entry, e.g. 事件没有加入处理队列, 避免 Harbor 重试时被当作重复事件.
+// key 仍然是 entry 时恢复之前的事件 prev, prev 为 nil 时删除, 已被其他事件替换时不修改
+func (s *Store) UndoDedup(key string, entry DedupEntry, prev *DedupEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dedupBucket)
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		var current DedupEntry
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+		if current.RecordID != entry.RecordID || current.Digest != entry.Digest || !current.SeenAt.Equal(entry.SeenAt) {
+			return nil
+		}
+		if prev == nil {
+			return bucket.Delete([]byte(key))
+		}
+		data, err := json.Marshal(prev)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+// pruneDedup 删除 before 之前的去重记录
+func pruneDedup(tx *bolt.Tx, before time.Time) (int, error) {
+	bucket := tx.Bucket(dedupBucket)
+	expired := make([][]byte, 0)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var entry DedupEntry
+		if err := json.Unmarshal(v, &entry); err != nil || entry.SeenAt.Before(before) {
+			expired = append(expired, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
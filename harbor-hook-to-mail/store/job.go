@@ -0,0 +1,143 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 任务状态
+const (
+	JobPending = "pending"
+	// 多次重试仍然失败, 不再处理
+	JobDead = "dead"
+)
+
+// ErrQueueFull 待处理的任务数达到上限
+var ErrQueueFull = errors.New("queue is full")
+
+var (
+	jobsBucket = []byte("jobs")
+	deadBucket = []byte("dead-letters")
+)
+
+// Job 待处理的 webhook 事件, 处理成功后删除, 多次失败后移入死信列表
+type Job struct {
+	ID   uint64 `json:"id"`
+	App  string `json:"app"`
+	Type string `json:"type"`
+	// 事件记录, 处理过程中更新
+	Record *BuildRecord `json:"record"`
+	// 原始的 webhook 请求
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func putJob(bucket *bolt.Bucket, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(jobKey(job.ID), data)
+}
+
+// AddJob 保存新任务, 分配 ID
+func (s *Store) AddJob(job *Job) error {
+	return s.AddJobLimited(job, 0)
+}
+
+// AddJobLimited 在同一个事务中检查任务数量并保存, 待处理的任务数达到 size 时返回 ErrQueueFull, size <= 0 不限制
+func (s *Store) AddJobLimited(job *Job, size int) error {
+	now := time.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	if job.NextAttempt.IsZero() {
+		job.NextAttempt = now
+	}
+	job.State, job.UpdatedAt = JobPending, now
+	return s.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+		if size > 0 && jobs.Stats().KeyN >= size {
+			return ErrQueueFull
+		}
+		id, err := jobs.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+		return putJob(jobs, job)
+	})
+}
+
+// UpdateJob 更新任务, 状态为 JobDead 时移入死信列表
+func (s *Store) UpdateJob(job *Job) error {
+	job.UpdatedAt = time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+		if job.State == JobDead {
+			if err := jobs.Delete(jobKey(job.ID)); err != nil {
+				return err
+			}
+			return putJob(tx.Bucket(deadBucket), job)
+		}
+		return putJob(jobs, job)
+	})
+}
+
+// DeleteJob 删除处理完成的任务
+func (s *Store) DeleteJob(id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete(jobKey(id))
+	})
+}
+
+// Jobs 按 ID 排序的任务, state 为 JobPending 或 JobDead
+func (s *Store) Jobs(state string) ([]Job, error) {
+	name := jobsBucket
+	switch state {
+	case JobPending:
+	case JobDead:
+		name = deadBucket
+	default:
+		return nil, fmt.Errorf("unknown job state %q", state)
+	}
+
+	jobs := make([]Job, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// CountJobs 待处理的任务数量
+func (s *Store) CountJobs() (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(jobsBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var outboxBucket = []byte("outbox")
+
+// Mail outbox 中待发送的一条通知, 每个渠道一条, Status 使用 MailPending, MailSent, MailFailed
+type Mail struct {
+	ID      uint64 `json:"id"`
+	App     string `json:"app"`
+	Channel string `json:"channel"`
+	// 关联的构建记录, 发送结束后更新记录的通知状态, 定时统计通知为 0
+	RecordID    uint64   `json:"record_id,omitempty"`
+	Title       string   `json:"title"`
+	Body        string   `json:"body,omitempty"`
+	BodyType    string   `json:"body_type,omitempty"`
+	Summary     string   `json:"summary,omitempty"`
+	Attachments []string `json:"attachments,omitempty"`
+	Outcome     string   `json:"outcome,omitempty"`
+
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	SentAt      time.Time `json:"sent_at,omitempty"`
+}
+
+func putMail(bucket *bolt.Bucket, mail *Mail) error {
+	data, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(jobKey(mail.ID), data)
+}
+
+// AddMail 保存待发送的通知, 分配 ID
+func (s *Store) AddMail(mail *Mail) error {
+	now := time.Now()
+	if mail.CreatedAt.IsZero() {
+		mail.CreatedAt = now
+	}
+	if mail.NextAttempt.IsZero() {
+		mail.NextAttempt = now
+	}
+	mail.Status, mail.UpdatedAt = MailPending, now
+	return s.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		id, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		mail.ID = id
+		return putMail(outbox, mail)
+	})
+}
+
+// UpdateMail 更新通知的发送状态
+func (s *Store) UpdateMail(mail *Mail) error {
+	mail.UpdatedAt = time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putMail(tx.Bucket(outboxBucket), mail)
+	})
+}
+
+// GetMail 按 ID 查询通知, 不存在时返回 nil
+func (s *Store) GetMail(id uint64) (*Mail, error) {
+	var mail *Mail
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(outboxBucket).Get(jobKey(id))
+		if data == nil {
+			return nil
+		}
+		mail = &Mail{}
+		return json.Unmarshal(data, mail)
+	})
+	return mail, err
+}
+
+// Mails 按 ID 排序的通知, status 为空时返回全部
+func (s *Store) Mails(status string) ([]Mail, error) {
+	switch status {
+	case "", MailPending, MailSent, MailFailed:
+	default:
+		return nil, fmt.Errorf("unknown mail status %q", status)
+	}
+
+	mails := make([]Mail, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var mail Mail
+			if err := json.Unmarshal(v, &mail); err != nil {
+				return err
+			}
+			if status == "" || mail.Status == status {
+				mails = append(mails, mail)
+			}
+			return nil
+		})
+	})
+	return mails, err
+}
+
+// UpdateRecordMailStatus 按 outbox 中构建记录每个渠道的通知计算记录的通知状态:
+// 有渠道待发送时为 MailPending, 否则有渠道失败时为 MailFailed, 全部发送成功时为 MailSent
+func (s *Store) UpdateRecordMailStatus(app string, id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		status, failures := "", make([]string, 0)
+		err := tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var mail Mail
+			if err := json.Unmarshal(v, &mail); err != nil {
+				return err
+			}
+			if mail.RecordID != id || mail.App != app {
+				return nil
+			}
+			switch {
+			case mail.Status == MailPending:
+				status = MailPending
+			case mail.Status == MailFailed:
+				failures = append(failures, mail.Channel+": "+mail.LastError)
+				if status != MailPending {
+					status = MailFailed
+				}
+			case status == "":
+				status = MailSent
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if status == "" {
+			return fmt.Errorf("no mail of record %d of %s in outbox", id, app)
+		}
+
+		builds := tx.Bucket(buildsBucket)
+		bucket := builds.Bucket([]byte(app))
+		if bucket == nil {
+			return fmt.Errorf("record %d of %s not found", id, app)
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if binaryID(k) != id {
+				continue
+			}
+			var record BuildRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			record.MailStatus, record.MailError = status, strings.Join(failures, "; ")
+			return putRecord(builds, &record)
+		}
+		return fmt.Errorf("record %d of %s not found", id, app)
+	})
+}
+
+// pruneOutbox 删除 before 之前已经发送结束的通知, 待发送的通知保留
+func pruneOutbox(tx *bolt.Tx, before time.Time) error {
+	bucket := tx.Bucket(outboxBucket)
+	expired := make([][]byte, 0)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var mail Mail
+		if err := json.Unmarshal(v, &mail); err != nil || (mail.Status != MailPending && mail.UpdatedAt.Before(before)) {
+			expired = append(expired, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
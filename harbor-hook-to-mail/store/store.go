@@ -0,0 +1,352 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 记录状态
+const (
+	StatusReceived = "received"
+	// 已加入处理队列
+	StatusQueued     = "queued"
+	StatusProcessed  = "processed"
+	StatusFailed     = "failed"
+	StatusDuplicate  = "duplicate"
+	StatusDeprecated = "deprecated"
+	StatusRejected   = "rejected"
+	StatusIgnored    = "ignored"
+)
+
+// 通知发送状态
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailFailed  = "failed"
+	MailSkipped = "skipped"
+)
+
+var (
+	buildsBucket = []byte("builds")
+	stateBucket  = []byte("state")
+)
+
+// BuildInfo hook 镜像中 /build.json 的构建信息
+type BuildInfo struct {
+	// SUCCESS, FAILURE, UNSTABLE, ABORTED, NOT_BUILT
+	Result string `json:"result"`
+	// 构建耗时, 秒
+	Duration int64  `json:"duration,omitempty"`
+	Branch   string `json:"branch,omitempty"`
+	Commit   string `json:"commit,omitempty"`
+	// 失败的 pipeline 阶段
+	FailedStage string `json:"failed_stage,omitempty"`
+	// Jenkins 构建地址
+	URL   string      `json:"url,omitempty"`
+	Tests *TestCounts `json:"tests,omitempty"`
+}
+
+type TestCounts struct {
+	Total   int `json:"total"`
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+}
+
+// BuildRecord 一次 webhook 事件的处理记录
+type BuildRecord struct {
+	ID          uint64 `json:"id"`
+	App         string `json:"app"`
+	Type        string `json:"type"`
+	Tag         string `json:"tag"`
+	Digest      string `json:"digest"`
+	ResourceURL string `json:"resource_url"`
+	// hook.match 中 tag 的 env 和 timestamp 分组
+	Env     string    `json:"env,omitempty"`
+	BuiltAt time.Time `json:"built_at,omitempty"`
+	// SUCCESS, FAILURE, UNSTABLE, ABORTED, UNKNOWN 等, 非构建事件为空
+	Result string `json:"result,omitempty"`
+	// 镜像中有 /build.json 时的构建信息
+	Build  *BuildInfo `json:"build,omitempty"`
+	Status string     `json:"status"`
+	Error  string     `json:"error,omitempty"`
+	// 重复或过期事件被丢弃的原因
+	DropReason  string    `json:"drop_reason,omitempty"`
+	MailStatus  string    `json:"mail_status,omitempty"`
+	MailError   string    `json:"mail_error,omitempty"`
+	OccurAt     time.Time `json:"occur_at"`
+	ReceivedAt  time.Time `json:"received_at"`
+	ProcessedAt time.Time `json:"processed_at,omitempty"`
+}
+
+// Store 基于 bbolt 的构建记录存储, 每个应用一个子 bucket, key 为接收时间和 ID, 按时间有序
+type Store struct {
+	db        *bolt.DB
+	retention time.Duration
+	// 关闭后停止定期清理
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func Open(path string, retention time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{buildsBucket, stateBucket, jobsBucket, deadBucket, dedupBucket, outboxBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, retention: retention, closed: make(chan struct{})}, nil
+}
+
+// ErrClosed 存储已经关闭, e.g. 失去 leader 时还在处理的请求
+var ErrClosed = bolt.ErrDatabaseNotOpen
+
+// ErrLocked 只读打开时其他进程持有写锁
+var ErrLocked = errors.New("store is locked by another process")
+
+// OpenReadOnly 只读打开已有的存储, 用于命令行查询. 服务进程持有写锁时等待 timeout 后返回错误
+func OpenReadOnly(path string, timeout time.Duration) (*Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: true})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %s: %w", path, err)
+	}
+	return &Store{db: db, closed: make(chan struct{})}, nil
+}
+
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.db.Close()
+}
+
+func recordKey(receivedAt time.Time, id uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(receivedAt.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], id)
+	return key
+}
+
+// binaryID 记录 key 中的 ID
+func binaryID(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[8:])
+}
+
+// timeKey 时间对应的 key 前缀, 零值时间为最小的 key
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	}
+	return key
+}
+
+// Add 保存新记录, 分配 ID, ReceivedAt 为空时使用当前时间
+func (s *Store) Add(record *BuildRecord) error {
+	if record.App == "" {
+		return fmt.Errorf("record without app")
+	}
+	if record.ReceivedAt.IsZero() {
+		record.ReceivedAt = time.Now()
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		builds := tx.Bucket(buildsBucket)
+		id, err := builds.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.ID = id
+		return putRecord(builds, record)
+	})
+}
+
+// Update 更新已保存的记录, 通知状态由 outbox 发送后更新, 不会被 MailPending 覆盖
+func (s *Store) Update(record *BuildRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		builds := tx.Bucket(buildsBucket)
+		if record.MailStatus == MailPending {
+			if bucket := builds.Bucket([]byte(record.App)); bucket != nil {
+				if data := bucket.Get(recordKey(record.ReceivedAt, record.ID)); data != nil {
+					var saved BuildRecord
+					if err := json.Unmarshal(data, &saved); err == nil && saved.MailStatus != MailPending && saved.MailStatus != "" {
+						record.MailStatus, record.MailError = saved.MailStatus, saved.MailError
+					}
+				}
+			}
+		}
+		return putRecord(builds, record)
+	})
+}
+
+func putRecord(builds *bolt.Bucket, record *BuildRecord) error {
+	bucket, err := builds.CreateBucketIfNotExists([]byte(record.App))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(recordKey(record.ReceivedAt, record.ID), data)
+}
+
+// List 查询应用在 [since, until) 内收到的记录, until 为空时不限制, 按接收时间排序
+func (s *Store) List(app string, since time.Time, until time.Time) ([]BuildRecord, error) {
+	records := make([]BuildRecord, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(buildsBucket).Bucket([]byte(app))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(timeKey(since)); k != nil; k, v = c.Next() {
+			if !until.IsZero() && binary.BigEndian.Uint64(k[:8]) >= uint64(until.UnixNano()) {
+				break
+			}
+			var record BuildRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Last 应用最近的一条满足条件的记录
+func (s *Store) Last(app string, match func(record *BuildRecord) bool) (*BuildRecord, error) {
+	var found *BuildRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(buildsBucket).Bucket([]byte(app))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var record BuildRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if match == nil || match(&record) {
+				found = &record
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Apps 有记录的应用
+func (s *Store) Apps() ([]string, error) {
+	apps := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(buildsBucket).ForEach(func(k, v []byte) error {
+			if v == nil {
+				apps = append(apps, string(k))
+			}
+			return nil
+		})
+	})
+	sort.Strings(apps)
+	return apps, err
+}
+
+// Prune 删除 before 之前收到的记录, 去重记录和已发送结束的通知, 返回删除的记录数量
+func (s *Store) Prune(before time.Time) (int, error) {
+	deleted := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := pruneDedup(tx, before); err != nil {
+			return err
+		}
+		if err := pruneOutbox(tx, before); err != nil {
+			return err
+		}
+		builds := tx.Bucket(buildsBucket)
+		return builds.ForEach(func(app, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			c := builds.Bucket(app).Cursor()
+			end := timeKey(before)
+			for k, _ := c.First(); k != nil && bytes.Compare(k[:8], end) < 0; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				deleted++
+			}
+			return nil
+		})
+	})
+	return deleted, err
+}
+
+// RunRetention 按保留时间定期清理记录, retention 为 0 时不清理, 存储关闭后返回
+func (s *Store) RunRetention(interval time.Duration) {
+	if s.retention <= 0 {
+		return
+	}
+	for {
+		deleted, err := s.Prune(time.Now().Add(-s.retention))
+		if err != nil {
+			log.Printf("[ Store ] Failed to prune records: %v", err)
+		} else if deleted > 0 {
+			log.Printf("[ Store ] Pruned %d records older than %s", deleted, s.retention)
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// GetState 读取 key 对应的状态, 不存在时返回 false
+func (s *Store) GetState(key string, value interface{}) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(stateBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, value)
+	})
+	return found, err
+}
+
+// PutState 保存 key 对应的状态
+func (s *Store) PutState(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put([]byte(key), data)
+	})
+}
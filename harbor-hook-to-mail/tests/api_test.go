@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAPIEngine(t *testing.T) (*gin.Engine, *store.Store) {
+	gin.SetMode(gin.TestMode)
+	s := openTestStore(t)
+	hookConfig := &HookConfig{}
+	hookConfig.Hook.Apps = []AppConfig{{Name: "demo-app", Channels: []string{"email"}}, {Name: "demo-ui"}}
+
+	r := gin.New()
+	routes.RegisterAPI(r, s, func() *HookConfig { return hookConfig })
+	return r, s
+}
+
+func getAPI(t *testing.T, r *gin.Engine, path string, v interface{}) int {
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if v != nil && w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+func addBuild(t *testing.T, s *store.Store, app string, status string, result string, receivedAt time.Time) {
+	assert.NoError(t, s.Add(&store.BuildRecord{
+		App:        app,
+		Type:       EventPushArtifact,
+		Tag:        "test_" + receivedAt.Format("20060102150405"),
+		Status:     status,
+		Result:     result,
+		ReceivedAt: receivedAt,
+	}))
+}
+
+func TestAPIApps(t *testing.T) {
+	r, s := newAPIEngine(t)
+	now := time.Now()
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", now.Add(-time.Second))
+	addBuild(t, s, "demo-app", store.StatusDuplicate, "", now)
+	addBuild(t, s, "removed-app", store.StatusProcessed, "SUCCESS", now)
+
+	var apps []routes.AppStatus
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps", &apps))
+	if assert.Len(t, apps, 3) {
+		assert.Equal(t, "demo-app", apps[0].Name)
+		assert.True(t, apps[0].Configured)
+		assert.Equal(t, []string{"email"}, apps[0].Channels)
+		assert.Equal(t, int32(2), apps[0].Today.Calls)
+		assert.Equal(t, int32(1), apps[0].Today.Duplicates)
+		assert.True(t, apps[0].Today.Built)
+		assert.True(t, apps[0].Today.Succeeded)
+
+		assert.Equal(t, "demo-ui", apps[1].Name)
+		assert.False(t, apps[1].Today.Built)
+
+		assert.Equal(t, "removed-app", apps[2].Name)
+		assert.False(t, apps[2].Configured)
+	}
+}
+
+func TestAPIAppStats(t *testing.T) {
+	r, s := newAPIEngine(t)
+	yesterday := time.Now().AddDate(0, 0, -1)
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", yesterday)
+	addBuild(t, s, "demo-app", store.StatusFailed, "FAILURE", time.Now())
+
+	var stats routes.AppStats
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps/demo-app/stats", &stats))
+	assert.True(t, stats.Built)
+	assert.False(t, stats.Succeeded)
+	assert.Equal(t, int32(1), stats.Errors)
+	if assert.NotNil(t, stats.LastSuccess) {
+		assert.Equal(t, "SUCCESS", stats.LastSuccess.Result)
+	}
+
+	stats = routes.AppStats{}
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps/demo-app/stats?date="+yesterday.Format("2006-01-02"), &stats))
+	assert.True(t, stats.Succeeded)
+	assert.Equal(t, int32(0), stats.Errors)
+
+	assert.Equal(t, http.StatusBadRequest, getAPI(t, r, "/api/apps/demo-app/stats?date=yesterday", nil))
+	assert.Equal(t, http.StatusNotFound, getAPI(t, r, "/api/apps/unknown/stats", nil))
+}
+
+func TestAPIAppBuilds(t *testing.T) {
+	r, s := newAPIEngine(t)
+	now := time.Now()
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", now.Add(-48*time.Hour))
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", now.Add(-2*time.Second))
+	addBuild(t, s, "demo-app", store.StatusDuplicate, "", now.Add(-time.Second))
+
+	var builds []store.BuildRecord
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps/demo-app/builds?since=72h", &builds))
+	assert.Len(t, builds, 3)
+
+	builds = nil
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps/demo-app/builds?since=72h&status=processed&limit=1", &builds))
+	if assert.Len(t, builds, 1) {
+		assert.Equal(t, now.Add(-2*time.Second).Unix(), builds[0].ReceivedAt.Unix())
+	}
+
+	builds = nil
+	since := now.Add(-time.Hour).Format(time.RFC3339)
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps/demo-app/builds?since="+since, &builds))
+	assert.Len(t, builds, 2)
+
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/apps/demo-ui/builds", &builds))
+	assert.Empty(t, builds)
+	assert.Equal(t, http.StatusBadRequest, getAPI(t, r, "/api/apps/demo-app/builds?since=never", nil))
+	assert.Equal(t, http.StatusNotFound, getAPI(t, r, "/api/apps/unknown/builds", nil))
+}
+
+func TestAPIAuth(t *testing.T) {
+	r := newTestRouter(t, "  auth:\n    secret: harbor-secret\n    allow-cidrs: [10.0.0.0/8]\n  apps:\n  - name: demo-app\n")
+	rejected := routes.UnattributedRejected()
+
+	request := func(path string, remoteAddr string, authorization string) int {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, path := range []string{"/api/apps", "/api/apps/demo-app/builds", "/api/outbox", "/api/outbox/1"} {
+		assert.Equal(t, http.StatusUnauthorized, request(path, "10.0.0.1:1234", ""), path)
+		assert.Equal(t, http.StatusUnauthorized, request(path, "10.0.0.1:1234", "wrong-secret"), path)
+		assert.Equal(t, http.StatusForbidden, request(path, "192.168.1.1:1234", "harbor-secret"), path)
+	}
+	assert.Equal(t, http.StatusOK, request("/api/apps/demo-app/builds", "10.0.0.1:1234", "harbor-secret"))
+	assert.Equal(t, http.StatusNotFound, request("/api/outbox/1", "10.0.0.1:1234", "harbor-secret"))
+	// 被拒绝的查询不是 webhook 请求
+	assert.Equal(t, rejected, routes.UnattributedRejected())
+}
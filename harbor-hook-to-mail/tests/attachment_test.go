@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeBuildLog(t *testing.T, lines []string) string {
+	path := filepath.Join(t.TempDir(), "test.build.log")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+	return path
+}
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func testAttachment(t *testing.T) Attachment {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("email:\n  server: localhost\n"), 0600))
+	config, err := Read(path)
+	assert.NoError(t, err)
+	return config.Email.Attachment
+}
+
+func TestBuildLogExcerpt(t *testing.T) {
+	path := writeBuildLog(t, []string{
+		"[INFO] Compiling 12 source files",
+		"[ERROR] Failed to execute goal on project demo-app",
+		"Tests run: 42, Failures: 0, Errors: 0, Skipped: 1",
+		"Tests run: 12, Failures: 2, Errors: 0, Skipped: 0",
+		"--- FAIL: TestLogin (0.01s)",
+		"BUILD FAILED in 1m 2s",
+	})
+	buildLog, err := handlers.PrepareBuildLog(path, testAttachment(t))
+	assert.NoError(t, err)
+	assert.Equal(t, path, buildLog.Path)
+	assert.False(t, buildLog.Compressed)
+	assert.Equal(t, []string{
+		"[ERROR] Failed to execute goal on project demo-app",
+		"Tests run: 12, Failures: 2, Errors: 0, Skipped: 0",
+		"--- FAIL: TestLogin (0.01s)",
+		"BUILD FAILED in 1m 2s",
+	}, buildLog.Excerpt)
+
+	attachment := testAttachment(t)
+	attachment.Excerpt.MaxLines = 2
+	buildLog, err = handlers.PrepareBuildLog(path, attachment)
+	assert.NoError(t, err)
+	assert.Len(t, buildLog.Excerpt, 2)
+
+	attachment.Excerpt.Patterns = []string{"("}
+	_, err = handlers.PrepareBuildLog(path, attachment)
+	assert.Error(t, err)
+	assert.Error(t, attachment.Validate())
+}
+
+func TestBuildLogCompress(t *testing.T) {
+	lines := make([]string, 20000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("[INFO] step %d done", i)
+	}
+	path := writeBuildLog(t, lines)
+	attachment := testAttachment(t)
+	attachment.MaxSize = 64 << 10
+
+	buildLog, err := handlers.PrepareBuildLog(path, attachment)
+	assert.NoError(t, err)
+	assert.Equal(t, path+".gz", buildLog.Path)
+	assert.True(t, buildLog.Compressed)
+	assert.False(t, buildLog.Truncated)
+	original, _ := os.ReadFile(path)
+	assert.Equal(t, string(original), readGzip(t, buildLog.Path))
+}
+
+func TestBuildLogTruncate(t *testing.T) {
+	// 随机内容压缩后几乎不变小
+	lines := make([]string, 4000)
+	for i := range lines {
+		random := make([]byte, 32)
+		rand.Read(random)
+		lines[i] = fmt.Sprintf("%d %s", i, hex.EncodeToString(random))
+	}
+	lines[10] = "ERROR: connection refused"
+	path := writeBuildLog(t, lines)
+	attachment := testAttachment(t)
+	attachment.MaxSize = 32 << 10
+	attachment.TailLines = 1000
+
+	buildLog, err := handlers.PrepareBuildLog(path, attachment)
+	assert.NoError(t, err)
+	assert.True(t, buildLog.Compressed)
+	assert.True(t, buildLog.Truncated)
+	assert.Equal(t, 4000, buildLog.Lines)
+	assert.Equal(t, 500, buildLog.Kept)
+	assert.Equal(t, []string{"ERROR: connection refused"}, buildLog.Excerpt)
+
+	info, err := os.Stat(buildLog.Path)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), int64(attachment.MaxSize))
+	content := strings.Split(strings.TrimSuffix(readGzip(t, buildLog.Path), "\n"), "\n")
+	assert.Equal(t, "... 3500 lines omitted, last 500 lines kept ...", content[0])
+	assert.Equal(t, lines[3500:], content[1:])
+}
+
+func TestAttachmentConfig(t *testing.T) {
+	attachment := testAttachment(t)
+	assert.Equal(t, ByteSize(10<<20), attachment.MaxSize)
+	assert.Equal(t, 5000, attachment.TailLines)
+	assert.NotEmpty(t, attachment.Excerpt.Patterns)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("email:\n  attachment:\n    max-size: 2.5MB\n    excerpt:\n      patterns: ['FATAL']\n"), 0600))
+	config, err := Read(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ByteSize(5<<19), config.Email.Attachment.MaxSize)
+	assert.Equal(t, []string{"FATAL"}, config.Email.Attachment.Excerpt.Patterns)
+
+	assert.NoError(t, os.WriteFile(path, []byte("email:\n  attachment:\n    max-size: 1048576\n"), 0600))
+	config, err = Read(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ByteSize(1<<20), config.Email.Attachment.MaxSize)
+
+	assert.NoError(t, os.WriteFile(path, []byte("email:\n  attachment:\n    max-size: 10XB\n"), 0600))
+	_, err = Read(path)
+	assert.Error(t, err)
+}
+
+func TestRenderLogExcerpt(t *testing.T) {
+	data := &handlers.MailData{App: "demo-app", Tag: "test_20240526171000", Result: "FAILURE", Time: templateTestTime,
+		Body: "<p>构建结果: FAILURE</p>",
+		Log:  &handlers.BuildLog{Excerpt: []string{"[ERROR] <missing> dependency"}, Compressed: true, Truncated: true, Lines: 90000, Kept: 5000},
+	}
+	msg, err := handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(msg.Body, "<p>构建结果: FAILURE</p>\n<h4>报错日志摘录</h4>"))
+	assert.Contains(t, msg.Body, "[ERROR] &lt;missing&gt; dependency</pre>")
+	assert.Contains(t, msg.Body, "构建日志共 90000 行, 超过附件大小限制, 附件只保留最后 5000 行")
+
+	data.Body = ""
+	msg, err = handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{Lang: "en"})
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Body, "<h4>Error excerpt</h4>")
+	assert.True(t, strings.HasSuffix(msg.Body, "only the last 5000 lines are attached</p>\n</body></html>"))
+}
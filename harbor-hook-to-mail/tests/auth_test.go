@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAuthEngine(t *testing.T, secret string, allowCIDRs ...string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	hookConfig := &HookConfig{}
+	hookConfig.Hook.Auth.Secret = secret
+	hookConfig.Hook.Auth.AllowCIDRs = allowCIDRs
+	hookConfig.Hook.Apps = []AppConfig{{Name: "test-app"}}
+
+	authHandler, err := routes.HookAuthHandler(hookConfig)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	r := gin.New()
+	r.POST("/hook/app", authHandler, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	})
+	return r
+}
+
+func postHook(r *gin.Engine, remoteAddr string, authorization string) int {
+	body := `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/build-hook/test-app:p0_20240526171000"}]}}`
+	req, _ := http.NewRequest(http.MethodPost, "/hook/app", bytes.NewBufferString(body))
+	req.RemoteAddr = remoteAddr
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestHookAuthSecret(t *testing.T) {
+	r := newAuthEngine(t, "harbor-secret")
+
+	assert.Equal(t, http.StatusOK, postHook(r, "10.0.0.1:1234", "harbor-secret"))
+	assert.Equal(t, http.StatusUnauthorized, postHook(r, "10.0.0.1:1234", "wrong-secret"))
+	assert.Equal(t, http.StatusUnauthorized, postHook(r, "10.0.0.1:1234", ""))
+}
+
+func TestHookAuthAllowCIDRs(t *testing.T) {
+	r := newAuthEngine(t, "", "10.0.0.0/24", "192.168.1.5")
+
+	assert.Equal(t, http.StatusOK, postHook(r, "10.0.0.8:1234", ""))
+	assert.Equal(t, http.StatusOK, postHook(r, "192.168.1.5:1234", ""))
+	assert.Equal(t, http.StatusForbidden, postHook(r, "192.168.1.6:1234", ""))
+}
+
+func TestHookAuthDisabled(t *testing.T) {
+	r := newAuthEngine(t, "")
+	assert.Equal(t, http.StatusOK, postHook(r, "172.16.0.1:1234", ""))
+}
+
+func TestHookAuthInvalidCIDR(t *testing.T) {
+	hookConfig := &HookConfig{}
+	hookConfig.Hook.Auth.AllowCIDRs = []string{"10.0.0.0/33"}
+	_, err := routes.HookAuthHandler(hookConfig)
+	assert.Error(t, err)
+}
+
+func TestHookAuthRejectedStats(t *testing.T) {
+	r := newTestRouter(t, "  auth:\n    secret: harbor-secret\n  apps:\n  - name: test-app\n")
+	before := routes.UnattributedRejected()
+
+	assert.Equal(t, http.StatusUnauthorized, postHook(r, "10.0.0.1:1234", "wrong-secret"))
+	// 未配置的应用和超过大小的请求体不计入应用的统计
+	other := `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/build-hook/other-app:v1"}]}}`
+	oversized := `{"type":"PUSH_ARTIFACT","event_data":{"resources":[{"resource_url":"harbor.example.com/build-hook/test-app:v1"}]}}` + strings.Repeat(" ", 128<<10)
+	for _, body := range []string{other, oversized} {
+		req, _ := http.NewRequest(http.MethodPost, "/hook/app", bytes.NewBufferString(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	assert.Equal(t, before+2, routes.UnattributedRejected())
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/apps/test-app/stats", nil)
+	req.Header.Set("Authorization", "harbor-secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats routes.AppStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, int32(1), stats.Rejected)
+	assert.Equal(t, int32(0), stats.Calls)
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const buildJSON = `{
+  "result": "unstable",
+  "duration": 342,
+  "branch": "release/1.2",
+  "commit": "9f2c1e7",
+  "failed_stage": "Integration Test",
+  "url": "https://jenkins.example.com/job/demo-app/128/",
+  "tests": {"total": 120, "passed": 117, "failed": 2, "skipped": 1}
+}`
+
+func TestParseBuildInfo(t *testing.T) {
+	info, err := handlers.ParseBuildInfo([]byte(buildJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, &store.BuildInfo{
+		Result:      "UNSTABLE",
+		Duration:    342,
+		Branch:      "release/1.2",
+		Commit:      "9f2c1e7",
+		FailedStage: "Integration Test",
+		URL:         "https://jenkins.example.com/job/demo-app/128/",
+		Tests:       &store.TestCounts{Total: 120, Passed: 117, Failed: 2, Skipped: 1},
+	}, info)
+
+	_, err = handlers.ParseBuildInfo([]byte(`{"branch": "main"}`))
+	assert.Error(t, err)
+	_, err = handlers.ParseBuildInfo([]byte(`{"result": "SUCCESS", "duration": -1}`))
+	assert.Error(t, err)
+	_, err = handlers.ParseBuildInfo([]byte(`<html>`))
+	assert.Error(t, err)
+}
+
+func TestMailBodyResult(t *testing.T) {
+	assert.Equal(t, "SUCCESS", handlers.MailBodyResult("<p>构建结果: SUCCESS</p>"))
+	assert.Equal(t, "ABORTED", handlers.MailBodyResult("<p>构建结果: ABORTED</p>"))
+	assert.Equal(t, "UNKNOWN", handlers.MailBodyResult("<p>build finished</p>"))
+}
+
+func TestRenderBuildInfo(t *testing.T) {
+	info, err := handlers.ParseBuildInfo([]byte(buildJSON))
+	assert.NoError(t, err)
+	data := &handlers.MailData{App: "demo-app", Tag: "test_20240526171000", Result: info.Result, Build: info, Time: templateTestTime}
+
+	// 没有 mail.body 时按 build.json 生成正文
+	msg, err := handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "构建详情通知 - 2024-05-26: 应用 demo-app 构建不稳定", msg.Title)
+	assert.Contains(t, msg.Summary, "- 失败阶段: Integration Test")
+	assert.Contains(t, msg.Summary, "- 耗时: 5m42s")
+	assert.Contains(t, msg.Summary, "- 测试: 共 120, 通过 117, 失败 2, 跳过 1")
+	assert.Contains(t, msg.Body, "<tr><th align=\"left\">分支</th><td>release/1.2</td></tr>")
+	assert.Contains(t, msg.Body, `<a href="https://jenkins.example.com/job/demo-app/128/">`)
+
+	data.Body = "<p>构建结果: UNSTABLE</p>"
+	msg, err = handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{Lang: "en"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Build detail - 2024-05-26: demo-app build unstable", msg.Title)
+	assert.Equal(t, "<p>构建结果: UNSTABLE</p>", msg.Body)
+	assert.Contains(t, msg.Summary, "- Build URL: https://jenkins.example.com/job/demo-app/128/")
+}
@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/commands"
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const commandConfigTemplate = `
+registry:
+  address: harbor.example.com
+  auth:
+    username: hook
+    password: %[1]s
+email:
+  server: mail.example.com
+  port: 25
+  sender:
+    address: hook@example.com
+    password: %[1]s
+  receiver:
+  - dev@example.com
+notify:
+  channels:
+  - name: ci-webhook
+    type: webhook
+    url: %[2]s
+store:
+  path: %[3]s
+hook:
+  apps:
+  - name: demo-app
+    channels: [ci-webhook]
+    events: [PUSH_ARTIFACT, DELETE_ARTIFACT]
+  audit:
+    inform-time: [%[4]s]
+`
+
+func writeCommandConfig(t *testing.T, url string, storePath string, informTime string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf(commandConfigTemplate, encryptedPassword(t, "secret"), url, storePath, informTime)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func runCommand(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := commands.Run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommandEncrypt(t *testing.T) {
+	useKeys(t, "0123456789abcdef")
+	code, stdout, _ := runCommand("encrypt", "s3cret")
+	assert.Equal(t, 0, code)
+	encrypted := strings.TrimSpace(stdout)
+	assert.True(t, strings.HasPrefix(encrypted, "enc:v2:"))
+
+	code, stdout, _ = runCommand("decrypt", encrypted)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "s3cret\n", stdout)
+
+	code, _, stderr := runCommand("decrypt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "Usage: harbor-hook-to-mail decrypt")
+
+	useKeys(t, "")
+	code, _, stderr = runCommand("encrypt", "s3cret")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "no AES key configured")
+}
+
+func TestCommandReencrypt(t *testing.T) {
+	useKeys(t, "0123456789abcdef")
+	path := writeCommandConfig(t, "https://ci.example.com/hook", "hook.db", "09:50")
+
+	code, _, stderr := runCommand("reencrypt", "--config", path, "--write")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stderr, "2 values re-encrypted")
+	code, _, stderr = runCommand("validate-config", "--config", path)
+	assert.Equal(t, 0, code, stderr)
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, 2, strings.Count(string(data), "enc:v2:"))
+}
+
+func TestCommandValidateConfig(t *testing.T) {
+	path := writeCommandConfig(t, "https://ci.example.com/hook", "hook.db", "09:50")
+	code, stdout, stderr := runCommand("validate-config", "--config", path)
+	assert.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "is valid, 1 apps")
+
+	path = writeCommandConfig(t, "https://ci.example.com/hook", "hook.db", "25:99")
+	code, _, stderr = runCommand("validate-config", "--config", path)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "hook.audit.inform-time")
+}
+
+func TestCommandSendTestMail(t *testing.T) {
+	var captured capturedRequest
+	server := newCaptureServer(t, "ok", &captured)
+	path := writeCommandConfig(t, server.URL, "hook.db", "09:50")
+
+	code, stdout, stderr := runCommand("send-test-mail", "--config", path, "--app", "demo-app")
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, "ci-webhook: sent\n", stdout)
+	assert.Equal(t, "demo-app", captured.Body["app"])
+	assert.Contains(t, captured.Body["title"], "测试通知")
+
+	code, _, stderr = runCommand("send-test-mail", "--config", path, "--app", "unknown-app")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "not configured")
+}
+
+func TestCommandReplay(t *testing.T) {
+	var captured capturedRequest
+	server := newCaptureServer(t, "ok", &captured)
+	path := writeCommandConfig(t, server.URL, "hook.db", "09:50")
+
+	payload := filepath.Join(t.TempDir(), "payload.json")
+	assert.NoError(t, os.WriteFile(payload, []byte(`{
+  "type": "DELETE_ARTIFACT",
+  "occur_at": 1719720000,
+  "operator": "admin",
+  "event_data": {
+    "resources": [{"digest": "sha256:1234", "tag": "v1.0.0", "resource_url": "harbor.example.com/library/demo-app:v1.0.0"}],
+    "repository": {"name": "demo-app", "namespace": "library", "repo_full_name": "library/demo-app"}
+  }
+}`), 0600))
+	code, stdout, stderr := runCommand("replay", "--config", path, payload)
+	assert.Equal(t, 0, code, stderr)
+	var record store.BuildRecord
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &record))
+	assert.Equal(t, store.StatusProcessed, record.Status)
+	assert.Equal(t, store.MailSent, record.MailStatus)
+	assert.Contains(t, captured.Body["title"], "demo-app:v1.0.0")
+
+	// 未开启的事件和 webhook 处理一样被忽略
+	assert.NoError(t, os.WriteFile(payload, []byte(`{"type": "QUOTA_EXCEED", "event_data": {"repository": {"name": "demo-app"}}}`), 0600))
+	code, _, stderr = runCommand("replay", "--config", path, payload)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "QUOTA_EXCEED disabled")
+	assert.NoError(t, os.WriteFile(payload, []byte(`{"type": "TAG_RETENTION", "event_data": {"repository": {"name": "demo-app"}}}`), 0600))
+	code, _, stderr = runCommand("replay", "--config", path, payload)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "unsupported event type TAG_RETENTION")
+}
+
+func TestCommandStats(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "hook.db")
+	s, err := store.Open(storePath, 0)
+	assert.NoError(t, err)
+	now := time.Now()
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", now.Add(-time.Second))
+	addBuild(t, s, "demo-app", store.StatusFailed, "", now)
+	path := writeCommandConfig(t, "https://ci.example.com/hook", storePath, "09:50")
+
+	// 服务进程持有写锁时提示使用 --server
+	code, _, stderr := runCommand("stats", "--config", path)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "use --server")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	cfg, err := Load(path)
+	assert.NoError(t, err)
+	routes.RegisterAPI(r, s, func() *HookConfig { return &cfg.HookConfig })
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	code, stdout, stderr := runCommand("stats", "--server", server.URL, "--json")
+	assert.Equal(t, 0, code, stderr)
+	var hookStats []routes.HookStats
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &hookStats))
+	assert.Equal(t, []routes.HookStats{{Name: "demo-app", Calls: 2, Errors: 1}}, hookStats)
+
+	// 查询接口需要认证
+	authConfig := &HookConfig{}
+	authConfig.Hook.Auth.Secret = "harbor-secret"
+	authHandler, err := routes.APIAuthHandler(authConfig)
+	assert.NoError(t, err)
+	r = gin.New()
+	routes.RegisterAPI(r, s, func() *HookConfig { return &cfg.HookConfig }, authHandler)
+	authServer := httptest.NewServer(r)
+	t.Cleanup(authServer.Close)
+	code, _, stderr = runCommand("stats", "--config", path, "--server", authServer.URL)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "401")
+	code, stdout, stderr = runCommand("stats", "--config", path, "--server", authServer.URL, "--auth", "harbor-secret", "--json")
+	assert.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, `"demo-app"`)
+
+	assert.NoError(t, s.Close())
+	code, stdout, stderr = runCommand("stats", "--config", path, "--date", now.Format("2006-01-02"))
+	assert.Equal(t, 0, code, stderr)
+	assert.Regexp(t, `demo-app\s+2\s+1\s+0\s+0\s+0`, stdout)
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const validConfig = `
+server:
+  port: 9000
+email:
+  server: smtp.example.com
+  port: 465
+  receiver: [dev@example.com]
+hook:
+  apps:
+  - name: demo-app
+  audit:
+    inform-time: ["09:50"]
+    inform-cron: "0 0 10 * * *"
+`
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := Load(writeConfigFile(t, validConfig))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, 9000, cfg.Server.Port)
+	assert.Equal(t, "/hook", cfg.Hook.ContextPath)
+	assert.Equal(t, 24*time.Hour, cfg.Hook.Dedup.TTL)
+	assert.Equal(t, "hook.db", cfg.Store.Path)
+	assert.Equal(t, 4, cfg.Queue.Workers)
+	assert.Equal(t, 24*time.Hour, cfg.Outbox.MaxAge)
+	assert.Equal(t, 30*time.Second, cfg.Email.KeepAlive)
+	assert.Equal(t, 30*time.Second, cfg.Email.Timeout)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	for name, test := range map[string]struct {
+		content string
+		err     string
+	}{
+		"inform-time": {
+			content: "email: {server: smtp.example.com, port: 25, receiver: [dev@example.com]}\nhook:\n  audit:\n    inform-time: ['9.50']\n",
+			err:     `hook.audit.inform-time: invalid time "9.50"`,
+		},
+		"receiver": {
+			content: "email: {server: smtp.example.com, port: 25}\n",
+			err:     "email.receiver: at least one receiver is required",
+		},
+		"timeout": {
+			content: "email: {server: smtp.example.com, port: 25, receiver: [dev@example.com], timeout: 0s}\n",
+			err:     "email.timeout: must be positive",
+		},
+		"cron": {
+			content: "email: {server: smtp.example.com, port: 25, receiver: [dev@example.com]}\nhook:\n  audit:\n    inform-cron: '0 10 * *'\n",
+			err:     "hook.audit.inform-cron",
+		},
+		"channel": {
+			content: "email: {server: smtp.example.com, port: 25, receiver: [dev@example.com]}\nhook:\n  apps:\n  - name: demo-app\n    channels: [ci-webhook]\n",
+			err:     "app demo-app uses undefined notify channel ci-webhook",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(writeConfigFile(t, test.content))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.err)
+			}
+		})
+	}
+
+	// 所有错误一起返回
+	_, err := Load(writeConfigFile(t, "server:\n  port: 0\nhook:\n  audit:\n    inform-time: ['25:00']\n"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "server.port")
+		assert.Contains(t, err.Error(), "email.server")
+		assert.Contains(t, err.Error(), "hook.audit.inform-time")
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	path := writeConfigFile(t, validConfig)
+	t.Setenv("HOOK_SERVER_PORT", "9100")
+	t.Setenv("HOOK_EMAIL_SERVER", "smtp.internal")
+	t.Setenv("HOOK_EMAIL_RECEIVER", "ops@example.com, qa@example.com")
+	t.Setenv("HOOK_HOOK_DEDUP_TTL", "1h")
+	t.Setenv("HOOK_EMAIL_ATTACHMENT_MAX_SIZE", "2MB")
+	t.Setenv("HOOK_EMAIL_TLS_INSECURE_SKIP_VERIFY", "true")
+
+	cfg, err := Load(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, 9100, cfg.Server.Port)
+	assert.Equal(t, "smtp.internal", cfg.Email.Server)
+	assert.Equal(t, []string{"ops@example.com", "qa@example.com"}, cfg.Email.Receiver)
+	assert.Equal(t, time.Hour, cfg.Hook.Dedup.TTL)
+	assert.Equal(t, ByteSize(2<<20), cfg.Email.Attachment.MaxSize)
+	assert.True(t, cfg.Email.TLS.InsecureSkipVerify)
+
+	t.Setenv("HOOK_QUEUE_WORKERS", "four")
+	_, err = Load(path)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "HOOK_QUEUE_WORKERS")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := writeConfigFile(t, validConfig)
+	changed := make(chan struct{}, 10)
+	stop, err := Watch(path, func() { changed <- struct{}{} })
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer stop()
+
+	assert.NoError(t, os.WriteFile(path, []byte(validConfig+"\n"), 0600))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change not notified")
+	}
+}
@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup(t *testing.T) {
+	s := openTestStore(t)
+	base := time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local)
+	key := "PUSH_ARTIFACT/demo-app/test"
+
+	verdict, prev, err := s.Dedup(key, store.DedupEntry{Digest: "sha256:b", OccurAt: base, SeenAt: base, RecordID: 1}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupAccepted, verdict)
+	assert.Nil(t, prev)
+
+	// Harbor 重试
+	verdict, prev, err = s.Dedup(key, store.DedupEntry{Digest: "sha256:b", OccurAt: base, SeenAt: base.Add(time.Minute), RecordID: 2}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupDuplicate, verdict)
+	assert.Equal(t, uint64(1), prev.RecordID)
+
+	// 同一个 tag 更早的推送乱序到达
+	verdict, _, err = s.Dedup(key, store.DedupEntry{Digest: "sha256:a", OccurAt: base.Add(-time.Minute), SeenAt: base.Add(2 * time.Minute), RecordID: 3}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupStale, verdict)
+
+	// 同一个 tag 新的推送
+	verdict, _, err = s.Dedup(key, store.DedupEntry{Digest: "sha256:c", OccurAt: base.Add(time.Minute), SeenAt: base.Add(3 * time.Minute), RecordID: 4}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupAccepted, verdict)
+
+	// 不同 tag 乱序到达互不影响
+	verdict, _, err = s.Dedup("PUSH_ARTIFACT/demo-app/older", store.DedupEntry{Digest: "sha256:d", OccurAt: base.Add(-time.Hour), SeenAt: base.Add(4 * time.Minute)}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupAccepted, verdict)
+
+	// 超过窗口后重新接受
+	verdict, _, err = s.Dedup(key, store.DedupEntry{Digest: "sha256:c", OccurAt: base.Add(time.Minute), SeenAt: base.Add(2 * time.Hour), RecordID: 5}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupAccepted, verdict)
+}
+
+func TestUndoDedup(t *testing.T) {
+	s := openTestStore(t)
+	base := time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local)
+	key := "PUSH_ARTIFACT/demo-app/test"
+	first := store.DedupEntry{Digest: "sha256:a", OccurAt: base, SeenAt: base, RecordID: 1}
+	second := store.DedupEntry{Digest: "sha256:b", OccurAt: base.Add(time.Minute), SeenAt: base.Add(time.Minute), RecordID: 2}
+
+	_, _, err := s.Dedup(key, first, time.Hour)
+	assert.NoError(t, err)
+	_, prev, err := s.Dedup(key, second, time.Hour)
+	assert.NoError(t, err)
+
+	// 恢复之前接受的事件
+	assert.NoError(t, s.UndoDedup(key, second, prev))
+	verdict, _, err := s.Dedup(key, store.DedupEntry{Digest: "sha256:a", OccurAt: base, SeenAt: base.Add(2 * time.Minute), RecordID: 3}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupDuplicate, verdict)
+
+	// 已被其他事件替换时不修改
+	assert.NoError(t, s.UndoDedup(key, second, nil))
+	verdict, _, err = s.Dedup(key, store.DedupEntry{Digest: "sha256:a", OccurAt: base, SeenAt: base.Add(3 * time.Minute), RecordID: 4}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupDuplicate, verdict)
+
+	assert.NoError(t, s.UndoDedup(key, first, nil))
+	verdict, _, err = s.Dedup(key, second, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, store.DedupAccepted, verdict)
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	s := openTestStore(t)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	verdicts := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			verdict, _, err := s.Dedup("PUSH_ARTIFACT/demo-app/test", store.DedupEntry{Digest: "sha256:a", OccurAt: now, RecordID: id}, time.Hour)
+			assert.NoError(t, err)
+			verdicts <- verdict
+		}(uint64(i))
+	}
+	wg.Wait()
+	close(verdicts)
+
+	accepted := 0
+	for verdict := range verdicts {
+		if verdict == store.DedupAccepted {
+			accepted++
+		} else {
+			assert.Equal(t, store.DedupDuplicate, verdict)
+		}
+	}
+	assert.Equal(t, 1, accepted)
+}
+
+// TestDedupQueueFull 队列已满返回 503 的事件不记录去重, Harbor 重试时仍然可以加入队列
+func TestDedupQueueFull(t *testing.T) {
+	requested, release := make(chan struct{}, 10), make(chan struct{})
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(registry.Close)
+	releaseOnce := sync.OnceFunc(func() { close(release) })
+	host := strings.TrimPrefix(registry.URL, "http://")
+	r := newTestRouter(t, fmt.Sprintf("registries:\n- host: %s\n  scheme: http\nqueue:\n  size: 1\n  max-attempts: 1\n", host))
+	// 先于关闭路由执行, 否则队列等待处理中的任务
+	t.Cleanup(releaseOnce)
+
+	push := func(tag string, digest string) (int, string) {
+		request := artifactEvent(EventPushArtifact, "test-app")
+		request.EventData.Resources[0] = routes.WebhookResource{Digest: digest, Tag: tag, ResourceURL: host + "/build-hook/test-app:" + tag}
+		request.EventData.Repository.Namespace = "build-hook"
+		return postEvent(r, request)
+	}
+
+	code, status := push("v1", "sha256:a")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "queued", status)
+	// v1 正在处理, 队列已满
+	<-requested
+	code, _ = push("v2", "sha256:b")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	// Harbor 重试不是重复事件
+	code, _ = push("v2", "sha256:b")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	releaseOnce()
+	assert.Eventually(t, func() bool {
+		var jobs []store.Job
+		return getAPI(t, r, "/api/jobs?state=dead", &jobs) == http.StatusOK && len(jobs) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	code, status = push("v2", "sha256:b")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "queued", status)
+
+	statuses := make([]string, 0)
+	for _, record := range appBuilds(t, r, "test-app", EventPushArtifact) {
+		if record.Tag == "v2" {
+			statuses = append(statuses, record.Status)
+		}
+	}
+	assert.Len(t, statuses, 3)
+	assert.NotContains(t, statuses, store.StatusDuplicate)
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildDigest(t *testing.T) {
+	s := openTestStore(t)
+	hookConfig := &HookConfig{}
+	hookConfig.Hook.Apps = []AppConfig{{Name: "demo-app"}, {Name: "demo-ui"}, {Name: "backend"}}
+
+	day := time.Date(2024, 6, 30, 18, 0, 0, 0, time.Local)
+	// demo-app: 昨天成功, 今天连续失败两次
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", day.AddDate(0, 0, -1))
+	addBuild(t, s, "demo-app", store.StatusProcessed, "FAILURE", day.Add(-2*time.Hour))
+	addBuild(t, s, "demo-app", store.StatusDuplicate, "", day.Add(-90*time.Minute))
+	addBuild(t, s, "demo-app", store.StatusProcessed, "FAILURE", day.Add(-time.Hour))
+	// demo-ui: 今天成功
+	addBuild(t, s, "demo-ui", store.StatusProcessed, "SUCCESS", day.Add(-time.Hour))
+	// 第二天的构建不计入
+	addBuild(t, s, "demo-ui", store.StatusProcessed, "FAILURE", day.AddDate(0, 0, 1))
+
+	report, err := routes.BuildDigest(s, hookConfig, nil, day)
+	assert.NoError(t, err)
+	if !assert.Len(t, report.Rows, 3) {
+		return
+	}
+	assert.Equal(t, 2, report.Problems)
+
+	app := report.Rows[0]
+	assert.Equal(t, "demo-app", app.App)
+	assert.Equal(t, int32(3), app.Calls)
+	assert.Equal(t, "FAILURE", app.LastResult)
+	assert.Equal(t, "test_"+day.Add(-time.Hour).Format("20060102150405"), app.LastTag)
+	assert.Equal(t, 2, app.FailureStreak)
+	assert.Equal(t, day.AddDate(0, 0, -1).Unix(), app.LastSuccess.Unix())
+	assert.True(t, app.Problem)
+
+	ui := report.Rows[1]
+	assert.Equal(t, int32(1), ui.Calls)
+	assert.Equal(t, "SUCCESS", ui.LastResult)
+	assert.Equal(t, 0, ui.FailureStreak)
+	assert.False(t, ui.Problem)
+
+	backend := report.Rows[2]
+	assert.Equal(t, int32(0), backend.Calls)
+	assert.Empty(t, backend.LastTag)
+	assert.True(t, backend.LastSuccess.IsZero())
+	assert.True(t, backend.Problem)
+}
+
+func TestRenderDigest(t *testing.T) {
+	report := &handlers.DigestReport{Problems: 1, Rows: []handlers.DigestRow{
+		{App: "demo-app", Calls: 2, Errors: 1, LastTag: "test_20240526171000", LastResult: "FAILURE", FailureStreak: 3, Problem: true},
+		{App: "demo-ui", Calls: 1, LastTag: "test_20240526120000", LastResult: "SUCCESS", LastSuccess: templateTestTime},
+	}}
+	data := &handlers.MailData{Time: templateTestTime, Report: report}
+	msg, err := handlers.RenderMailWith(handlers.MailKindDigest, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "构建日报 - 2024-05-26: 2 个应用, 1 个异常", msg.Title)
+	assert.Equal(t, OutcomeSummary, msg.Outcome)
+	assert.Contains(t, msg.Body, `<tr style="color:#c00"><td>demo-app</td><td>2</td><td>1</td><td>test_20240526171000</td><td>失败</td><td>-</td><td>3</td></tr>`)
+	assert.Contains(t, msg.Body, "<td>2024-05-26 17:10</td>")
+	assert.Contains(t, msg.Summary, "- **demo-app**: 构建 2 次, 报错 1 次, 最近 test_20240526171000 失败, 连续失败 3 次")
+
+	report.Problems = 0
+	msg, err = handlers.RenderMailWith(handlers.MailKindDigest, data, "html", handlers.TemplateOptions{Lang: "en"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Build digest - 2024-05-26: 2 apps, all healthy", msg.Title)
+}
@@ -4,9 +4,14 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestEncrypt(t *testing.T) {
@@ -33,3 +38,140 @@ func TestEncrypt(t *testing.T) {
 	fmt.Printf("Ciphertext (Base64 encoded): %s\n", decryptedPassword)
 
 }
+
+// useKeys 设置密钥和密钥文件, 测试结束后恢复
+func useKeys(t *testing.T, key string, fileKeys ...string) *KeyRing {
+	path := filepath.Join(t.TempDir(), "aes.key")
+	assert.NoError(t, os.WriteFile(path, []byte("# rotated keys\n"+strings.Join(fileKeys, "\n")+"\n"), 0600))
+	t.Setenv(EnvAESKey, key)
+	t.Setenv(EnvAESKeyFile, path)
+	ring, err := LoadKeyRing()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	SetKeyRing(ring)
+	t.Cleanup(func() { SetKeyRing(nil) })
+	return ring
+}
+
+func TestParseAESKey(t *testing.T) {
+	key, err := ParseAESKey("0123456789abcdef")
+	assert.NoError(t, err)
+	assert.Len(t, key, 16)
+	key, err = ParseAESKey("base64:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+	_, err = ParseAESKey("too-short")
+	assert.Error(t, err)
+	_, err = ParseAESKey("base64:!!!")
+	assert.Error(t, err)
+}
+
+func TestEncryptSecret(t *testing.T) {
+	ring := useKeys(t, "", "0123456789abcdef")
+	assert.Equal(t, KeyID([]byte("0123456789abcdef")), ring.Primary)
+
+	encrypted, err := ring.EncryptSecret("s3cret")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, "enc:v2:"+ring.Primary+":"))
+	password, err := DecryptPassword(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", password)
+
+	// 轮换后新密钥用于加密, 旧密钥仍可解密
+	ring = useKeys(t, "fedcba9876543210", "0123456789abcdef")
+	assert.Equal(t, KeyID([]byte("fedcba9876543210")), ring.Primary)
+	password, err = DecryptPassword(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", password)
+
+	useKeys(t, "fedcba9876543210")
+	_, err = DecryptPassword(encrypted)
+	assert.ErrorContains(t, err, "not found")
+
+	_, err = (&KeyRing{}).EncryptSecret("s3cret")
+	assert.Error(t, err)
+}
+
+func TestDecryptPassword(t *testing.T) {
+	useKeys(t, "0123456789abcdef")
+
+	t.Setenv("SMTP_PASSWORD", "from-env")
+	password, err := DecryptPassword("${SMTP_PASSWORD}")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", password)
+	_, err = DecryptPassword("${MISSING_PASSWORD_FOR_TEST}")
+	assert.Error(t, err)
+
+	legacy, err := EncryptAES([]byte("legacy"))
+	assert.NoError(t, err)
+	password, err = DecryptPassword(base64.StdEncoding.EncodeToString(legacy))
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy", password)
+
+	password, err = DecryptPassword("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", password)
+
+	// 原本就是明文的配置只展开引用和解密 v2 密文
+	value, err := ResolveSecret("plain-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain-token", value)
+	value, err = ResolveSecret("${SMTP_PASSWORD}")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", value)
+}
+
+func TestReencryptConfig(t *testing.T) {
+	oldRing := useKeys(t, "0123456789abcdef")
+	rotated, err := oldRing.EncryptSecret("registry-password")
+	assert.NoError(t, err)
+	legacy, err := EncryptAES([]byte("mail-password"))
+	assert.NoError(t, err)
+
+	ring := useKeys(t, "fedcba9876543210", "0123456789abcdef")
+	current, err := ring.EncryptSecret("current")
+	assert.NoError(t, err)
+	config := fmt.Sprintf(`# registry
+registry:
+  auth:
+    username: hook
+    password: %s
+email:
+  sender:
+    address: hook@example.com
+    password: %s # legacy
+hook:
+  auth:
+    secret: %s
+notify:
+  channels:
+  - name: ops
+    secret: ${DINGTALK_SECRET}
+`, rotated, base64.StdEncoding.EncodeToString(legacy), current)
+
+	data, count, err := ring.ReencryptConfig([]byte(config))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Contains(t, string(data), "# registry")
+	assert.Contains(t, string(data), "# legacy")
+	assert.Contains(t, string(data), "secret: "+current)
+	assert.Contains(t, string(data), "secret: ${DINGTALK_SECRET}")
+
+	var parsed struct {
+		Registry struct{ Auth struct{ Password string } }
+		Email    struct{ Sender struct{ Password string } }
+	}
+	assert.NoError(t, yaml.Unmarshal(data, &parsed))
+	for value, expected := range map[string]string{parsed.Registry.Auth.Password: "registry-password", parsed.Email.Sender.Password: "mail-password"} {
+		assert.True(t, strings.HasPrefix(value, "enc:v2:"+ring.Primary+":"))
+		password, err := DecryptPassword(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, password)
+	}
+
+	// 已经是当前密钥时不修改
+	data, count, err = ring.ReencryptConfig(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppEventEnabled(t *testing.T) {
+	assert.True(t, AppConfig{Name: "demo-app"}.EventEnabled(EventPushArtifact))
+	assert.False(t, AppConfig{Name: "demo-app"}.EventEnabled(EventScanningCompleted))
+
+	app := AppConfig{Name: "demo-app", Events: []string{"scanning_completed", EventReplication}}
+	assert.True(t, app.EventEnabled(EventScanningCompleted))
+	assert.True(t, app.EventEnabled(EventReplication))
+	assert.False(t, app.EventEnabled(EventPushArtifact))
+}
+
+func TestParseScanningEvent(t *testing.T) {
+	payload := `{
+  "type": "SCANNING_COMPLETED",
+  "occur_at": 1716714783,
+  "operator": "auto",
+  "event_data": {
+    "resources": [{
+      "digest": "sha256:5518",
+      "tag": "v1.0.0",
+      "resource_url": "harbor.example.com/library/demo-app:v1.0.0",
+      "scan_overview": {
+        "application/vnd.security.vulnerability.report; version=1.1": {
+          "report_id": "r1",
+          "scan_status": "Success",
+          "severity": "High",
+          "duration": 5,
+          "summary": {"total": 4, "fixable": 3, "summary": {"High": 1, "Medium": 3}},
+          "scanner": {"name": "Trivy", "vendor": "Aqua Security", "version": "v0.50.1"}
+        }
+      }
+    }],
+    "repository": {"name": "demo-app", "namespace": "library", "repo_full_name": "library/demo-app", "repo_type": "private"}
+  }
+}`
+	var request routes.WebhookRequest
+	assert.NoError(t, json.Unmarshal([]byte(payload), &request))
+	assert.Equal(t, EventScanningCompleted, request.Type)
+
+	report := request.EventData.Resources[0].ScanOverview["application/vnd.security.vulnerability.report; version=1.1"]
+	assert.Equal(t, "High", report.Severity)
+	assert.Equal(t, 4, report.Summary.Total)
+	assert.Equal(t, map[string]int{"High": 1, "Medium": 3}, report.Summary.Summary)
+	assert.Equal(t, "Trivy", report.Scanner.Name)
+}
+
+func TestParseReplicationEvent(t *testing.T) {
+	payload := `{
+  "type": "REPLICATION",
+  "occur_at": 1716714783,
+  "operator": "MANUAL",
+  "event_data": {
+    "replication": {
+      "harbor_hostname": "harbor.example.com",
+      "job_status": "Success",
+      "trigger_type": "MANUAL",
+      "src_resource": {"registry_type": "harbor", "endpoint": "https://harbor.example.com", "namespace": "library"},
+      "dest_resource": {"registry_name": "dr", "endpoint": "https://harbor-dr.example.com", "namespace": "library"},
+      "successful_artifact": [{"type": "image", "status": "Success", "name_tag": "demo-app [1 item(s) in total]"}]
+    }
+  }
+}`
+	var request routes.WebhookRequest
+	assert.NoError(t, json.Unmarshal([]byte(payload), &request))
+	assert.Equal(t, "Success", request.EventData.Replication.JobStatus)
+	assert.Equal(t, "https://harbor-dr.example.com", request.EventData.Replication.DestResource.Endpoint)
+	assert.Equal(t, "demo-app [1 item(s) in total]", request.EventData.Replication.SuccessfulArtifact[0].NameTag)
+	assert.Equal(t, "SUCCESS", handlers.ReplicationResult(request.EventData.Replication))
+
+	// 任务成功但有镜像复制失败
+	request.EventData.Replication.FailedArtifact = []handlers.ReplicationArtifact{{Type: "image", Status: "Failed", NameTag: "demo-ui [1 item(s) in total]"}}
+	assert.Equal(t, "FAILURE", handlers.ReplicationResult(request.EventData.Replication))
+	request.EventData.Replication.FailedArtifact = nil
+	request.EventData.Replication.JobStatus = "Failed"
+	assert.Equal(t, "FAILURE", handlers.ReplicationResult(request.EventData.Replication))
+}
+
+// postEvent 发送 webhook 请求, 返回状态码和响应中的 status
+func postEvent(r *gin.Engine, request routes.WebhookRequest) (int, string) {
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest(http.MethodPost, "/hook/app", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response.Status
+}
+
+func artifactEvent(eventType string, app string) routes.WebhookRequest {
+	return routes.WebhookRequest{
+		Type:    eventType,
+		OccurAt: 1716714783,
+		EventData: routes.WebhookEventData{
+			Resources: []routes.WebhookResource{{
+				Digest:      "sha256:5518",
+				Tag:         "v1.0.0",
+				ResourceURL: "harbor.example.com/library/" + app + ":v1.0.0",
+			}},
+			Repository: routes.WebhookRepository{Name: app, Namespace: "library", RepoFullName: "library/" + app},
+		},
+	}
+}
+
+func appBuilds(t *testing.T, r *gin.Engine, app string, eventType string) []store.BuildRecord {
+	req, _ := http.NewRequest(http.MethodGet, "/api/apps/"+app+"/builds?type="+eventType, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var records []store.BuildRecord
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	return records
+}
+
+func TestEventDispatch(t *testing.T) {
+	r := newTestRouter(t, `  apps:
+  - name: demo-app
+    events: [scanning_completed, replication]
+  - name: other-app
+`)
+
+	// 按 type 分发到对应的处理
+	code, status := postEvent(r, artifactEvent(EventScanningCompleted, "demo-app"))
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "queued", status)
+	records := appBuilds(t, r, "demo-app", EventScanningCompleted)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "v1.0.0", records[0].Tag)
+	}
+
+	replication := routes.WebhookRequest{Type: EventReplication, OccurAt: 1716714783}
+	// 部分镜像复制失败, 构建记录与通知一样为 FAILURE
+	replication.EventData.Replication = &handlers.Replication{
+		JobStatus:      "Success",
+		FailedArtifact: []handlers.ReplicationArtifact{{Type: "image", Status: "Failed", NameTag: "demo-app:v1.0.0 [1 item(s) in total]"}},
+	}
+	code, status = postEvent(r, replication)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "queued", status)
+	records = appBuilds(t, r, "demo-app", EventReplication)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "FAILURE", records[0].Result)
+	}
+	// 复制的镜像不属于配置中的应用
+	replication.EventData.Replication.FailedArtifact[0].NameTag = "unknown-app:v1.0.0 [1 item(s) in total]"
+	code, status = postEvent(r, replication)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ignored", status)
+
+	// 不支持的事件类型
+	code, status = postEvent(r, artifactEvent("TAG_RETENTION", "demo-app"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ignored", status)
+
+	// 只对开启了该事件的应用处理, 其他配置中的应用保存为 ignored
+	code, status = postEvent(r, artifactEvent(EventScanningCompleted, "other-app"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ignored", status)
+	records = appBuilds(t, r, "other-app", EventScanningCompleted)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, store.StatusIgnored, records[0].Status)
+	}
+
+	// 开启了其他事件的应用
+	code, status = postEvent(r, artifactEvent(EventQuotaExceed, "demo-app"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ignored", status)
+	assert.Len(t, appBuilds(t, r, "demo-app", EventQuotaExceed), 1)
+}
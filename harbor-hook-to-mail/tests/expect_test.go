@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/calendar"
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const holidayICS = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20241001\r\n" +
+	"DTEND;VALUE=DATE:20241008\r\n" +
+	"SUMMARY:国庆\r\n" +
+	" 节\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART:20240501T000000\r\n" +
+	"DTEND:20240501T235959\r\n" +
+	"SUMMARY:Labour Day\\, CN\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+const holidayYAML = `
+holidays:
+- 2024-05-01
+- date: 2024-10-01
+  to: 2024-10-07
+  name: 国庆节
+workdays:
+- date: 2024-10-12
+  name: 国庆节调休
+`
+
+func calendarDay(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 12, 0, 0, 0, time.Local)
+}
+
+func TestCalendarICS(t *testing.T) {
+	cal, err := calendar.ParseICS([]byte(holidayICS))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	name, ok := cal.Holiday(calendarDay(2024, 10, 1))
+	assert.True(t, ok)
+	assert.Equal(t, "国庆节", name)
+	_, ok = cal.Holiday(calendarDay(2024, 10, 7))
+	assert.True(t, ok)
+	// DTEND 不包含在事件中
+	_, ok = cal.Holiday(calendarDay(2024, 10, 8))
+	assert.False(t, ok)
+	name, ok = cal.Holiday(calendarDay(2024, 5, 1))
+	assert.True(t, ok)
+	assert.Equal(t, "Labour Day, CN", name)
+	_, ok = cal.Holiday(calendarDay(2024, 5, 2))
+	assert.False(t, ok)
+}
+
+func TestCalendarYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(holidayYAML), 0600))
+	cal, err := calendar.Load(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	holidays, workdays := cal.Len()
+	assert.Equal(t, 8, holidays)
+	assert.Equal(t, 1, workdays)
+	_, ok := cal.Holiday(calendarDay(2024, 5, 1))
+	assert.True(t, ok)
+	assert.True(t, cal.Workday(calendarDay(2024, 10, 12)))
+	assert.False(t, cal.Workday(calendarDay(2024, 10, 13)))
+
+	// nil 日历没有节假日
+	var empty *calendar.Calendar
+	_, ok = empty.Holiday(calendarDay(2024, 5, 1))
+	assert.False(t, ok)
+
+	_, err = calendar.ParseYAML([]byte("holidays:\n- date: 2024-10-07\n  to: 2024-10-01\n"))
+	assert.Error(t, err)
+	_, err = calendar.Load(filepath.Join(t.TempDir(), "holidays.json"))
+	assert.Error(t, err)
+}
+
+func TestExpectConfig(t *testing.T) {
+	weekday, err := ParseWeekday("Monday")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Monday, weekday)
+	weekday, err = ParseWeekday("fri")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Friday, weekday)
+	_, err = ParseWeekday("mo")
+	assert.Error(t, err)
+
+	expect := ExpectConfig{Weekdays: []string{"mon", "tue", "wed", "thu", "fri"}}
+	assert.Equal(t, 1, expect.Min())
+	assert.True(t, expect.OnWeekday(time.Friday))
+	assert.False(t, expect.OnWeekday(time.Saturday))
+	assert.True(t, ExpectConfig{}.OnWeekday(time.Sunday))
+
+	assert.Error(t, ExpectConfig{Cron: "0 10 * *"}.Validate("demo-app"))
+	assert.Error(t, ExpectConfig{MinBuilds: -1}.Validate("demo-app"))
+	assert.Error(t, ExpectConfig{Weekdays: []string{"someday"}}.Validate("demo-app"))
+
+	cal, err := calendar.ParseYAML([]byte(holidayYAML))
+	assert.NoError(t, err)
+	app := AppConfig{Name: "demo-app", Expect: expect}
+	// 2024-10-11 周五, 2024-10-12 调休上班的周六, 2024-10-13 周日, 2024-10-01 国庆节
+	assert.True(t, app.ExpectedOn(calendarDay(2024, 10, 11), cal))
+	assert.True(t, app.ExpectedOn(calendarDay(2024, 10, 12), cal))
+	assert.False(t, app.ExpectedOn(calendarDay(2024, 10, 13), cal))
+	assert.False(t, app.ExpectedOn(calendarDay(2024, 10, 1), cal))
+}
+
+func TestCheckExpectation(t *testing.T) {
+	s := openTestStore(t)
+	// 2024-06-28 周五, 2024-07-01 周一
+	friday := time.Date(2024, 6, 28, 0, 0, 0, 0, time.Local)
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", friday.Add(17*time.Hour))
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", friday.Add(20*time.Hour))
+	addBuild(t, s, "demo-app", store.StatusFailed, "", friday.AddDate(0, 0, 1).Add(19*time.Hour))
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", friday.AddDate(0, 0, 3).Add(9*time.Hour))
+
+	app := AppConfig{Name: "demo-app", Expect: ExpectConfig{
+		Cron:      "0 0 10,18 * * *",
+		MinBuilds: 3,
+		Weekdays:  []string{"mon", "tue", "wed", "thu", "fri"},
+	}}
+	monday := friday.AddDate(0, 0, 3).Add(10 * time.Hour)
+
+	// 周末不检查, 周一 10 点统计周五 18 点之后的构建
+	result, err := routes.CheckExpectation(s, app, nil, monday)
+	assert.NoError(t, err)
+	assert.Equal(t, friday.Add(18*time.Hour), result.Since)
+	assert.Equal(t, int32(3), result.Calls)
+	assert.Equal(t, int32(1), result.Errors)
+	assert.True(t, result.Expected)
+	assert.False(t, result.Missing())
+
+	// 周六调休上班, 统计周六 18 点之后的构建
+	cal, err := calendar.ParseYAML([]byte("workdays: [2024-06-29]\n"))
+	assert.NoError(t, err)
+	result, err = routes.CheckExpectation(s, app, cal, monday)
+	assert.NoError(t, err)
+	assert.Equal(t, friday.AddDate(0, 0, 1).Add(18*time.Hour), result.Since)
+	assert.Equal(t, int32(2), result.Calls)
+	assert.True(t, result.Missing())
+
+	// 节假日不通知没有构建
+	cal, err = calendar.ParseYAML([]byte("holidays:\n- date: 2024-07-01\n  name: 假期\n"))
+	assert.NoError(t, err)
+	result, err = routes.CheckExpectation(s, app, cal, monday.Add(8*time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, result.Expected)
+	assert.Equal(t, "假期", result.Holiday)
+	assert.False(t, result.Missing())
+
+	// 没有 expect.cron 时统计当天的构建
+	result, err = routes.CheckExpectation(s, AppConfig{Name: "demo-app"}, nil, monday)
+	assert.NoError(t, err)
+	assert.Equal(t, friday.AddDate(0, 0, 3), result.Since)
+	assert.Equal(t, int32(1), result.Calls)
+	assert.False(t, result.Missing())
+}
+
+func TestDigestHoliday(t *testing.T) {
+	s := openTestStore(t)
+	hookConfig := &HookConfig{}
+	hookConfig.Hook.Apps = []AppConfig{{Name: "demo-app"}, {Name: "demo-ui", Expect: ExpectConfig{Weekdays: []string{"sat"}}}}
+	cal, err := calendar.ParseYAML([]byte("holidays:\n- date: 2024-10-01\n  name: 国庆节\n"))
+	assert.NoError(t, err)
+
+	report, err := routes.BuildDigest(s, hookConfig, cal, calendarDay(2024, 10, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Problems)
+	assert.True(t, report.Rows[0].Rest)
+	assert.Equal(t, "国庆节", report.Rows[0].Holiday)
+
+	// 2024-10-02 周三, demo-ui 只在周六构建
+	report, err = routes.BuildDigest(s, hookConfig, cal, calendarDay(2024, 10, 2))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Problems)
+	assert.True(t, report.Rows[0].Problem)
+	assert.True(t, report.Rows[1].Rest)
+
+	data := &handlers.MailData{Time: templateTestTime, Report: report}
+	msg, err := handlers.RenderMailWith(handlers.MailKindDigest, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Body, "<td>demo-ui</td><td>0 (休息日)</td>")
+}
+
+func TestRenderExpectWindow(t *testing.T) {
+	window := &handlers.ExpectWindow{Since: templateTestTime.Add(-16 * time.Hour), Until: templateTestTime, MinBuilds: 2}
+	data := &handlers.MailData{App: "demo-app", Calls: 1, Time: templateTestTime, Window: window}
+	msg, err := handlers.RenderMailWith(handlers.MailKindFail, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Body, "<p>检查时段 05-26 01:10 ~ 05-26 17:10 收到 1 次构建, 预期至少 2 次.</p>")
+
+	data.Errors = 1
+	msg, err = handlers.RenderMailWith(handlers.MailKindWarn, data, "html", handlers.TemplateOptions{Lang: "en"})
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>demo-app received 1 build notifications during May 26 01:10 - May 26 17:10, 1 of them failed to process.</p>", msg.Body)
+}
@@ -0,0 +1,276 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/leader"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	leaderA = leader.Record{ID: "replica-a", Address: "http://10.0.0.1:8002"}
+	leaderB = leader.Record{ID: "replica-b", Address: "http://10.0.0.2:8002"}
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a, b := leader.NewFileLock(path), leader.NewFileLock(path)
+	ctx := context.Background()
+
+	holder, err := a.Acquire(ctx, leaderA, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+	// 续约
+	holder, err = a.Acquire(ctx, leaderA, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+
+	holder, err = b.Acquire(ctx, leaderB, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+
+	assert.NoError(t, a.Release(ctx, leaderA))
+	holder, err = b.Acquire(ctx, leaderB, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderB, holder)
+	assert.NoError(t, b.Release(ctx, leaderB))
+}
+
+// leaseHolder fake API server 中 Lease 的持有者
+func leaseHolder(t *testing.T, client kubernetes.Interface) string {
+	lease, err := client.CoordinationV1().Leases("ci").Get(context.Background(), "harbor-hook-to-mail", metav1.GetOptions{})
+	if !assert.NoError(t, err) || lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestKubernetesLock(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	newLock := func() *leader.KubernetesLock {
+		return &leader.KubernetesLock{Client: client, Namespace: "ci", Name: "harbor-hook-to-mail"}
+	}
+	a, b := newLock(), newLock()
+	ctx := context.Background()
+
+	holder, err := a.Acquire(ctx, leaderA, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+	assert.Equal(t, leaderA.ID, leaseHolder(t, client))
+
+	// 租约未过期, 返回 leader 的地址
+	holder, err = b.Acquire(ctx, leaderB, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+
+	// leader 停止续约, 从 b 观察到的时间开始超过租约后接替
+	time.Sleep(1100 * time.Millisecond)
+	holder, err = b.Acquire(ctx, leaderB, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderB, holder)
+	assert.Equal(t, leaderB.ID, leaseHolder(t, client))
+
+	holder, err = a.Acquire(ctx, leaderA, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderB, holder)
+
+	// 释放后其他副本不需要等待过期
+	assert.NoError(t, b.Release(ctx, leaderB))
+	assert.Empty(t, leaseHolder(t, client))
+	holder, err = a.Acquire(ctx, leaderA, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+}
+
+func TestRedisLock(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	a := leader.NewRedisLock(server.Addr(), "secret", 0, "hook/leader")
+	b := leader.NewRedisLock(server.Addr(), "secret", 0, "hook/leader")
+	ctx := context.Background()
+
+	holder, err := a.Acquire(ctx, leaderA, 10*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+	assert.Equal(t, 10*time.Second, server.TTL("hook/leader"))
+
+	holder, err = b.Acquire(ctx, leaderB, 10*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderA, holder)
+
+	// 其他副本不能释放
+	assert.NoError(t, b.Release(ctx, leaderB))
+	assert.True(t, server.Exists("hook/leader"))
+
+	// 过期后接替
+	server.FastForward(11 * time.Second)
+	holder, err = b.Acquire(ctx, leaderB, 10*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, leaderB, holder)
+
+	assert.NoError(t, b.Release(ctx, leaderB))
+	assert.False(t, server.Exists("hook/leader"))
+
+	wrong := leader.NewRedisLock(server.Addr(), "wrong", 0, "hook/leader")
+	_, err = wrong.Acquire(ctx, leaderA, time.Second)
+	assert.Error(t, err)
+}
+
+func TestElector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	options := leader.Options{LeaseDuration: time.Second, RetryPeriod: 20 * time.Millisecond}
+	var started, stopped int32
+	newElector := func(self leader.Record) *leader.Elector {
+		e := leader.NewElector(leader.NewFileLock(path), self, options)
+		e.OnStartedLeading = func() error {
+			atomic.AddInt32(&started, 1)
+			return nil
+		}
+		e.OnStoppedLeading = func() { atomic.AddInt32(&stopped, 1) }
+		return e
+	}
+
+	a := newElector(leaderA)
+	a.Start()
+	assert.Eventually(t, a.IsLeader, time.Second, 10*time.Millisecond)
+
+	b := newElector(leaderB)
+	b.Start()
+	defer b.Stop()
+	assert.Eventually(t, func() bool {
+		current, ok := b.Leader()
+		return ok && current == leaderA
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, b.IsLeader())
+
+	// leader 停止后释放锁, 其他副本接替
+	a.Stop()
+	assert.False(t, a.IsLeader())
+	assert.Eventually(t, b.IsLeader, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&started))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stopped))
+}
+
+func TestLeaderConfig(t *testing.T) {
+	base := "email:\n  server: smtp.example.com\n  port: 25\n  receiver: [dev@example.com]\n"
+
+	cfg, err := config.Load(writeConfigFile(t, base+"leader:\n  type: redis\n  redis:\n    address: redis:6379\n"))
+	if assert.NoError(t, err) {
+		assert.True(t, cfg.LeaderConfig.Enabled())
+		assert.Equal(t, 15*time.Second, cfg.Leader.LeaseDuration)
+		assert.Equal(t, "harbor-hook-to-mail/leader", cfg.Leader.Redis.Key)
+	}
+
+	_, err = config.Load(writeConfigFile(t, base+"leader:\n  type: zookeeper\n"))
+	assert.ErrorContains(t, err, "leader.type")
+
+	_, err = config.Load(writeConfigFile(t, base+"leader:\n  type: file\n  file:\n    path: /shared/leader.lock\n  lease-duration: 2s\n  retry-period: 5s\n"))
+	assert.ErrorContains(t, err, "leader.retry-period")
+
+	_, err = config.Load(writeConfigFile(t, base+"leader:\n  type: file\n  file:\n    path: /shared/leader.lock\n  tls:\n    cert-file: /etc/hook/replica.crt\n"))
+	assert.ErrorContains(t, err, "leader.tls")
+
+	// 限制来源地址时需要 token 信任转发的请求
+	_, err = config.Load(writeConfigFile(t, base+"hook:\n  auth:\n    allow-cidrs: [10.0.0.0/8]\nleader:\n  type: file\n  file:\n    path: /shared/leader.lock\n"))
+	assert.ErrorContains(t, err, "leader.token")
+}
+
+// newReplicaCertificate 副本共用的自签名证书, 同时用于服务端和客户端认证, 返回证书和私钥文件
+func newReplicaCertificate(t *testing.T) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "harbor-hook-to-mail"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "replica.crt"), filepath.Join(dir, "replica.key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certFile, keyFile
+}
+
+func TestForwardToMTLSLeader(t *testing.T) {
+	cert, certFile, keyFile := newReplicaCertificate(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParseCertificate(t, cert.Certificate[0]))
+
+	// leader 要求客户端证书
+	var forwardedBy atomic.Value
+	leaderServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy.Store(r.Header.Get("X-Hook-Forwarded-By"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	leaderServer.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	leaderServer.StartTLS()
+	defer leaderServer.Close()
+
+	lockPath := filepath.Join(t.TempDir(), "leader.lock")
+	lock := leader.NewFileLock(lockPath)
+	_, err := lock.Acquire(context.Background(), leader.Record{ID: leaderA.ID, Address: leaderServer.URL}, time.Minute)
+	assert.NoError(t, err)
+	defer lock.Release(context.Background(), leaderA)
+
+	// follower 使用 server.tls 的证书转发
+	r := newTestRouter(t, fmt.Sprintf("server:\n  tls:\n    cert-file: %s\n    key-file: %s\n    client-ca-file: %s\n"+
+		"leader:\n  type: file\n  id: %s\n  address: %s\n  retry-period: 20ms\n  file:\n    path: %s\n",
+		certFile, keyFile, certFile, leaderB.ID, leaderB.Address, lockPath))
+	// 反向代理需要真实的 ResponseWriter
+	follower := httptest.NewServer(r)
+	defer follower.Close()
+	assert.Eventually(t, func() bool {
+		response, err := http.Post(follower.URL+"/hook/app", "application/json", strings.NewReader(`{"type":"PUSH_ARTIFACT"}`))
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return response.StatusCode == http.StatusAccepted
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, leaderB.ID, forwardedBy.Load())
+}
+
+func mustParseCertificate(t *testing.T, der []byte) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return cert
+}
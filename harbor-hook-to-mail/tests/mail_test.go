@@ -1,31 +1,469 @@
 package tests
 
 import (
-	"log"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
 	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/stretchr/testify/assert"
 )
 
+type stubMessage struct {
+	From string
+	To   []string
+	Data string
+	TLS  bool
+	Auth string
+}
+
+// smtpStub 进程内的 SMTP 服务器, 支持 STARTTLS, SMTPS 和 PLAIN, LOGIN, CRAM-MD5 认证
+type smtpStub struct {
+	Port int
+	// CA 证书文件, 服务器证书由它签发
+	CAFile string
+
+	implicitTLS bool
+	startTLS    bool
+	mechs       []string
+	username    string
+	password    string
+	// 每个连接接收多少封邮件后断开, 0 表示不断开
+	closeAfter int
+	// 每条命令回复前的等待时间
+	delay time.Duration
+
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	conns     int
+	messages  []stubMessage
+}
+
+func newSMTPStub(t *testing.T, configure func(stub *smtpStub)) *smtpStub {
+	stub := &smtpStub{username: "hook@example.com", password: "secret"}
+	if configure != nil {
+		configure(stub)
+	}
+	stub.tlsConfig, stub.CAFile = newStubCertificate(t)
+
+	var listener net.Listener
+	var err error
+	if stub.implicitTLS {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", stub.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { listener.Close() })
+	stub.Port = listener.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			stub.mu.Lock()
+			stub.conns++
+			stub.mu.Unlock()
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func newStubCertificate(t *testing.T) (*tls.Config, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "smtp stub"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, caFile
+}
+
+func (stub *smtpStub) Conns() int {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	return stub.conns
+}
+
+func (stub *smtpStub) Messages() []stubMessage {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	return append([]stubMessage{}, stub.messages...)
+}
+
+func (stub *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	_, isTLS := conn.(*tls.Conn)
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stub ESMTP")
+
+	auth, from, to, received := "", "", []string{}, 0
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		time.Sleep(stub.delay)
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			lines := []string{"stub"}
+			if stub.startTLS && !isTLS {
+				lines = append(lines, "STARTTLS")
+			}
+			if len(stub.mechs) > 0 {
+				lines = append(lines, "AUTH "+strings.Join(stub.mechs, " "))
+			}
+			lines = append(lines, "8BITMIME")
+			for i, ext := range lines {
+				separator := "-"
+				if i == len(lines)-1 {
+					separator = " "
+				}
+				tp.PrintfLine("250%s%s", separator, ext)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, stub.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, isTLS = tlsConn, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			if mech, ok := stub.authenticate(tp, arg); ok {
+				auth = mech
+				tp.PrintfLine("235 authenticated")
+			} else {
+				tp.PrintfLine("535 authentication failed")
+			}
+		case "MAIL":
+			if len(stub.mechs) > 0 && auth == "" {
+				tp.PrintfLine("530 authentication required")
+				continue
+			}
+			from = strings.Trim(strings.Fields(arg[len("FROM:"):])[0], "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			to = append(to, strings.Trim(arg[len("TO:"):], "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			stub.mu.Lock()
+			stub.messages = append(stub.messages, stubMessage{From: from, To: to, Data: string(data), TLS: isTLS, Auth: auth})
+			stub.mu.Unlock()
+			tp.PrintfLine("250 queued")
+			from, to = "", []string{}
+			if received++; stub.closeAfter > 0 && received >= stub.closeAfter {
+				return
+			}
+		case "RSET":
+			from, to = "", []string{}
+			tp.PrintfLine("250 ok")
+		case "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// authenticate 检查 AUTH 命令, 返回认证方式
+func (stub *smtpStub) authenticate(tp *textproto.Conn, arg string) (string, bool) {
+	mech, initial, _ := strings.Cut(arg, " ")
+	mech = strings.ToUpper(mech)
+	challenge := func(text string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(text)))
+		line, _ := tp.ReadLine()
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded)
+	}
+	switch mech {
+	case "PLAIN":
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		return mech, string(decoded) == "\x00"+stub.username+"\x00"+stub.password
+	case "LOGIN":
+		username := challenge("Username:")
+		password := challenge("Password:")
+		return mech, username == stub.username && password == stub.password
+	case "CRAM-MD5":
+		nonce := "<1896.697170952@stub>"
+		response := challenge(nonce)
+		mac := hmac.New(md5.New, []byte(stub.password))
+		mac.Write([]byte(nonce))
+		return mech, response == stub.username+" "+hex.EncodeToString(mac.Sum(nil))
+	}
+	return mech, false
+}
+
+func newStubSender(t *testing.T, stub *smtpStub, options SMTPOptions) *EmailSender {
+	sender, err := NewEmailSenderWithOptions("127.0.0.1", stub.Port, stub.username, stub.password, options)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { sender.Close() })
+	return sender
+}
+
 func TestSMTPClient_SendEmail(t *testing.T) {
-	configPath := os.Getenv("config_file_path")
-	config, err := LoadEmailConfig(configPath)
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+	stub := newSMTPStub(t, func(stub *smtpStub) { stub.mechs = []string{"PLAIN", "LOGIN"} })
+	sender := newStubSender(t, stub, SMTPOptions{Name: "Harbor Hook"})
+
+	assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "This is a test email."))
+	assert.NoError(t, sender.SendEmailWithAttachment("构建通知", []string{"dev@example.com"}, []string{"qa@example.com"}, "<p>SUCCESS</p>", "html", nil))
+
+	messages := stub.Messages()
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "hook@example.com", messages[0].From)
+		assert.Equal(t, []string{"dev@example.com"}, messages[0].To)
+		assert.Equal(t, "PLAIN", messages[0].Auth)
+		assert.False(t, messages[0].TLS)
+		assert.Contains(t, messages[0].Data, `From: "Harbor Hook" <hook@example.com>`)
+		assert.Contains(t, messages[0].Data, "This is a test email.")
+		assert.Equal(t, []string{"dev@example.com", "qa@example.com"}, messages[1].To)
 	}
+}
 
-	sender := NewEmailSender(config.Email.Server, config.Email.Port, config.Email.Sender.Address, config.Email.Sender.Password)
+func TestSMTPCommandTimeout(t *testing.T) {
+	// 整个会话超过 timeout, 但每条命令都在 timeout 内完成
+	stub := newSMTPStub(t, func(stub *smtpStub) { stub.delay = 100 * time.Millisecond })
+	sender := newStubSender(t, stub, SMTPOptions{Auth: AuthNone, Timeout: 300 * time.Millisecond})
+	start := time.Now()
+	assert.NoError(t, sender.SendEmail([]string{"dev@example.com", "qa@example.com"}, "Test mail", "body"))
+	assert.Greater(t, time.Since(start), 300*time.Millisecond)
+	assert.Len(t, stub.Messages(), 1)
 
-	err = sender.SendEmail(config.Email.Receiver, config.Email.Body.Subject, config.Email.Body.Message)
-	if err != nil {
-		log.Fatal(err)
+	// 没有回复的命令在 timeout 后失败
+	stalled := newSMTPStub(t, func(stub *smtpStub) { stub.delay = 2 * time.Second })
+	sender = newStubSender(t, stalled, SMTPOptions{Auth: AuthNone, Timeout: 200 * time.Millisecond})
+	start = time.Now()
+	err := sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body")
+	assert.ErrorContains(t, err, "i/o timeout")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestEmailNotifierCc(t *testing.T) {
+	stub := newSMTPStub(t, func(stub *smtpStub) { stub.mechs = []string{"PLAIN"} })
+	sender := newStubSender(t, stub, SMTPOptions{})
+	notifier := notifiers.NewEmailNotifier("email", sender, []string{"dev@example.com"}, []string{"qa@example.com"})
+
+	// 没有附件的纯文本邮件和 HTML 邮件都发送给抄送人
+	assert.NoError(t, notifier.Notify(&notifiers.Message{App: "demo-app", Title: "构建通知", Body: "SUCCESS"}))
+	assert.NoError(t, notifier.Notify(&notifiers.Message{App: "demo-app", Title: "构建通知", Body: "<p>SUCCESS</p>", BodyType: "html"}))
+
+	messages := stub.Messages()
+	if assert.Len(t, messages, 2) {
+		for _, message := range messages {
+			assert.Equal(t, []string{"dev@example.com", "qa@example.com"}, message.To)
+			assert.Contains(t, message.Data, "Cc: <qa@example.com>")
+		}
+		assert.Contains(t, messages[0].Data, "SUCCESS")
+	}
+}
+
+func TestSMTPTransport(t *testing.T) {
+	for name, tc := range map[string]struct {
+		implicitTLS bool
+		auth        string
+		mech        string
+	}{
+		"starttls login":    {auth: AuthLogin, mech: "LOGIN"},
+		"starttls plain":    {auth: AuthPlain, mech: "PLAIN"},
+		"starttls cram-md5": {auth: "CRAM-MD5", mech: "CRAM-MD5"},
+		"smtps cram-md5":    {implicitTLS: true, auth: AuthCRAMMD5, mech: "CRAM-MD5"},
+		"smtps default":     {implicitTLS: true, mech: "PLAIN"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			stub := newSMTPStub(t, func(stub *smtpStub) {
+				stub.implicitTLS, stub.startTLS = tc.implicitTLS, !tc.implicitTLS
+				stub.mechs = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+			})
+			transport := TransportSTARTTLS
+			if tc.implicitTLS {
+				transport = TransportSMTPS
+			}
+			sender := newStubSender(t, stub, SMTPOptions{Transport: transport, Auth: tc.auth, CAFile: stub.CAFile})
+
+			assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+			messages := stub.Messages()
+			if assert.Len(t, messages, 1) {
+				assert.True(t, messages[0].TLS)
+				assert.Equal(t, tc.mech, messages[0].Auth)
+			}
+		})
+	}
+}
+
+func TestSMTPCertificate(t *testing.T) {
+	stub := newSMTPStub(t, func(stub *smtpStub) {
+		stub.startTLS = true
+		stub.mechs = []string{"PLAIN"}
+	})
+
+	// 不信任自签名证书
+	sender := newStubSender(t, stub, SMTPOptions{Transport: TransportSTARTTLS})
+	err := sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate")
+	}
+
+	sender = newStubSender(t, stub, SMTPOptions{Transport: TransportSTARTTLS, InsecureSkipVerify: true})
+	assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+
+	_, err = NewEmailSenderWithOptions("127.0.0.1", stub.Port, "", "", SMTPOptions{CAFile: filepath.Join(t.TempDir(), "missing.crt")})
+	assert.Error(t, err)
+}
+
+func TestSMTPWithoutAuth(t *testing.T) {
+	// 中继服务器不需要认证
+	stub := newSMTPStub(t, nil)
+	sender, err := NewEmailSenderWithOptions("127.0.0.1", stub.Port, "hook@example.com", "", SMTPOptions{Auth: AuthNone})
+	assert.NoError(t, err)
+	assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+	assert.Len(t, stub.Messages(), 1)
+
+	// 服务器要求认证, 但配置为不认证
+	stub = newSMTPStub(t, func(stub *smtpStub) { stub.mechs = []string{"PLAIN"} })
+	sender, err = NewEmailSenderWithOptions("127.0.0.1", stub.Port, "hook@example.com", "", SMTPOptions{Auth: AuthNone})
+	assert.NoError(t, err)
+	assert.Error(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+
+	// 密码错误
+	sender, err = NewEmailSenderWithOptions("127.0.0.1", stub.Port, "hook@example.com", "wrong", SMTPOptions{})
+	assert.NoError(t, err)
+	assert.Error(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+}
+
+func TestSMTPOpportunisticStartTLS(t *testing.T) {
+	stub := newSMTPStub(t, func(stub *smtpStub) {
+		stub.startTLS = true
+		stub.mechs = []string{"PLAIN"}
+	})
+
+	// 默认传输方式在服务器支持时升级为 TLS
+	sender := newStubSender(t, stub, SMTPOptions{CAFile: stub.CAFile})
+	assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+	// plain 不升级
+	sender = newStubSender(t, stub, SMTPOptions{Transport: TransportPlain})
+	assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body"))
+
+	messages := stub.Messages()
+	if assert.Len(t, messages, 2) {
+		assert.True(t, messages[0].TLS)
+		assert.Equal(t, "PLAIN", messages[0].Auth)
+		assert.False(t, messages[1].TLS)
+		assert.Equal(t, "PLAIN", messages[1].Auth)
+	}
+}
+
+func TestSMTPAuthNotAdvertised(t *testing.T) {
+	// 配置了密码, 服务器没有提供 AUTH 时不会不认证就发送
+	stub := newSMTPStub(t, nil)
+	sender := newStubSender(t, stub, SMTPOptions{})
+	err := sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AUTH")
+	}
+	assert.Empty(t, stub.Messages())
+}
+
+func TestSMTPStartTLSRequired(t *testing.T) {
+	stub := newSMTPStub(t, nil)
+	sender := newStubSender(t, stub, SMTPOptions{Transport: TransportSTARTTLS, Auth: AuthNone})
+	err := sender.SendEmail([]string{"dev@example.com"}, "Test mail", "body")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "STARTTLS")
 	}
+	assert.Empty(t, stub.Messages())
+}
+
+func TestSMTPConnectionReuse(t *testing.T) {
+	send := func(sender *EmailSender, count int) {
+		for i := 0; i < count; i++ {
+			assert.NoError(t, sender.SendEmail([]string{"dev@example.com"}, "Test mail "+strconv.Itoa(i), "body"))
+		}
+	}
+
+	stub := newSMTPStub(t, func(stub *smtpStub) { stub.mechs = []string{"PLAIN"} })
+	send(newStubSender(t, stub, SMTPOptions{KeepAlive: time.Minute}), 3)
+	assert.Len(t, stub.Messages(), 3)
+	assert.Equal(t, 1, stub.Conns())
+
+	stub = newSMTPStub(t, func(stub *smtpStub) { stub.mechs = []string{"PLAIN"} })
+	send(newStubSender(t, stub, SMTPOptions{}), 3)
+	assert.Equal(t, 3, stub.Conns())
+
+	// 服务器关闭了空闲连接时重新连接
+	stub = newSMTPStub(t, func(stub *smtpStub) {
+		stub.closeAfter = 1
+		stub.mechs = []string{"PLAIN"}
+	})
+	send(newStubSender(t, stub, SMTPOptions{KeepAlive: time.Minute}), 3)
+	assert.Len(t, stub.Messages(), 3)
+	assert.Equal(t, 3, stub.Conns())
+
+	// 空闲超时后关闭连接
+	stub = newSMTPStub(t, func(stub *smtpStub) { stub.mechs = []string{"PLAIN"} })
+	sender := newStubSender(t, stub, SMTPOptions{KeepAlive: 20 * time.Millisecond})
+	send(sender, 1)
+	time.Sleep(100 * time.Millisecond)
+	send(sender, 1)
+	assert.Equal(t, 2, stub.Conns())
+}
 
-	// err = sender.SendEmailWithAttachment([]string{config.Email.Receiver.Address}, config.Email.Body.Subject, config.Email.Body.Message, config.Email.Attachments)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	t.Logf("Email sent successfully!")
+func TestSMTPOptionsValidate(t *testing.T) {
+	_, err := NewEmailSenderWithOptions("mail.example.com", 25, "", "", SMTPOptions{Transport: "ssl"})
+	assert.Error(t, err)
+	_, err = NewEmailSenderWithOptions("mail.example.com", 25, "", "", SMTPOptions{Auth: "xoauth2"})
+	assert.Error(t, err)
+	_, err = NewEmailSenderWithOptions("mail.example.com", 25, "", "", SMTPOptions{Transport: "SMTPS", Auth: "Login"})
+	assert.NoError(t, err)
+	_, err = NewEmailSenderWithOptions("mail.example.com", 25, "", "", SMTPOptions{Transport: TransportPlain})
+	assert.NoError(t, err)
 }
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+const matchConfig = `
+hook:
+  match:
+  - project: build-hook
+  - project: apps
+    repository: "team-*/*"
+    tag: '^(?:(?P<app>[a-z-]+)-)?(?P<env>dev|test|prod)-(?P<timestamp>\d{14})$'
+    apps:
+      team-a/backend: demo-app
+`
+
+func TestArtifactMatcher(t *testing.T) {
+	// 未配置时与之前相同, 只处理 build-hook 项目, 应用名为仓库名
+	matcher, err := NewArtifactMatcher(nil)
+	assert.NoError(t, err)
+	match, ok := matcher.Match("harbor.example.com/build-hook/test-app:p0_20240526171000", "")
+	if assert.True(t, ok) {
+		assert.Equal(t, "test-app", match.App)
+		assert.Equal(t, "p0_20240526171000", match.Tag)
+		assert.True(t, match.BuiltAt.IsZero())
+	}
+	_, ok = matcher.Match("harbor.example.com/library/test-app:v1", "")
+	assert.False(t, ok)
+
+	hookConfig := &HookConfig{}
+	assert.NoError(t, yaml.Unmarshal([]byte(matchConfig), hookConfig))
+	matcher, err = NewArtifactMatcher(hookConfig.Hook.Match)
+	assert.NoError(t, err)
+
+	// 仓库映射优先于 tag 中的应用名
+	match, ok = matcher.Match("harbor.example.com:443/apps/team-a/backend@sha256:1234", "web-prod-20240630120000")
+	if assert.True(t, ok) {
+		assert.Equal(t, "demo-app", match.App)
+		assert.Equal(t, "apps", match.Project)
+		assert.Equal(t, "team-a/backend", match.Repository)
+		assert.Equal(t, "prod", match.Env)
+		assert.Equal(t, time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local), match.BuiltAt)
+	}
+	match, ok = matcher.Match("harbor.example.com/apps/team-b/frontend:web-dev-20240630120000", "")
+	if assert.True(t, ok) {
+		assert.Equal(t, "web", match.App)
+		assert.Equal(t, "dev", match.Env)
+	}
+	// 没有 app 分组时使用仓库名的最后一段
+	match, ok = matcher.Match("harbor.example.com/apps/team-b/frontend:test-20240630120000", "")
+	if assert.True(t, ok) {
+		assert.Equal(t, "frontend", match.App)
+	}
+
+	// tag, 仓库或项目不匹配
+	_, ok = matcher.Match("harbor.example.com/apps/team-b/frontend:latest", "")
+	assert.False(t, ok)
+	_, ok = matcher.Match("harbor.example.com/apps/frontend:dev-20240630120000", "")
+	assert.False(t, ok)
+	_, ok = matcher.Match("harbor.example.com/library/team-a/backend:dev-20240630120000", "")
+	assert.False(t, ok)
+}
+
+func TestMatchConfigValidate(t *testing.T) {
+	validate := func(rule MatchRule) error {
+		hookConfig := &HookConfig{}
+		hookConfig.Hook.ContextPath = "/hook"
+		hookConfig.Hook.Match = []MatchRule{rule}
+		return hookConfig.Validate()
+	}
+	assert.NoError(t, validate(MatchRule{Project: "apps", Tag: `^(?P<env>\w+)-\d+$`}))
+	assert.ErrorContains(t, validate(MatchRule{Project: "apps["}), "invalid glob")
+	assert.ErrorContains(t, validate(MatchRule{Tag: `^(?P<env>\w+`}), "hook.match[0].tag")
+	assert.ErrorContains(t, validate(MatchRule{Tag: `^(?P<branch>\w+)$`}), `unknown group "branch"`)
+	assert.ErrorContains(t, validate(MatchRule{Apps: map[string]string{"team-a/backend": ""}}), "empty app name")
+}
+
+func TestRenderDetailEnv(t *testing.T) {
+	data := &handlers.MailData{App: "demo-app", Tag: "prod-20240526171000", Result: "SUCCESS", Time: templateTestTime, Env: "prod", BuiltAt: templateTestTime}
+	msg, err := handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Summary, "- 环境: prod\n- 构建时间: 2024-05-26 17:10:00")
+	assert.Contains(t, msg.Body, `<tr><th align="left">环境</th><td>prod</td></tr>`)
+
+	data.Env, data.BuiltAt = "", time.Time{}
+	msg, err = handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{Lang: "en"})
+	assert.NoError(t, err)
+	assert.NotContains(t, msg.Summary, "Env")
+	assert.NotContains(t, msg.Body, "Built at")
+}
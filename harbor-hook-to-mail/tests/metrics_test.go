@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/metrics"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectedMetric(t *testing.T) {
+	r := newAuthEngine(t, "harbor-secret")
+	before := testutil.ToFloat64(metrics.HookRejected.WithLabelValues("test-app"))
+
+	assert.Equal(t, http.StatusUnauthorized, postHook(r, "10.0.0.1:1234", "wrong-secret"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.HookRejected.WithLabelValues("test-app")))
+}
+
+func TestBuildCollector(t *testing.T) {
+	s := openTestStore(t)
+	hookConfig := &HookConfig{}
+	hookConfig.Hook.Apps = []AppConfig{{Name: "demo-app"}, {Name: "demo-ui"}}
+
+	addBuild(t, s, "demo-app", store.StatusProcessed, "SUCCESS", time.Now().Add(-time.Hour))
+	addBuild(t, s, "demo-app", store.StatusProcessed, "FAILURE", time.Now())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(routes.NewBuildCollector(s, func() *HookConfig { return hookConfig }))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `harbor_hook_seconds_since_last_success{app="demo-ui"} -1`)
+
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, `harbor_hook_seconds_since_last_success{app="demo-app"}`) {
+			seconds, err := strconv.ParseFloat(strings.Fields(line)[1], 64)
+			assert.NoError(t, err)
+			assert.InDelta(t, time.Hour.Seconds(), seconds, 60)
+			return
+		}
+	}
+	t.Errorf("metric for demo-app not found in:\n%s", w.Body.String())
+}
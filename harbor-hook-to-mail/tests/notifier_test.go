@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+type capturedRequest struct {
+	Query   map[string][]string
+	Headers http.Header
+	Body    map[string]interface{}
+}
+
+func newCaptureServer(t *testing.T, response string, captured *capturedRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured.Query = r.URL.Query()
+		captured.Headers = r.Header
+		json.NewDecoder(r.Body).Decode(&captured.Body)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAppConfigUnmarshal(t *testing.T) {
+	var hookConfig HookConfig
+	err := yaml.Unmarshal([]byte(`
+hook:
+  apps:
+  - "demo-ui"
+  - name: "demo-app"
+    channels: ["email", "dingtalk-ops"]
+`), &hookConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []AppConfig{
+		{Name: "demo-ui"},
+		{Name: "demo-app", Channels: []string{"email", "dingtalk-ops"}},
+	}, hookConfig.Hook.Apps)
+
+	app, ok := hookConfig.GetApp("demo-app")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"email", "dingtalk-ops"}, app.Channels)
+}
+
+func TestDingTalkNotifier(t *testing.T) {
+	var captured capturedRequest
+	server := newCaptureServer(t, `{"errcode":0,"errmsg":"ok"}`, &captured)
+
+	notifier, err := notifiers.NewNotifier(ChannelConfig{Name: "ops", Type: "dingtalk", URL: server.URL + "/robot/send?access_token=abc", Secret: "SEC123"})
+	assert.NoError(t, err)
+	assert.NoError(t, notifier.Notify(&notifiers.Message{Title: "构建通知", Summary: "- 构建结果: 成功"}))
+
+	assert.Equal(t, "abc", captured.Query["access_token"][0])
+	assert.NotEmpty(t, captured.Query["timestamp"])
+	assert.NotEmpty(t, captured.Query["sign"])
+	assert.Equal(t, "markdown", captured.Body["msgtype"])
+	assert.Equal(t, "### 构建通知\n\n- 构建结果: 成功", captured.Body["markdown"].(map[string]interface{})["text"])
+}
+
+func TestRobotNotifierError(t *testing.T) {
+	var captured capturedRequest
+	server := newCaptureServer(t, `{"errcode":93000,"errmsg":"invalid webhook url"}`, &captured)
+
+	notifier, _ := notifiers.NewNotifier(ChannelConfig{Name: "wecom", Type: "wecom", URL: server.URL})
+	err := notifier.Notify(&notifiers.Message{Title: "构建通知"})
+	assert.ErrorContains(t, err, "invalid webhook url")
+	assert.Equal(t, "### 构建通知\n构建通知", captured.Body["markdown"].(map[string]interface{})["content"])
+}
+
+func TestSlackAndWebhookNotifier(t *testing.T) {
+	var slackRequest, webhookRequest capturedRequest
+	slackServer := newCaptureServer(t, "ok", &slackRequest)
+	webhookServer := newCaptureServer(t, "", &webhookRequest)
+
+	msg := &notifiers.Message{App: "demo-app", Title: "构建通知", Summary: "构建结果: 成功", Body: "<p>详情</p>", BodyType: "html"}
+
+	slack, _ := notifiers.NewNotifier(ChannelConfig{Name: "slack", Type: "slack", URL: slackServer.URL})
+	assert.NoError(t, slack.Notify(msg))
+	assert.Equal(t, "*构建通知*\n构建结果: 成功", slackRequest.Body["text"])
+
+	webhook, _ := notifiers.NewNotifier(ChannelConfig{Name: "ci", Type: "webhook", URL: webhookServer.URL, Headers: map[string]string{"X-Token": "t"}})
+	assert.NoError(t, webhook.Notify(msg))
+	assert.Equal(t, "t", webhookRequest.Headers.Get("X-Token"))
+	assert.Equal(t, "demo-app", webhookRequest.Body["app"])
+	assert.Equal(t, "<p>详情</p>", webhookRequest.Body["body"])
+}
+
+func TestNewNotifierInvalidChannel(t *testing.T) {
+	_, err := notifiers.NewNotifier(ChannelConfig{Name: "x", Type: "telegram", URL: "http://localhost"})
+	assert.Error(t, err)
+	_, err = notifiers.NewNotifier(ChannelConfig{Name: "x", Type: "slack"})
+	assert.Error(t, err)
+}
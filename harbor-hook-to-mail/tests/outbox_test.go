@@ -0,0 +1,246 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/notifiers"
+	"github.com/exyb/harbor-hook-to-mail/outbox"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func testOutboxOptions() outbox.Options {
+	return outbox.Options{
+		Backoff:      10 * time.Millisecond,
+		MaxBackoff:   40 * time.Millisecond,
+		MaxAge:       time.Minute,
+		PollInterval: 10 * time.Millisecond,
+	}
+}
+
+func waitMail(t *testing.T, ch chan *store.Mail) *store.Mail {
+	select {
+	case mail := <-ch:
+		return mail
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	s := openTestStore(t)
+	var attempts int32
+	o := outbox.New(s, func(mail *store.Mail) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("421 service not available")
+		}
+		return nil
+	}, testOutboxOptions())
+	finished := make(chan *store.Mail, 1)
+	o.OnFinish = func(mail *store.Mail) { finished <- mail }
+	o.Start()
+	defer o.Stop()
+
+	assert.NoError(t, o.Add(&store.Mail{App: "demo-app", Channel: "email", Title: "构建通知"}))
+	mail := waitMail(t, finished)
+	assert.Equal(t, store.MailSent, mail.Status)
+	assert.Equal(t, 3, mail.Attempts)
+	assert.Empty(t, mail.LastError)
+
+	saved, err := s.GetMail(mail.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, store.MailSent, saved.Status)
+	assert.False(t, saved.SentAt.IsZero())
+}
+
+func TestOutboxMaxAge(t *testing.T) {
+	s := openTestStore(t)
+	options := testOutboxOptions()
+	options.MaxAge = 50 * time.Millisecond
+	o := outbox.New(s, func(mail *store.Mail) error {
+		panic("smtp client crashed")
+	}, options)
+	finished := make(chan *store.Mail, 1)
+	o.OnFinish = func(mail *store.Mail) { finished <- mail }
+	o.Start()
+	defer o.Stop()
+
+	assert.NoError(t, o.Add(&store.Mail{App: "demo-app", Channel: "email", Title: "构建通知"}))
+	mail := waitMail(t, finished)
+	assert.Equal(t, store.MailFailed, mail.Status)
+	assert.Greater(t, mail.Attempts, 1)
+	assert.Equal(t, "panic: smtp client crashed", mail.LastError)
+
+	failed, err := s.Mails(store.MailFailed)
+	assert.NoError(t, err)
+	assert.Len(t, failed, 1)
+	pending, err := s.Mails(store.MailPending)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestOutboxResumeAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.db")
+	s, err := store.Open(path, 0)
+	assert.NoError(t, err)
+	// 没有启动的 outbox 只保存通知
+	stopped := outbox.New(s, func(mail *store.Mail) error { return nil }, testOutboxOptions())
+	assert.NoError(t, stopped.Add(&store.Mail{App: "demo-app", Channel: "email", Title: "构建通知"}))
+	assert.NoError(t, s.Close())
+
+	s, err = store.Open(path, 0)
+	assert.NoError(t, err)
+	defer s.Close()
+	sent := make(chan *store.Mail, 1)
+	o := outbox.New(s, func(mail *store.Mail) error {
+		sent <- mail
+		return nil
+	}, testOutboxOptions())
+	o.Start()
+	defer o.Stop()
+	assert.Equal(t, "构建通知", waitMail(t, sent).Title)
+}
+
+func TestRecordMailStatus(t *testing.T) {
+	s := openTestStore(t)
+	record := &store.BuildRecord{App: "demo-app", Type: EventPushArtifact, Status: store.StatusQueued, MailStatus: store.MailPending}
+	assert.NoError(t, s.Add(record))
+	email := &store.Mail{App: "demo-app", Channel: "email", RecordID: record.ID}
+	wecom := &store.Mail{App: "demo-app", Channel: "wecom", RecordID: record.ID}
+	assert.NoError(t, s.AddMail(email))
+	assert.NoError(t, s.AddMail(wecom))
+	recordMailStatus := func() (string, string) {
+		last, err := s.Last("demo-app", nil)
+		assert.NoError(t, err)
+		return last.MailStatus, last.MailError
+	}
+
+	// 其他渠道还在发送
+	email.Status = store.MailSent
+	assert.NoError(t, s.UpdateMail(email))
+	assert.NoError(t, s.UpdateRecordMailStatus("demo-app", record.ID))
+	status, _ := recordMailStatus()
+	assert.Equal(t, store.MailPending, status)
+
+	// 任一渠道失败时为失败, 不论哪个渠道最后发送结束
+	wecom.Status, wecom.LastError = store.MailFailed, "timeout"
+	assert.NoError(t, s.UpdateMail(wecom))
+	assert.NoError(t, s.UpdateRecordMailStatus("demo-app", record.ID))
+	status, mailError := recordMailStatus()
+	assert.Equal(t, store.MailFailed, status)
+	assert.Equal(t, "wecom: timeout", mailError)
+
+	// outbox 发送结束早于记录保存时, 保存记录不会覆盖发送结果
+	record.Status = store.StatusProcessed
+	assert.NoError(t, s.Update(record))
+	assert.Equal(t, store.MailFailed, record.MailStatus)
+	status, _ = recordMailStatus()
+	assert.Equal(t, store.MailFailed, status)
+
+	// 全部发送成功
+	wecom.Status, wecom.LastError = store.MailSent, ""
+	assert.NoError(t, s.UpdateMail(wecom))
+	assert.NoError(t, s.UpdateRecordMailStatus("demo-app", record.ID))
+	status, mailError = recordMailStatus()
+	assert.Equal(t, store.MailSent, status)
+	assert.Empty(t, mailError)
+
+	assert.Error(t, s.UpdateRecordMailStatus("demo-app", 100))
+}
+
+const outboxConfigTemplate = `
+email:
+  server: mail.example.com
+  port: 25
+  sender:
+    address: hook@example.com
+    password: %s
+  receiver: [dev@example.com]
+notify:
+  channels:
+  - name: ci-webhook
+    type: webhook
+    url: %s
+hook:
+  apps:
+  - name: demo-app
+    channels: [ci-webhook]
+`
+
+func TestNotifyOutbox(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf(outboxConfigTemplate, encryptedPassword(t, "secret"), server.URL)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	cfg, err := Load(path)
+	assert.NoError(t, err)
+	// 不替换当前配置, 发送和重试都使用传入的 handlerConfig
+	handlerConfig, err := handlers.NewHandlerConfig(cfg)
+	assert.NoError(t, err)
+
+	s := openTestStore(t)
+	o := outbox.New(s, handlerConfig.Deliver, testOutboxOptions())
+	finished := make(chan *store.Mail, 1)
+	o.OnFinish = func(mail *store.Mail) { finished <- mail }
+	handlers.SetOutbox(o)
+	defer handlers.SetOutbox(nil)
+
+	// 写入 outbox 后立即返回, 不等待发送
+	assert.NoError(t, handlerConfig.Notify("demo-app", &notifiers.Message{Title: "构建通知", RecordID: 7}))
+	pending, err := s.Mails(store.MailPending)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "ci-webhook", pending[0].Channel)
+		assert.Equal(t, uint64(7), pending[0].RecordID)
+	}
+
+	o.Start()
+	defer o.Stop()
+	mail := waitMail(t, finished)
+	assert.Equal(t, store.MailSent, mail.Status)
+	assert.Equal(t, 2, mail.Attempts)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestAPIOutbox(t *testing.T) {
+	r, s := newAPIEngine(t)
+	sent := &store.Mail{App: "demo-app", Channel: "email", Title: "构建通知", Body: "<p>SUCCESS</p>"}
+	assert.NoError(t, s.AddMail(sent))
+	assert.NoError(t, s.AddMail(&store.Mail{App: "demo-ui", Channel: "email", Title: "构建通知"}))
+	sent.Status = store.MailSent
+	assert.NoError(t, s.UpdateMail(sent))
+
+	var mails []store.Mail
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/outbox", &mails))
+	assert.Len(t, mails, 2)
+	mails = nil
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/outbox?status=sent&app=demo-app", &mails))
+	if assert.Len(t, mails, 1) {
+		assert.Empty(t, mails[0].Body)
+	}
+
+	var mail store.Mail
+	assert.Equal(t, http.StatusOK, getAPI(t, r, fmt.Sprintf("/api/outbox/%d", sent.ID), &mail))
+	assert.Equal(t, "<p>SUCCESS</p>", mail.Body)
+	assert.Equal(t, http.StatusNotFound, getAPI(t, r, "/api/outbox/100", nil))
+	assert.Equal(t, http.StatusBadRequest, getAPI(t, r, "/api/outbox/abc", nil))
+	assert.Equal(t, http.StatusBadRequest, getAPI(t, r, "/api/outbox?status=lost", nil))
+}
@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/queue"
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func testQueueOptions() queue.Options {
+	return queue.Options{
+		Workers:      2,
+		Size:         10,
+		MaxAttempts:  3,
+		Backoff:      10 * time.Millisecond,
+		MaxBackoff:   40 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, queue.Backoff(1, 10*time.Second, time.Minute))
+	assert.Equal(t, 20*time.Second, queue.Backoff(2, 10*time.Second, time.Minute))
+	assert.Equal(t, 40*time.Second, queue.Backoff(3, 10*time.Second, time.Minute))
+	assert.Equal(t, time.Minute, queue.Backoff(4, 10*time.Second, time.Minute))
+	assert.Equal(t, time.Minute, queue.Backoff(20, 10*time.Second, time.Minute))
+}
+
+func TestQueueProcess(t *testing.T) {
+	s := openTestStore(t)
+	done := make(chan string, 2)
+	q := queue.New(s, func(job *store.Job) error {
+		done <- job.App
+		return nil
+	}, testQueueOptions())
+	q.Start()
+	defer q.Stop()
+
+	assert.NoError(t, q.Enqueue(&store.Job{App: "demo-app", Type: "PUSH_ARTIFACT"}))
+	assert.NoError(t, q.Enqueue(&store.Job{App: "demo-ui", Type: "PUSH_ARTIFACT"}))
+
+	apps := []string{waitValue(t, done), waitValue(t, done)}
+	assert.ElementsMatch(t, []string{"demo-app", "demo-ui"}, apps)
+	assert.Eventually(t, func() bool {
+		jobs, _ := s.Jobs(store.JobPending)
+		return len(jobs) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueRetryAndDeadLetter(t *testing.T) {
+	s := openTestStore(t)
+	var attempts int32
+	var mu sync.Mutex
+	var times []time.Time
+	q := queue.New(s, func(job *store.Job) error {
+		atomic.AddInt32(&attempts, 1)
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		return errors.New("registry unavailable")
+	}, testQueueOptions())
+	dead := make(chan *store.Job, 1)
+	q.OnDead = func(job *store.Job) { dead <- job }
+	q.Start()
+	defer q.Stop()
+
+	assert.NoError(t, q.Enqueue(&store.Job{App: "demo-app", Type: "PUSH_ARTIFACT"}))
+
+	select {
+	case job := <-dead:
+		assert.Equal(t, 3, job.Attempts)
+		assert.Equal(t, "registry unavailable", job.LastError)
+	case <-time.After(2 * time.Second):
+		t.Fatal("job was not moved to dead letters")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	mu.Lock()
+	assert.GreaterOrEqual(t, times[1].Sub(times[0]), 10*time.Millisecond)
+	assert.GreaterOrEqual(t, times[2].Sub(times[1]), 20*time.Millisecond)
+	mu.Unlock()
+
+	pending, err := s.Jobs(store.JobPending)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	deadJobs, err := s.Jobs(store.JobDead)
+	assert.NoError(t, err)
+	if assert.Len(t, deadJobs, 1) {
+		assert.Equal(t, store.JobDead, deadJobs[0].State)
+	}
+}
+
+func TestQueueResumeAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.db")
+	s, err := store.Open(path, 0)
+	assert.NoError(t, err)
+
+	// 没有启动的队列只保存任务
+	stopped := queue.New(s, func(job *store.Job) error { return nil }, testQueueOptions())
+	assert.NoError(t, stopped.Enqueue(&store.Job{App: "demo-app", Type: "PUSH_ARTIFACT"}))
+	assert.NoError(t, s.Close())
+
+	s, err = store.Open(path, 0)
+	assert.NoError(t, err)
+	defer s.Close()
+	done := make(chan string, 1)
+	q := queue.New(s, func(job *store.Job) error {
+		done <- job.App
+		return nil
+	}, testQueueOptions())
+	q.Start()
+	defer q.Stop()
+	assert.Equal(t, "demo-app", waitValue(t, done))
+}
+
+func TestQueueFull(t *testing.T) {
+	s := openTestStore(t)
+	options := testQueueOptions()
+	options.Size = 1
+	q := queue.New(s, func(job *store.Job) error { return nil }, options)
+
+	assert.NoError(t, q.Enqueue(&store.Job{App: "demo-app"}))
+	assert.ErrorIs(t, q.Enqueue(&store.Job{App: "demo-app"}), queue.ErrQueueFull)
+}
+
+func TestQueueFullConcurrent(t *testing.T) {
+	s := openTestStore(t)
+	options := testQueueOptions()
+	options.Size = 3
+	q := queue.New(s, func(job *store.Job) error { return nil }, options)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := q.Enqueue(&store.Job{App: "demo-app"})
+			if err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+				return
+			}
+			assert.ErrorIs(t, err, queue.ErrQueueFull)
+		}()
+	}
+	wg.Wait()
+
+	count, err := s.CountJobs()
+	assert.NoError(t, err)
+	assert.Equal(t, options.Size, count)
+	assert.Equal(t, options.Size, accepted)
+}
+
+func TestAPIJobs(t *testing.T) {
+	r, s := newAPIEngine(t)
+	job := &store.Job{App: "demo-app", Type: "PUSH_ARTIFACT"}
+	assert.NoError(t, s.AddJob(job))
+	assert.NoError(t, s.AddJob(&store.Job{App: "demo-ui", Type: "PUSH_ARTIFACT"}))
+	job.State, job.LastError = store.JobDead, "boom"
+	assert.NoError(t, s.UpdateJob(job))
+
+	var jobs []store.Job
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/jobs", &jobs))
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, "demo-ui", jobs[0].App)
+	}
+	jobs = nil
+	assert.Equal(t, http.StatusOK, getAPI(t, r, "/api/jobs?state=dead&app=demo-app", &jobs))
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, "boom", jobs[0].LastError)
+	}
+	assert.Equal(t, http.StatusBadRequest, getAPI(t, r, "/api/jobs?state=running", nil))
+}
+
+func waitValue(t *testing.T, ch chan string) string {
+	select {
+	case value := <-ch:
+		return value
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+		return ""
+	}
+}
@@ -0,0 +1,372 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeRegistry 进程内的 Registry v2 服务, 使用 Bearer token 认证
+type fakeRegistry struct {
+	server    *httptest.Server
+	manifests map[string][]byte
+	types     map[string]string
+	blobs     map[string][]byte
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	registry := &fakeRegistry{
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		blobs:     make(map[string][]byte),
+	}
+	registry.server = httptest.NewServer(http.HandlerFunc(registry.serveHTTP))
+	t.Cleanup(registry.server.Close)
+	return registry
+}
+
+// newFakeTLSRegistry 使用自签名证书的 registry
+func newFakeTLSRegistry(t *testing.T) *fakeRegistry {
+	registry := &fakeRegistry{
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		blobs:     make(map[string][]byte),
+	}
+	registry.server = httptest.NewTLSServer(http.HandlerFunc(registry.serveHTTP))
+	t.Cleanup(registry.server.Close)
+	return registry
+}
+
+func (r *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "hook" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "test-token"})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer test-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="harbor-registry"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(req.URL.Path, "/")
+	reference := parts[len(parts)-1]
+	switch parts[len(parts)-2] {
+	case "manifests":
+		if body, ok := r.manifests[reference]; ok {
+			w.Header().Set("Content-Type", r.types[reference])
+			w.Write(body)
+			return
+		}
+	case "blobs":
+		if body, ok := r.blobs[reference]; ok {
+			w.Write(body)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "http://"), "https://")
+}
+
+func (r *fakeRegistry) addBlob(content []byte) string {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	r.blobs[digest] = content
+	return digest
+}
+
+func (r *fakeRegistry) addManifest(reference string, mediaType string, value interface{}) string {
+	body, _ := json.Marshal(value)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	r.manifests[reference] = body
+	r.manifests[digest] = body
+	r.types[reference] = mediaType
+	r.types[digest] = mediaType
+	return digest
+}
+
+// pushImage 推送一个多架构镜像, layers 自底向上
+func (r *fakeRegistry) pushImage(tag string, layers ...[]byte) {
+	layerDescriptors := make([]map[string]interface{}, 0, len(layers))
+	for _, layer := range layers {
+		layerDescriptors = append(layerDescriptors, map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+			"digest":    r.addBlob(layer),
+			"size":      len(layer),
+		})
+	}
+	imageDigest := r.addManifest("image-"+tag, "application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"digest": r.addBlob([]byte("{}"))},
+		"layers":        layerDescriptors,
+	})
+	r.addManifest(tag, "application/vnd.oci.image.index.v1+json", map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []map[string]interface{}{
+			{"digest": "sha256:0000", "platform": map[string]string{"os": "windows", "architecture": "amd64"}},
+			{"digest": imageDigest, "platform": map[string]string{"os": "linux", "architecture": runtime.GOARCH}},
+		},
+	})
+}
+
+func buildLayer(t *testing.T, compress bool, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if !assert.NoError(t, tw.WriteHeader(header)) {
+			t.FailNow()
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	if !compress {
+		return buf.Bytes()
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(buf.Bytes())
+	zw.Close()
+	return gz.Bytes()
+}
+
+func TestParseImageReference(t *testing.T) {
+	ref, err := ParseImageReference("harbor.example.com/build-hook/demo-app:p0_20240526171000")
+	assert.NoError(t, err)
+	assert.Equal(t, "harbor.example.com", ref.Host)
+	assert.Equal(t, "build-hook/demo-app", ref.Repository)
+	assert.Equal(t, "p0_20240526171000", ref.Reference)
+
+	ref, err = ParseImageReference("10.0.0.1:5000/build-hook/demo-app@sha256:abcd")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:5000", ref.Host)
+	assert.Equal(t, "sha256:abcd", ref.Reference)
+
+	ref, err = ParseImageReference("localhost/build-hook/demo-app")
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", ref.Reference)
+
+	_, err = ParseImageReference("build-hook/demo-app:latest")
+	assert.Error(t, err)
+}
+
+func TestRegistryClientExtractFiles(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.pushImage("p0_20240526171000",
+		buildLayer(t, true, map[string]string{
+			"build.log":      "old log",
+			"git_commit.txt": "commit abc",
+			"./mail.body":    "<p>构建结果: SUCCESS</p>",
+			"etc/os-release": "alpine",
+		}),
+		buildLayer(t, false, map[string]string{
+			"build.log":          "new log",
+			".wh.git_commit.txt": "",
+		}),
+	)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"/build.log":      filepath.Join(dir, "build.log"),
+		"/git_commit.txt": filepath.Join(dir, "git_commit.txt"),
+		"/mail.body":      filepath.Join(dir, "mail.body"),
+	}
+
+	client := NewRegistryClient("http", "hook", "secret")
+	ref, err := ParseImageReference(registry.host() + "/build-hook/demo-app:p0_20240526171000")
+	assert.NoError(t, err)
+
+	missing, err := client.ExtractFiles(context.Background(), ref, files)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/git_commit.txt"}, missing)
+
+	buildLog, _ := os.ReadFile(files["/build.log"])
+	assert.Equal(t, "new log", string(buildLog))
+	mailBody, _ := os.ReadFile(files["/mail.body"])
+	assert.Equal(t, "<p>构建结果: SUCCESS</p>", string(mailBody))
+	assert.NoFileExists(t, files["/git_commit.txt"])
+}
+
+func TestRegistryClientOpaqueDirectory(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.pushImage("latest",
+		buildLayer(t, true, map[string]string{"hook/build.log": "old log", "hook/mail.body": "old body"}),
+		buildLayer(t, true, map[string]string{"hook/.wh..wh..opq": "", "hook/mail.body": "new body"}),
+	)
+
+	dir := t.TempDir()
+	client := NewRegistryClient("http", "hook", "secret")
+	ref, _ := ParseImageReference(registry.host() + "/build-hook/demo-app")
+
+	missing, err := client.ExtractFiles(context.Background(), ref, map[string]string{
+		"/hook/build.log": filepath.Join(dir, "build.log"),
+		"/hook/mail.body": filepath.Join(dir, "mail.body"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/hook/build.log"}, missing)
+
+	mailBody, _ := os.ReadFile(filepath.Join(dir, "mail.body"))
+	assert.Equal(t, "new body", string(mailBody))
+}
+
+func TestRegistryClientUnauthorized(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.pushImage("latest", buildLayer(t, true, map[string]string{"build.log": "log"}))
+
+	client := NewRegistryClient("http", "hook", "wrong")
+	ref, _ := ParseImageReference(registry.host() + "/build-hook/demo-app")
+	_, err := client.ExtractFiles(context.Background(), ref, map[string]string{"/build.log": filepath.Join(t.TempDir(), "build.log")})
+	assert.Error(t, err)
+}
+
+func TestRegistryForHost(t *testing.T) {
+	registryConfig := &RegistryConfig{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+registry:
+  address: harbor-core.example.com
+  scheme: https
+  auth:
+    username: hook
+    password: secret
+registries:
+- host: harbor.example.com
+  auth:
+    username: robot$hook
+    password: robot-secret
+- host: harbor-dr.example.com:8443
+  docker-config: /etc/hook/docker/config.json
+  tls:
+    ca-file: /etc/hook/dr-ca.crt
+`), registryConfig))
+	assert.NoError(t, registryConfig.Validate())
+
+	registry := registryConfig.ForHost("HARBOR.example.com")
+	assert.Equal(t, "robot$hook", registry.Auth.Username)
+	registry = registryConfig.ForHost("harbor-dr.example.com:8443")
+	assert.Equal(t, "/etc/hook/docker/config.json", registry.DockerConfig)
+	assert.Equal(t, "/etc/hook/dr-ca.crt", registry.TLS.CAFile)
+	// registry.address 使用默认账号
+	registry = registryConfig.ForHost("Harbor-Core.example.com")
+	assert.Equal(t, "Harbor-Core.example.com", registry.Host)
+	assert.Equal(t, "https", registry.Scheme)
+	assert.Equal(t, RegistryAuth{Username: "hook", Password: "secret"}, registry.Auth)
+	// 其他地址匿名访问, 不发送默认账号
+	registry = registryConfig.ForHost("10.0.0.1:5000")
+	assert.Equal(t, "10.0.0.1:5000", registry.Host)
+	assert.Empty(t, registry.Auth)
+	registryConfig.Registry.Address = "https://10.0.0.1:5000/"
+	assert.Equal(t, "hook", registryConfig.ForHost("10.0.0.1:5000").Auth.Username)
+	registryConfig.Registry.Address = ""
+	assert.Empty(t, registryConfig.ForHost("10.0.0.1:5000").Auth)
+
+	registryConfig.Registries = append(registryConfig.Registries, RegistryHost{Host: "harbor.example.com"})
+	assert.ErrorContains(t, registryConfig.Validate(), "duplicate host")
+	registryConfig.Registries = []RegistryHost{{Host: "https://harbor.example.com"}}
+	assert.ErrorContains(t, registryConfig.Validate(), "without scheme")
+	registryConfig.Registries = []RegistryHost{{Host: "harbor.example.com", DockerConfig: "config.json", CredentialHelper: "pass"}}
+	assert.ErrorContains(t, registryConfig.Validate(), "only one of")
+}
+
+// decryptRegistries 解密只包含 registries 的配置, 传给 ExtractFilesFromImage
+func decryptRegistries(t *testing.T, registries ...RegistryHost) *RegistryConfig {
+	registryConfig, err := DecryptRegistryConfig(RegistryConfig{Registries: registries})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return registryConfig
+}
+
+func TestRegistryDockerConfig(t *testing.T) {
+	registry := newFakeRegistry(t)
+	registry.pushImage("latest", buildLayer(t, true, map[string]string{"build.log": "log"}))
+	image := registry.host() + "/build-hook/demo-app:latest"
+	dir := t.TempDir()
+	files := map[string]string{"/build.log": filepath.Join(dir, "build.log")}
+
+	dockerConfig := filepath.Join(dir, "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("hook:secret"))
+	assert.NoError(t, os.WriteFile(dockerConfig, []byte(fmt.Sprintf(`{"auths": {"https://%s/v1/": {"auth": %q}}}`, registry.host(), auth)), 0600))
+	registryConfig := decryptRegistries(t, RegistryHost{Host: registry.host(), Scheme: "http", DockerConfig: dockerConfig})
+	missing, err := ExtractFilesFromImage(registryConfig, image, files)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// 凭据助手, 与 docker 相同从标准输入读取地址
+	helperDir := t.TempDir()
+	helper := fmt.Sprintf("#!/bin/sh\nread host\n[ \"$host\" = %q ] && echo '{\"Username\": \"hook\", \"Secret\": \"secret\"}' && exit 0\necho 'credentials not found in native keychain'\nexit 1\n", registry.host())
+	assert.NoError(t, os.WriteFile(filepath.Join(helperDir, "docker-credential-test"), []byte(helper), 0700))
+	t.Setenv("PATH", helperDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	registryConfig = decryptRegistries(t, RegistryHost{Host: registry.host(), Scheme: "http", CredentialHelper: "test"})
+	missing, err = ExtractFilesFromImage(registryConfig, image, files)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// docker config 中没有该地址时使用 credsStore
+	assert.NoError(t, os.WriteFile(dockerConfig, []byte(`{"auths": {"harbor.example.com": {"auth": "eDp5"}}, "credsStore": "test"}`), 0600))
+	registryConfig = decryptRegistries(t, RegistryHost{Host: registry.host(), Scheme: "http", DockerConfig: dockerConfig})
+	missing, err = ExtractFilesFromImage(registryConfig, image, files)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestRegistryTLS(t *testing.T) {
+	registry := newFakeTLSRegistry(t)
+	registry.pushImage("latest", buildLayer(t, true, map[string]string{"build.log": "log"}))
+	image := registry.host() + "/build-hook/demo-app:latest"
+	files := map[string]string{"/build.log": filepath.Join(t.TempDir(), "build.log")}
+	// 密码与配置文件相同, 使用环境变量引用或密文
+	t.Setenv("TEST_REGISTRY_PASSWORD", "secret")
+	auth := RegistryAuth{Username: "hook", Password: "${TEST_REGISTRY_PASSWORD}"}
+
+	registryConfig := decryptRegistries(t, RegistryHost{Host: registry.host(), Auth: auth})
+	_, err := ExtractFilesFromImage(registryConfig, image, files)
+	assert.ErrorContains(t, err, "certificate")
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+	ca := RegistryHost{Host: registry.host(), Auth: auth}
+	ca.TLS.CAFile = caFile
+	registryConfig = decryptRegistries(t, ca)
+	missing, err := ExtractFilesFromImage(registryConfig, image, files)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	insecure := RegistryHost{Host: registry.host(), Auth: auth}
+	insecure.TLS.InsecureSkipVerify = true
+	registryConfig = decryptRegistries(t, insecure)
+	_, err = ExtractFilesFromImage(registryConfig, image, files)
+	assert.NoError(t, err)
+
+	// CA 证书无法读取时拒绝配置
+	ca.TLS.CAFile = filepath.Join(t.TempDir(), "missing.crt")
+	_, err = DecryptRegistryConfig(RegistryConfig{Registries: []RegistryHost{ca}})
+	assert.ErrorContains(t, err, "tls.ca-file")
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/exyb/harbor-hook-to-mail/leader"
+	"github.com/exyb/harbor-hook-to-mail/routes"
+	. "github.com/exyb/harbor-hook-to-mail/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadConfigTemplate = `
+registry:
+  address: harbor.example.com
+  auth:
+    username: hook
+    password: %[1]s
+email:
+  server: mail.example.com
+  port: 25
+  sender:
+    address: hook@example.com
+    password: %[1]s
+  receiver:
+  - %[2]s
+notify:
+  channels:
+  - name: ci-webhook
+    type: webhook
+    url: https://ci.example.com/hook
+hook:
+  auth:
+    allow-cidrs: [%[3]s]
+  apps:
+  - name: demo-app
+    channels: [%[4]s]
+  audit:
+    inform-time: [%[5]s]
+`
+
+func encryptedPassword(t *testing.T, password string) string {
+	ciphertext, err := EncryptAES([]byte(password))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+func TestReloadConfig(t *testing.T) {
+	// 单副本时重新加载会调度定时检查, 测试结束时停止
+	t.Cleanup(func() { routes.Close() })
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	password := encryptedPassword(t, "secret")
+
+	writeConfig := func(receiver string, cidrs string, channels string, informTime string) {
+		content := fmt.Sprintf(reloadConfigTemplate, password, receiver, cidrs, channels, informTime)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+
+	writeConfig("dev@example.com", "10.0.0.0/8", "email", "09:50")
+	assert.NoError(t, routes.ReloadConfig(path))
+	assert.Equal(t, []string{"dev@example.com"}, handlers.CurrentConfig().Mail.Email.Receiver)
+	assert.Equal(t, "secret", handlers.CurrentConfig().Registry.Registry.Auth.Password)
+	assert.Len(t, handlers.CurrentConfig().Notifiers("demo-app"), 1)
+
+	writeConfig("ops@example.com", "10.0.0.0/8", "email, ci-webhook", "09:50")
+	assert.NoError(t, routes.ReloadConfig(path))
+	assert.Equal(t, []string{"ops@example.com"}, handlers.CurrentConfig().Mail.Email.Receiver)
+	assert.Len(t, handlers.CurrentConfig().Notifiers("demo-app"), 2)
+
+	// 校验失败时保留当前配置
+	for name, invalid := range map[string][]string{
+		"inform-time": {"qa@example.com", "10.0.0.0/8", "email", "25:99"},
+		"allow-cidrs": {"qa@example.com", "not-an-ip", "email", "09:50"},
+		"channel":     {"qa@example.com", "10.0.0.0/8", "unknown-channel", "09:50"},
+	} {
+		writeConfig(invalid[0], invalid[1], invalid[2], invalid[3])
+		assert.Error(t, routes.ReloadConfig(path), name)
+		assert.Equal(t, []string{"ops@example.com"}, handlers.CurrentConfig().Mail.Email.Receiver, name)
+	}
+
+	assert.NoError(t, os.WriteFile(path, []byte("hook: ["), 0600))
+	assert.Error(t, routes.ReloadConfig(path))
+	assert.Len(t, handlers.CurrentConfig().Notifiers("demo-app"), 2)
+}
+
+func TestReloadConfigFollower(t *testing.T) {
+	// 其他副本持有锁, 当前副本是 follower
+	lockPath := filepath.Join(t.TempDir(), "leader.lock")
+	lock := leader.NewFileLock(lockPath)
+	_, err := lock.Acquire(context.Background(), leaderA, time.Minute)
+	assert.NoError(t, err)
+	defer lock.Release(context.Background(), leaderA)
+
+	leaderConfig := fmt.Sprintf("leader:\n  type: file\n  id: %s\n  address: %s\n  retry-period: 20ms\n  file:\n    path: %s\n", leaderB.ID, leaderB.Address, lockPath)
+	newTestRouter(t, leaderConfig)
+	assert.False(t, routes.InformersScheduled())
+
+	// 检查时间和预期构建变化时 follower 也不调度定时检查
+	content := fmt.Sprintf(webhookConfigTemplate, filepath.Join(t.TempDir(), "hook.db")) +
+		"  apps:\n  - name: demo-app\n    expect:\n      weekdays: [mon, tue, wed, thu, fri]\n  audit:\n    inform-time: [\"09:50\"]\n" + leaderConfig
+	assert.NoError(t, routes.ReloadConfig(writeConfigFile(t, content)))
+	assert.False(t, routes.InformersScheduled())
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"testing"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+const routeConfig = `
+email:
+  receiver: [all@example.com]
+  cc: [cc@example.com]
+  routes:
+  - apps: ["demo-*"]
+    outcomes: [failure, warning, missing]
+    receiver: [demo-owner@example.com]
+  - apps: ["demo-app"]
+    outcomes: [failure]
+    receiver: [demo-owner@example.com, lead@example.com]
+    cc: [qa@example.com]
+  - outcomes: [summary]
+    receiver: [release-manager@example.com]
+`
+
+func TestMailRecipients(t *testing.T) {
+	config := &MailConfig{}
+	assert.NoError(t, yaml.Unmarshal([]byte(routeConfig), config))
+
+	to, cc := config.Recipients("demo-app", OutcomeFailure)
+	assert.Equal(t, []string{"demo-owner@example.com", "lead@example.com"}, to)
+	assert.Equal(t, []string{"qa@example.com"}, cc)
+
+	to, cc = config.Recipients("demo-ui", OutcomeMissing)
+	assert.Equal(t, []string{"demo-owner@example.com"}, to)
+	assert.Empty(t, cc)
+
+	to, _ = config.Recipients("demo-ui", OutcomeSummary)
+	assert.Equal(t, []string{"release-manager@example.com"}, to)
+
+	// 没有匹配的规则时使用默认收件人
+	to, cc = config.Recipients("demo-app", OutcomeSuccess)
+	assert.Equal(t, []string{"all@example.com"}, to)
+	assert.Equal(t, []string{"cc@example.com"}, cc)
+	to, _ = config.Recipients("backend", OutcomeFailure)
+	assert.Equal(t, []string{"all@example.com"}, to)
+}
+
+func TestMailRouteValidate(t *testing.T) {
+	assert.NoError(t, (&MailRoute{Apps: []string{"demo-*"}, Outcomes: []string{"Failure"}, Receiver: []string{"a@example.com"}}).Validate())
+	assert.Error(t, (&MailRoute{Apps: []string{"demo-["}, Receiver: []string{"a@example.com"}}).Validate())
+	assert.Error(t, (&MailRoute{Outcomes: []string{"broken"}, Receiver: []string{"a@example.com"}}).Validate())
+	assert.Error(t, (&MailRoute{Apps: []string{"demo-app"}}).Validate())
+}
+
+func TestMailOutcome(t *testing.T) {
+	assert.Equal(t, OutcomeSuccess, handlers.MailOutcome(handlers.MailKindDetail, "SUCCESS"))
+	assert.Equal(t, OutcomeFailure, handlers.MailOutcome(handlers.MailKindDetail, "FAILURE"))
+	assert.Equal(t, OutcomeWarning, handlers.MailOutcome(handlers.MailKindDetail, "UNKNOWN"))
+	assert.Equal(t, OutcomeWarning, handlers.MailOutcome(handlers.MailKindWarn, ""))
+	assert.Equal(t, OutcomeMissing, handlers.MailOutcome(handlers.MailKindFail, ""))
+	assert.Equal(t, OutcomeSummary, handlers.MailOutcome(handlers.MailKindSuccess, ""))
+	assert.Equal(t, OutcomeFailure, handlers.MailOutcome("replication", "FAILURE"))
+	assert.Equal(t, OutcomeFailure, handlers.MailOutcome("scanning_failed", ""))
+}
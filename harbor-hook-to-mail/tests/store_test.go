@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestStore(t *testing.T) *store.Store {
+	s, err := store.Open(filepath.Join(t.TempDir(), "hook.db"), 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreAddAndList(t *testing.T) {
+	s := openTestStore(t)
+	base := time.Date(2024, 6, 30, 12, 0, 0, 0, time.Local)
+
+	for i, status := range []string{store.StatusProcessed, store.StatusFailed, store.StatusDuplicate} {
+		record := &store.BuildRecord{
+			App:        "demo-app",
+			Type:       "PUSH_ARTIFACT",
+			Tag:        "test",
+			Status:     status,
+			ReceivedAt: base.Add(time.Duration(i) * time.Hour),
+		}
+		assert.NoError(t, s.Add(record))
+		assert.Equal(t, uint64(i+1), record.ID)
+	}
+	assert.NoError(t, s.Add(&store.BuildRecord{App: "demo-ui", Status: store.StatusProcessed, ReceivedAt: base}))
+	assert.Error(t, s.Add(&store.BuildRecord{}))
+
+	records, err := s.List("demo-app", base.Add(time.Hour), time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, store.StatusFailed, records[0].Status)
+		assert.Equal(t, store.StatusDuplicate, records[1].Status)
+	}
+
+	records, err = s.List("demo-app", base, base.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	records, err = s.List("unknown", base, time.Time{})
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	apps, err := s.Apps()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"demo-app", "demo-ui"}, apps)
+}
+
+func TestStoreUpdateAndLast(t *testing.T) {
+	s := openTestStore(t)
+
+	first := &store.BuildRecord{App: "demo-app", Status: store.StatusReceived}
+	assert.NoError(t, s.Add(first))
+	second := &store.BuildRecord{App: "demo-app", Status: store.StatusReceived}
+	assert.NoError(t, s.Add(second))
+
+	first.Status, first.Result = store.StatusProcessed, "SUCCESS"
+	assert.NoError(t, s.Update(first))
+
+	last, err := s.Last("demo-app", func(record *store.BuildRecord) bool {
+		return record.Status == store.StatusProcessed
+	})
+	assert.NoError(t, err)
+	if assert.NotNil(t, last) {
+		assert.Equal(t, first.ID, last.ID)
+		assert.Equal(t, "SUCCESS", last.Result)
+	}
+
+	last, err = s.Last("demo-app", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, last.ID)
+
+	records, err := s.List("demo-app", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+}
+
+func TestStorePrune(t *testing.T) {
+	s := openTestStore(t)
+	now := time.Now()
+
+	assert.NoError(t, s.Add(&store.BuildRecord{App: "demo-app", ReceivedAt: now.Add(-48 * time.Hour)}))
+	assert.NoError(t, s.Add(&store.BuildRecord{App: "demo-ui", ReceivedAt: now.Add(-30 * time.Hour)}))
+	assert.NoError(t, s.Add(&store.BuildRecord{App: "demo-app", ReceivedAt: now}))
+
+	deleted, err := s.Prune(now.Add(-24 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	records, err := s.List("demo-app", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestStoreState(t *testing.T) {
+	s := openTestStore(t)
+
+	type once struct {
+		Sign       string
+		CreateTime string
+	}
+	var value once
+	found, err := s.GetState("sign/demo-app", &value)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, s.PutState("sign/demo-app", once{Sign: "abc", CreateTime: "20240630120000"}))
+	found, err = s.GetState("sign/demo-app", &value)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "20240630120000", value.CreateTime)
+}
+
+func TestStoreClosed(t *testing.T) {
+	s := openTestStore(t)
+	record := &store.BuildRecord{App: "demo-app", Status: store.StatusReceived}
+	assert.NoError(t, s.Add(record))
+	assert.NoError(t, s.Close())
+
+	// 失去 leader 后仍在处理的请求得到关闭的错误
+	record.Status = store.StatusProcessed
+	assert.ErrorIs(t, s.Update(record), store.ErrClosed)
+	_, err := s.List("demo-app", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, store.ErrClosed)
+	_, err = s.CountJobs()
+	assert.ErrorIs(t, err, store.ErrClosed)
+}
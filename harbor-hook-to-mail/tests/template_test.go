@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/handlers"
+	"github.com/stretchr/testify/assert"
+)
+
+var templateTestTime = time.Date(2024, 5, 26, 17, 10, 0, 0, time.Local)
+
+func TestRenderBuiltinTemplates(t *testing.T) {
+	data := &handlers.MailData{App: "demo-app", Tag: "p0_20240526171000", Result: "FAILURE", Time: templateTestTime, Body: template.HTML("<p>构建结果: FAILURE</p>")}
+	msg, err := handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "构建详情通知 - 2024-05-26: 应用 demo-app 构建失败", msg.Title)
+	assert.Equal(t, "<p>构建结果: FAILURE</p>", msg.Body)
+	assert.Contains(t, msg.Summary, "- 构建结果: 失败")
+
+	data = &handlers.MailData{App: "demo-app", Calls: 3, Errors: 1, Time: templateTestTime}
+	msg, err = handlers.RenderMailWith(handlers.MailKindWarn, data, "html", handlers.TemplateOptions{Lang: "en"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Build warning - 2024-05-26: demo-app built with errors", msg.Title)
+	assert.Equal(t, "<p>demo-app received 3 build notifications today, 1 of them failed to process.</p>", msg.Body)
+}
+
+func TestRenderLegacySubject(t *testing.T) {
+	data := &handlers.MailData{App: "demo-app", Result: "SUCCESS", Time: templateTestTime}
+
+	msg, err := handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{Subject: "Jenkins detail inform for %s on %s: %s"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Jenkins detail inform for demo-app on 2024-05-26: 成功", msg.Title)
+
+	msg, err = handlers.RenderMailWith(handlers.MailKindDetail, data, "html", handlers.TemplateOptions{Lang: "en", Subject: "[{{ .App }}] {{ template \"result\" .Result }}"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[demo-app] succeeded", msg.Title)
+}
+
+func TestRenderTemplateOverrides(t *testing.T) {
+	globalDir, appDir := t.TempDir(), t.TempDir()
+	writeTemplate(t, filepath.Join(globalDir, "zh", "fail.tmpl"), `{{ define "subject" }}全局 {{ .App }}{{ end }}{{ define "body" }}<b>{{ .App }}</b>{{ end }}`)
+	writeTemplate(t, filepath.Join(appDir, "zh", "fail.tmpl"), `{{ define "subject" }}应用 {{ .App }}{{ end }}{{ define "body" }}{{ .Body }}{{ end }}`)
+
+	data := &handlers.MailData{App: "<demo>", Body: "<i>x</i>", Time: templateTestTime}
+	msg, err := handlers.RenderMailWith(handlers.MailKindFail, data, "html", handlers.TemplateOptions{Dir: globalDir})
+	assert.NoError(t, err)
+	assert.Equal(t, "全局 <demo>", msg.Title)
+	assert.Equal(t, "<b>&lt;demo&gt;</b>", msg.Body)
+	assert.Empty(t, msg.Summary)
+
+	msg, err = handlers.RenderMailWith(handlers.MailKindFail, data, "text", handlers.TemplateOptions{Dir: globalDir, AppDir: appDir})
+	assert.NoError(t, err)
+	assert.Equal(t, "应用 <demo>", msg.Title)
+	assert.Equal(t, "<i>x</i>", msg.Body)
+	assert.Equal(t, "text", msg.BodyType)
+
+	// 目录中没有的模板使用内置模板
+	msg, err = handlers.RenderMailWith(handlers.MailKindSuccess, data, "html", handlers.TemplateOptions{Dir: globalDir})
+	assert.NoError(t, err)
+	assert.Equal(t, "构建定时通知 - 2024-05-26: 应用 <demo> 成功完成构建", msg.Title)
+}
+
+func TestRenderEventTemplates(t *testing.T) {
+	report := &handlers.ScanReport{Severity: "High", Summary: &handlers.ScanSummary{Total: 4, Fixable: 3}}
+	data := &handlers.MailData{App: "demo-app", Tag: "v1", Scan: report, Severities: []handlers.SeverityCount{{Severity: "High", Count: 1}, {Severity: "Medium", Count: 3}}, Time: templateTestTime}
+	for _, lang := range []string{"zh", "en"} {
+		msg, err := handlers.RenderMailWith("scanning_completed", data, "html", handlers.TemplateOptions{Lang: lang})
+		assert.NoError(t, err)
+		assert.Contains(t, msg.Title, "demo-app:v1")
+		assert.Contains(t, msg.Summary, "- Medium: 3")
+	}
+
+	replication := &handlers.Replication{JobStatus: "Failed", FailedArtifact: []handlers.ReplicationArtifact{{Type: "image", Status: "Failed", NameTag: "demo-app [1 item(s) in total]"}}}
+	data = &handlers.MailData{App: "demo-app", Result: "FAILURE", Replication: replication, Artifacts: replication.FailedArtifact, Time: templateTestTime}
+	msg, err := handlers.RenderMailWith("replication", data, "html", handlers.TemplateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "镜像复制失败 - demo-app", msg.Title)
+	assert.Contains(t, msg.Body, "demo-app [1 item(s) in total]")
+}
+
+func writeTemplate(t *testing.T, path string, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
@@ -3,58 +3,73 @@ package tests
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/exyb/harbor-hook-to-mail/config"
 	"github.com/exyb/harbor-hook-to-mail/routes"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
+const webhookConfigTemplate = `
+email:
+  server: smtp.example.com
+  port: 25
+  receiver: [dev@example.com]
+store:
+  path: %s
+hook:
+  context-path: /hook/app
+`
+
+// newTestRouter 使用 webhookConfigTemplate 加上 extra 配置启动路由, 测试结束时关闭存储
+func newTestRouter(t *testing.T, extra string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	content := fmt.Sprintf(webhookConfigTemplate, filepath.Join(t.TempDir(), "hook.db")) + extra
+	cfg, err := config.Load(writeConfigFile(t, content))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	r := gin.New()
+	routes.SetupRouter(r, cfg)
+	t.Cleanup(func() { routes.Close() })
+	return r
+}
+
 func TestWebhookHandler(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := fmt.Sprintf(webhookConfigTemplate, filepath.Join(t.TempDir(), "hook.db"))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	cfg, err := config.Load(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
 	r := gin.Default()
-	routes.SetupRouter(r)
+	routes.SetupRouter(r, cfg)
+	t.Cleanup(func() { routes.Close() })
 
 	testRequest := routes.WebhookRequest{
 		Type:     "PUSH_ARTIFACT",
 		OccurAt:  1716714783,
 		Operator: "admin",
-		EventData: struct {
-			Resources []struct {
-				Digest      string "json:\"digest\""
-				Tag         string "json:\"tag\""
-				ResourceURL string "json:\"resource_url\""
-			} "json:\"resources\""
-			Repository struct {
-				DateCreated  int64  "json:\"date_created\""
-				Name         string "json:\"name\""
-				Namespace    string "json:\"namespace\""
-				RepoFullName string "json:\"repo_full_name\""
-				RepoType     string "json:\"repo_type\""
-			} "json:\"repository\""
-		}{
-			Resources: []struct {
-				Digest      string "json:\"digest\""
-				Tag         string "json:\"tag\""
-				ResourceURL string "json:\"resource_url\""
-			}{
+		EventData: routes.WebhookEventData{
+			Resources: []routes.WebhookResource{
 				{
 					Digest:      "sha256:551816281922709f43d1d1ce3e10b8e60d07ad1ad4750454b2aae97b97ac2f86",
 					Tag:         "test_20240526171000",
 					ResourceURL: "harbor.example.com/build-hook/test-app:p0_20240526171000",
 				},
 			},
-			Repository: struct {
-				DateCreated  int64  "json:\"date_created\""
-				Name         string "json:\"name\""
-				Namespace    string "json:\"namespace\""
-				RepoFullName string "json:\"repo_full_name\""
-				RepoType     string "json:\"repo_type\""
-			}{
+			Repository: routes.WebhookRepository{
 				DateCreated:  1716714783,
 				Name:         "test-app",
 				Namespace:    "build-hook",
@@ -72,6 +87,6 @@ func TestWebhookHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusOK, w.Code)
-	assert.JSONEq(t, `{"status": "success"}`, w.Body.String())
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.JSONEq(t, `{"status": "queued"}`, w.Body.String())
 }
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/exyb/harbor-hook-to-mail/workdir"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeEventFile 在事件目录中写入 size 字节的文件, 并把修改时间设置为 modTime
+func writeEventFile(t *testing.T, dir string, size int, modTime time.Time) string {
+	file := filepath.Join(dir, "v1.build.log")
+	assert.NoError(t, os.WriteFile(file, make([]byte, size), 0600))
+	assert.NoError(t, os.Chtimes(file, modTime, modTime))
+	assert.NoError(t, os.Chtimes(dir, modTime, modTime))
+	return file
+}
+
+func TestWorkDirSanitize(t *testing.T) {
+	assert.Equal(t, "build-hook", workdir.Sanitize("build-hook"))
+	assert.Equal(t, "test_20240630120000", workdir.Sanitize("test_20240630120000"))
+	assert.Equal(t, "_", workdir.Sanitize(".."))
+	assert.Equal(t, "_", workdir.Sanitize(""))
+	assert.Equal(t, "_.._etc", workdir.Sanitize("/../etc"))
+	assert.Equal(t, "team-a_backend", workdir.Sanitize("team-a/backend"))
+	assert.LessOrEqual(t, len(workdir.Sanitize(strings.Repeat("a", 300))), 100)
+}
+
+func TestWorkDirEventDir(t *testing.T) {
+	w, err := workdir.New(t.TempDir(), workdir.Options{})
+	assert.NoError(t, err)
+
+	dir, err := w.EventDir("../..", "demo-app", "../../etc/passwd", 7)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(w.Root(), "_..", "demo-app", "_.._etc_passwd-7"), dir)
+	info, err := os.Stat(dir)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	// replay 没有记录 id, 每次使用新的目录
+	first, err := w.EventDir("build-hook", "demo-app", "v1", 0)
+	assert.NoError(t, err)
+	second, err := w.EventDir("build-hook", "demo-app", "v1", 0)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestWorkDirCleanupRetention(t *testing.T) {
+	w, err := workdir.New(t.TempDir(), workdir.Options{Retention: 72 * time.Hour})
+	assert.NoError(t, err)
+	now := time.Now()
+
+	old, _ := w.EventDir("build-hook", "demo-app", "v1", 1)
+	writeEventFile(t, old, 10, now.Add(-96*time.Hour))
+	recent, _ := w.EventDir("build-hook", "demo-other", "v2", 2)
+	writeEventFile(t, recent, 10, now.Add(-time.Hour))
+
+	removed, freed, err := w.Cleanup(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(10), freed)
+	assert.NoDirExists(t, old)
+	// 空的应用目录一起删除
+	assert.NoDirExists(t, filepath.Dir(old))
+	assert.DirExists(t, recent)
+}
+
+func TestWorkDirCleanupMaxSize(t *testing.T) {
+	w, err := workdir.New(t.TempDir(), workdir.Options{MaxSize: 250, MinAge: time.Hour})
+	assert.NoError(t, err)
+	now := time.Now()
+
+	oldest, _ := w.EventDir("build-hook", "demo-app", "v1", 1)
+	writeEventFile(t, oldest, 100, now.Add(-5*time.Hour))
+	older, _ := w.EventDir("build-hook", "demo-app", "v2", 2)
+	writeEventFile(t, older, 100, now.Add(-4*time.Hour))
+	newer, _ := w.EventDir("build-hook", "demo-app", "v3", 3)
+	writeEventFile(t, newer, 100, now.Add(-3*time.Hour))
+	// 可能还在处理的目录不清理
+	processing, _ := w.EventDir("build-hook", "demo-app", "v4", 4)
+	writeEventFile(t, processing, 100, now)
+
+	removed, freed, err := w.Cleanup(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, int64(200), freed)
+	assert.NoDirExists(t, oldest)
+	assert.NoDirExists(t, older)
+	assert.DirExists(t, newer)
+	assert.DirExists(t, processing)
+}
+
+func TestWorkDirCleanupInUse(t *testing.T) {
+	w, err := workdir.New(t.TempDir(), workdir.Options{Retention: time.Hour})
+	assert.NoError(t, err)
+	now := time.Now()
+
+	pending, _ := w.EventDir("build-hook", "demo-app", "v1", 1)
+	attachment := writeEventFile(t, pending, 10, now.Add(-2*time.Hour))
+	sent, _ := w.EventDir("build-hook", "demo-app", "v2", 2)
+	writeEventFile(t, sent, 10, now.Add(-2*time.Hour))
+
+	w.InUse = func() ([]string, error) {
+		return []string{attachment}, nil
+	}
+	removed, _, err := w.Cleanup(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.DirExists(t, pending)
+	assert.NoDirExists(t, sent)
+
+	// 无法确定哪些文件在使用时跳过清理
+	w.InUse = func() ([]string, error) {
+		return nil, os.ErrPermission
+	}
+	removed, _, err = w.Cleanup(now)
+	assert.Error(t, err)
+	assert.Equal(t, 0, removed)
+	assert.DirExists(t, pending)
+}
@@ -1,21 +1,161 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
 )
 
-// AES encryption key (hardcoded for simplicity, but consider using a secure key storage)
-const aesKey = "YrfLwOq7WiWVum3E"
+const (
+	// 密钥, 优先于密钥文件
+	EnvAESKey = "HOOK_AES_KEY"
+	// 密钥文件, 每行一个密钥, 第一个用于加密, 其余只用于解密轮换前的密文
+	EnvAESKeyFile = "HOOK_AES_KEY_FILE"
+	// 没有设置 HOOK_AES_KEY_FILE 时使用的密钥文件, 对应 k8s Secret 的挂载路径
+	DefaultAESKeyFile = "/etc/harbor-hook/aes.key"
 
-func EncryptAES(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher([]byte(aesKey))
+	// 密文格式 enc:v2:<密钥 ID>:<base64(nonce + 密文)>
+	secretPrefixV2 = "enc:v2:"
+	// base64 编码的密钥前缀, 否则按原始字符串使用
+	keyPrefixBase64 = "base64:"
+)
+
+// v1 密文 (没有前缀的 base64) 使用的内置密钥, 只用于兼容旧配置, 应尽快重新加密为 v2
+const legacyAESKey = "YrfLwOq7WiWVum3E"
+
+// ${ENV} 引用环境变量
+var envReference = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// KeyRing 加密密钥, 密文中记录密钥 ID, 轮换密钥后旧密钥仍可解密
+type KeyRing struct {
+	// 用于加密的密钥 ID, 没有配置密钥时为空
+	Primary string
+	keys    map[string][]byte
+}
+
+var (
+	keyRingMutex sync.RWMutex
+	keyRing      *KeyRing
+)
+
+// KeyID 密钥的 ID, 为密钥 sha256 的前 4 字节
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// ParseAESKey 解析密钥, base64: 前缀的按 base64 解码, 长度必须为 16, 24 或 32 字节
+func ParseAESKey(value string) ([]byte, error) {
+	key := []byte(value)
+	if strings.HasPrefix(value, keyPrefixBase64) {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, keyPrefixBase64))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 AES key: %w", err)
+		}
+		key = decoded
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid AES key length %d, expect 16, 24 or 32 bytes", len(key))
+	}
+}
+
+func (ring *KeyRing) add(value string) error {
+	key, err := ParseAESKey(value)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	id := KeyID(key)
+	if ring.Primary == "" {
+		ring.Primary = id
+	}
+	ring.keys[id] = key
+	return nil
+}
+
+// LoadKeyRing 从 HOOK_AES_KEY 和密钥文件加载密钥, 都没有配置时返回空的 KeyRing, 只能解密 v1 密文
+func LoadKeyRing() (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string][]byte)}
+	if value := strings.TrimSpace(os.Getenv(EnvAESKey)); value != "" {
+		if err := ring.add(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvAESKey, err)
+		}
+	}
+
+	path := os.Getenv(EnvAESKeyFile)
+	if path == "" {
+		path = DefaultAESKeyFile
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return ring, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AES key file: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		value := strings.TrimSpace(scanner.Text())
+		if value == "" || strings.HasPrefix(value, "#") {
+			continue
+		}
+		if err := ring.add(value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return ring, nil
+}
+
+// GetKeyRing 当前使用的密钥, 第一次调用时加载
+func GetKeyRing() (*KeyRing, error) {
+	keyRingMutex.RLock()
+	current := keyRing
+	keyRingMutex.RUnlock()
+	if current != nil {
+		return current, nil
 	}
 
+	keyRingMutex.Lock()
+	defer keyRingMutex.Unlock()
+	if keyRing == nil {
+		ring, err := LoadKeyRing()
+		if err != nil {
+			return nil, err
+		}
+		keyRing = ring
+	}
+	return keyRing, nil
+}
+
+// SetKeyRing 替换密钥, 用于配置热加载时重新读取挂载的密钥文件, nil 表示下次使用时重新加载
+func SetKeyRing(ring *KeyRing) {
+	keyRingMutex.Lock()
+	defer keyRingMutex.Unlock()
+	keyRing = ring
+}
+
+func sealAESGCM(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
@@ -25,25 +165,195 @@ func EncryptAES(plaintext []byte) ([]byte, error) {
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
 }
 
-func DecryptAES(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher([]byte(aesKey))
+func openAESGCM(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
 	}
 
 	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
 
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+// EncryptAES 使用内置密钥加密, 生成 v1 密文
+//
+// Deprecated: 内置密钥随代码公开, 使用 EncryptSecret
+func EncryptAES(plaintext []byte) ([]byte, error) {
+	return sealAESGCM([]byte(legacyAESKey), plaintext)
+}
+
+// DecryptAES 使用内置密钥解密 v1 密文
+func DecryptAES(ciphertext []byte) ([]byte, error) {
+	return openAESGCM([]byte(legacyAESKey), ciphertext)
+}
+
+// EncryptSecret 使用当前密钥加密, 返回 enc:v2: 格式的密文
+func (ring *KeyRing) EncryptSecret(plaintext string) (string, error) {
+	if ring.Primary == "" {
+		return "", fmt.Errorf("no AES key configured, set %s or %s", EnvAESKey, EnvAESKeyFile)
+	}
+	ciphertext, err := sealAESGCM(ring.keys[ring.Primary], []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return secretPrefixV2 + ring.Primary + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptV2 解密 enc:v2: 格式的密文, 返回使用的密钥 ID
+func (ring *KeyRing) decryptV2(value string) (string, string, error) {
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, secretPrefixV2), ":")
+	if !ok {
+		return "", "", errors.New("invalid enc:v2 ciphertext, expect enc:v2:<key id>:<base64>")
+	}
+	key, ok := ring.keys[id]
+	if !ok {
+		return "", id, fmt.Errorf("AES key %s not found, set %s or %s", id, EnvAESKey, EnvAESKeyFile)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", id, fmt.Errorf("invalid enc:v2 ciphertext: %w", err)
+	}
+	plaintext, err := openAESGCM(key, ciphertext)
+	if err != nil {
+		return "", id, fmt.Errorf("failed to decrypt with AES key %s: %w", id, err)
+	}
+	return string(plaintext), id, nil
+}
+
+func decryptLegacy(value string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode from base64: %w", err)
+	}
+	plaintext, err := DecryptAES(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// resolveEnv 展开 ${ENV} 引用, 不是引用时 ok 为 false
+func resolveEnv(value string) (string, bool, error) {
+	match := envReference.FindStringSubmatch(value)
+	if match == nil {
+		return "", false, nil
+	}
+	resolved, ok := os.LookupEnv(match[1])
+	if !ok {
+		return "", true, fmt.Errorf("environment variable %s is not set", match[1])
+	}
+	return resolved, true, nil
+}
+
+// ResolveSecret 展开 ${ENV} 引用, 解密 enc:v2: 密文, 其他值原样返回, 用于原本就是明文的配置
+func ResolveSecret(value string) (string, error) {
+	if resolved, ok, err := resolveEnv(value); ok {
+		return resolved, err
+	}
+	if !strings.HasPrefix(value, secretPrefixV2) {
+		return value, nil
+	}
+	ring, err := GetKeyRing()
+	if err != nil {
+		return "", err
+	}
+	plaintext, _, err := ring.decryptV2(value)
 	return plaintext, err
 }
+
+// DecryptPassword 解析密码配置: ${ENV} 引用, enc:v2: 密文或者 v1 密文, 空值返回空
+func DecryptPassword(value string) (string, error) {
+	if value == "" || envReference.MatchString(value) || strings.HasPrefix(value, secretPrefixV2) {
+		return ResolveSecret(value)
+	}
+	plaintext, err := decryptLegacy(value)
+	if err != nil {
+		return "", err
+	}
+	log.Print("[ Cipher ] Found v1 ciphertext encrypted with the built-in key, re-encrypt it to enc:v2")
+	return plaintext, nil
+}
+
+// ReencryptConfig 使用当前密钥重新加密配置中 password 的 v1 密文和其他密钥加密的 enc:v2: 密文,
+// ${ENV} 引用和明文不变, 返回修改后的配置和重新加密的数量
+func (ring *KeyRing) ReencryptConfig(data []byte) ([]byte, int, error) {
+	if ring.Primary == "" {
+		return nil, 0, fmt.Errorf("no AES key configured, set %s or %s", EnvAESKey, EnvAESKeyFile)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, 0, err
+	}
+
+	count := 0
+	var walk func(node *yaml.Node) error
+	walk = func(node *yaml.Node) error {
+		for i, child := range node.Content {
+			if child.Kind != yaml.ScalarNode {
+				if err := walk(child); err != nil {
+					return err
+				}
+				continue
+			}
+			// 只处理 mapping 的值
+			if node.Kind != yaml.MappingNode || i%2 == 0 {
+				continue
+			}
+			var plaintext string
+			switch {
+			case strings.HasPrefix(child.Value, secretPrefixV2):
+				decrypted, id, err := ring.decryptV2(child.Value)
+				if err != nil {
+					return fmt.Errorf("line %d: %w", child.Line, err)
+				}
+				if id == ring.Primary {
+					continue
+				}
+				plaintext = decrypted
+			case node.Content[i-1].Value == "password" && child.Value != "" && !envReference.MatchString(child.Value):
+				decrypted, err := decryptLegacy(child.Value)
+				if err != nil {
+					return fmt.Errorf("line %d: %w", child.Line, err)
+				}
+				plaintext = decrypted
+			default:
+				continue
+			}
+			encrypted, err := ring.EncryptSecret(plaintext)
+			if err != nil {
+				return err
+			}
+			child.Value, child.Style = encrypted, 0
+			count++
+		}
+		return nil
+	}
+	if err := walk(&root); err != nil {
+		return nil, 0, err
+	}
+	if count == 0 {
+		return data, 0, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, 0, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), count, nil
+}
@@ -2,68 +2,157 @@ package utils
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jordan-wright/email"
 )
 
+// 传输方式
+const (
+	// 服务器支持 STARTTLS 时升级为 TLS, 否则使用明文, 与 smtp.SendMail 一致
+	TransportSMTP = "smtp"
+	// 明文 SMTP, 服务器支持时也不升级为 TLS
+	TransportPlain = "plain"
+	// 明文连接后通过 STARTTLS 升级, 服务器不支持时发送失败
+	TransportSTARTTLS = "starttls"
+	// 连接时直接使用 TLS (465 端口)
+	TransportSMTPS = "smtps"
+)
+
+// 认证方式
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	// 不认证, 用于内网中继
+	AuthNone = "none"
+)
+
+const (
+	// 每条 SMTP 命令的默认超时时间
+	defaultSMTPTimeout = 30 * time.Second
+	// 发送邮件内容时按最低 32KB/s 延长超时, 大附件不会因为固定的超时时间失败
+	smtpMinDataRate = 32 << 10
+)
+
+// SMTPOptions 邮件服务器的连接选项, 零值为服务器支持时 STARTTLS, PLAIN 认证, 每封邮件使用新连接
+type SMTPOptions struct {
+	Transport string
+	Auth      string
+	// 发件人显示名称
+	Name string
+	// 额外信任的 CA 证书 (PEM), 用于自签名证书的邮件服务器
+	CAFile             string
+	InsecureSkipVerify bool
+	// 连接空闲多久后关闭, 期间的邮件复用同一个连接, 0 表示每封邮件使用新连接
+	KeepAlive time.Duration
+	// 连接和每条命令的超时时间, 0 表示 30s
+	Timeout time.Duration
+}
+
+// EmailSender 每次调用只发送一次, 失败时由 outbox 按退避时间重试
 type EmailSender struct {
 	Host     string
 	Port     int
 	Username string
 	Password string
+
+	options   SMTPOptions
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	client *smtp.Client
+	conn   net.Conn
+	idle   *time.Timer
 }
 
 func NewEmailSender(host string, port int, username, password string) *EmailSender {
-	return &EmailSender{
-		Host:     host,
-		Port:     port,
-		Username: username,
-		Password: password,
-	}
+	sender, _ := NewEmailSenderWithOptions(host, port, username, password, SMTPOptions{})
+	return sender
 }
 
-func retry(attempts int, sleep time.Duration, fn func() error) error {
-	var err error
-	for i := 0; i < attempts; i++ {
-		err = fn()
-		if err == nil {
-			return nil
+// NewEmailSenderWithOptions 检查传输和认证方式, 加载 CA 证书
+func NewEmailSenderWithOptions(host string, port int, username, password string, options SMTPOptions) (*EmailSender, error) {
+	options.Transport = strings.ToLower(options.Transport)
+	switch options.Transport {
+	case "":
+		options.Transport = TransportSMTP
+	case TransportSMTP, TransportPlain, TransportSTARTTLS, TransportSMTPS:
+	default:
+		return nil, fmt.Errorf("email.type: unsupported transport %q, expect %s, %s, %s or %s", options.Transport, TransportSMTP, TransportPlain, TransportSTARTTLS, TransportSMTPS)
+	}
+	options.Auth = strings.ToLower(options.Auth)
+	switch options.Auth {
+	case "":
+		options.Auth = AuthPlain
+	case AuthPlain, AuthLogin, AuthCRAMMD5, AuthNone:
+	default:
+		return nil, fmt.Errorf("email.auth: unsupported mechanism %q, expect %s, %s, %s or %s", options.Auth, AuthPlain, AuthLogin, AuthCRAMMD5, AuthNone)
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = defaultSMTPTimeout
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("email.tls.ca-file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
 		}
-		fmt.Printf("Attempt %d failed: %v\n", i+1, err)
-		if i < attempts-1 {
-			time.Sleep(sleep)
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("email.tls.ca-file: no certificate found in %s", options.CAFile)
 		}
+		tlsConfig.RootCAs = pool
 	}
-	return fmt.Errorf("after %d attempts, last error: %w", attempts, err)
+
+	return &EmailSender{
+		Host:      host,
+		Port:      port,
+		Username:  username,
+		Password:  password,
+		options:   options,
+		tlsConfig: tlsConfig,
+	}, nil
 }
 
-func (sender *EmailSender) SendEmail(to []string, subject, text string) error {
+func (sender *EmailSender) newEmail() *email.Email {
 	e := email.NewEmail()
-	// e.From = fmt.Sprintf("%s <%s>", sender.Username, sender.Username)
-	e.From = sender.Username
+	e.From = (&mail.Address{Name: sender.options.Name, Address: sender.Username}).String()
+	if sender.options.Name == "" {
+		e.From = sender.Username
+	}
+	return e
+}
+
+func (sender *EmailSender) SendEmail(to []string, subject, text string) error {
+	e := sender.newEmail()
 	e.To = to
 	e.Subject = subject
 	e.Text = []byte(text)
 
-	addr := fmt.Sprintf("%s:%d", sender.Host, sender.Port)
-	auth := smtp.PlainAuth("", sender.Username, sender.Password, sender.Host)
-
-	sendFunc := func() error {
-		fmt.Println("Calling sendFunc for SendEmail")
-		return e.Send(addr, auth)
-	}
-
-	return retry(3, 2*time.Second, sendFunc)
+	return sender.send(e)
 }
 
 func (sender *EmailSender) SendEmailWithAttachment(subject string, to []string, cc []string, mailBody string, mailBodyType string, attachments []string) error {
-	e := email.NewEmail()
-	// e.From = fmt.Sprintf("%s <%s>", sender.Username, sender.Username)
-	e.From = sender.Username
+	e := sender.newEmail()
 	e.Subject = subject
 	e.To = to
 	e.Cc = cc
@@ -81,36 +170,237 @@ func (sender *EmailSender) SendEmailWithAttachment(subject string, to []string,
 		}
 	}
 
-	addr := fmt.Sprintf("%s:%d", sender.Host, sender.Port)
-	auth := smtp.PlainAuth("", sender.Username, sender.Password, sender.Host)
+	return sender.send(e)
+}
+
+// Close 关闭复用的连接
+func (sender *EmailSender) Close() error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return sender.closeLocked(true)
+}
 
-	sendFunc := func() error {
-		fmt.Println("Calling sendFunc for SendEmailWithAttachment")
-		return e.Send(addr, auth)
+// send 发送邮件, 复用的连接已被服务器关闭时重新连接一次
+func (sender *EmailSender) send(e *email.Email) error {
+	msg, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	recipients := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	for _, address := range append(append(append([]string{}, e.To...), e.Cc...), e.Bcc...) {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", address, err)
+		}
+		recipients = append(recipients, parsed.Address)
+	}
+	if len(recipients) == 0 {
+		return errors.New("no recipient")
+	}
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	reused := sender.client != nil
+	err = sender.sendLocked(msg, recipients)
+	if err != nil && reused {
+		sender.closeLocked(false)
+		err = sender.sendLocked(msg, recipients)
+	}
+	if err != nil {
+		sender.closeLocked(false)
+		return err
 	}
 
-	return retry(3, 2*time.Second, sendFunc)
+	if sender.options.KeepAlive <= 0 {
+		return sender.closeLocked(true)
+	}
+	if sender.idle != nil {
+		sender.idle.Stop()
+	}
+	client := sender.client
+	sender.idle = time.AfterFunc(sender.options.KeepAlive, func() {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		if sender.client == client {
+			sender.closeLocked(true)
+		}
+	})
+	return nil
 }
 
-func (sender *EmailSender) SendEmailTLS(to []string, subject, text string) error {
-	e := email.NewEmail()
-	// e.From = fmt.Sprintf("%s <%s>", sender.Username, sender.Username)
-	e.From = sender.Username
-	e.To = to
-	e.Subject = subject
-	e.Text = []byte(text)
+func (sender *EmailSender) sendLocked(msg []byte, recipients []string) error {
+	if sender.client == nil {
+		if err := sender.dialLocked(); err != nil {
+			return err
+		}
+	} else {
+		sender.deadline(0)
+		if err := sender.client.Reset(); err != nil {
+			return err
+		}
+	}
+
+	client := sender.client
+	sender.deadline(0)
+	if err := client.Mail(sender.Username); err != nil {
+		return err
+	}
+	for _, address := range recipients {
+		sender.deadline(0)
+		if err := client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	sender.deadline(0)
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	// 邮件内容和服务器的确认按大小延长超时
+	sender.deadline(time.Duration(len(msg)) * time.Second / smtpMinDataRate)
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
 
-	addr := fmt.Sprintf("%s:%d", sender.Host, sender.Port)
+func (sender *EmailSender) dialLocked() error {
+	addr := net.JoinHostPort(sender.Host, strconv.Itoa(sender.Port))
+	dialer := &net.Dialer{Timeout: sender.options.Timeout}
+	var conn net.Conn
+	var err error
+	if sender.options.Transport == TransportSMTPS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, sender.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	sender.conn = conn
+	sender.deadline(0)
 
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         sender.Host,
+	client, err := smtp.NewClient(conn, sender.Host)
+	if err != nil {
+		conn.Close()
+		sender.conn = nil
+		return err
+	}
+	if err := sender.handshake(client); err != nil {
+		client.Close()
+		sender.conn = nil
+		return err
 	}
+	sender.client = client
+	return nil
+}
 
-	sendFunc := func() error {
-		fmt.Println("Calling sendFunc for SendEmailTLS")
-		return e.SendWithTLS(addr, smtp.PlainAuth("", sender.Username, sender.Password, sender.Host), tlsConfig)
+// deadline 设置下一条命令的超时时间, extra 为发送邮件内容需要的额外时间
+func (sender *EmailSender) deadline(extra time.Duration) {
+	sender.conn.SetDeadline(time.Now().Add(sender.options.Timeout + extra))
+}
+
+// handshake 按传输方式升级 TLS 后认证, 配置了密码但服务器不支持 AUTH 时返回错误
+func (sender *EmailSender) handshake(client *smtp.Client) error {
+	sender.deadline(0)
+	if err := client.Hello("localhost"); err != nil {
+		return err
 	}
+	switch sender.options.Transport {
+	case TransportSMTP:
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			sender.deadline(0)
+			if err := client.StartTLS(sender.tlsConfig); err != nil {
+				return err
+			}
+		}
+	case TransportSTARTTLS:
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", sender.Host)
+		}
+		sender.deadline(0)
+		if err := client.StartTLS(sender.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if sender.options.Auth == AuthNone {
+		return nil
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		if sender.Password != "" {
+			return fmt.Errorf("%s does not support AUTH, set email.auth to none to send without authentication", sender.Host)
+		}
+		return nil
+	}
+	var auth smtp.Auth
+	switch sender.options.Auth {
+	case AuthLogin:
+		auth = &loginAuth{username: sender.Username, password: sender.Password, host: sender.Host}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(sender.Username, sender.Password)
+	default:
+		auth = smtp.PlainAuth("", sender.Username, sender.Password, sender.Host)
+	}
+	sender.deadline(0)
+	if err := client.Auth(auth); err != nil {
+		return fmt.Errorf("smtp auth %s: %w", sender.options.Auth, err)
+	}
+	return nil
+}
+
+// closeLocked 关闭连接, quit 为 true 时先发送 QUIT
+func (sender *EmailSender) closeLocked(quit bool) error {
+	if sender.idle != nil {
+		sender.idle.Stop()
+		sender.idle = nil
+	}
+	if sender.client == nil {
+		return nil
+	}
+	client, conn := sender.client, sender.conn
+	sender.client, sender.conn = nil, nil
+	if quit {
+		conn.SetDeadline(time.Now().Add(sender.options.Timeout))
+		if err := client.Quit(); err == nil {
+			return nil
+		}
+	}
+	return client.Close()
+}
+
+// loginAuth LOGIN 认证, net/smtp 没有提供, 与 PlainAuth 一样只在 TLS 或本机连接时发送密码
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
 
-	return retry(3, 2*time.Second, sendFunc)
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
 }
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+)
+
+// NewRegistryClientFor 使用 registry 配置的凭据, CA 证书和 insecure-skip-verify 创建客户端.
+// docker-config 和 credential-helper 每次重新读取, 兼容会过期的凭据
+func NewRegistryClientFor(ctx context.Context, registry RegistryHost) (*RegistryClient, error) {
+	username, password, err := registryCredentials(ctx, registry)
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", registry.Host, err)
+	}
+	client := NewRegistryClient(registry.Scheme, username, password)
+	tlsConfig, err := registryTLSConfig(registry)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Client.Transport = transport
+	}
+	return client, nil
+}
+
+// registryTLSConfig 没有配置 CA 证书和 insecure-skip-verify 时返回 nil, 使用默认的 transport
+func registryTLSConfig(registry RegistryHost) (*tls.Config, error) {
+	if registry.TLS.CAFile == "" && !registry.TLS.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: registry.TLS.InsecureSkipVerify}
+	if registry.TLS.CAFile != "" {
+		pem, err := os.ReadFile(registry.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s tls.ca-file: %w", registry.Host, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("registry %s tls.ca-file: no certificate found in %s", registry.Host, registry.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// registryCredentials 按配置读取账号密码, 都没有配置时匿名访问
+func registryCredentials(ctx context.Context, registry RegistryHost) (string, string, error) {
+	switch {
+	case registry.CredentialHelper != "":
+		return credentialHelperGet(ctx, registry.CredentialHelper, registry.Host)
+	case registry.DockerConfig != "":
+		return dockerConfigCredentials(ctx, registry.DockerConfig, registry.Host)
+	default:
+		return registry.Auth.Username, registry.Auth.Password, nil
+	}
+}
+
+// dockerConfigFile docker login 生成的 config.json
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// dockerConfigCredentials 与 docker 相同, 先查找 auths, 再使用 credHelpers 或 credsStore 中的凭据助手
+func dockerConfigCredentials(ctx context.Context, path string, host string) (string, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read docker config: %w", err)
+	}
+	var dockerConfig dockerConfigFile
+	if err := json.Unmarshal(data, &dockerConfig); err != nil {
+		return "", "", fmt.Errorf("invalid docker config %s: %w", path, err)
+	}
+
+	for server, entry := range dockerConfig.Auths {
+		if !strings.EqualFold(dockerConfigHost(server), host) {
+			continue
+		}
+		if entry.IdentityToken != "" {
+			return "", "", fmt.Errorf("identity token in %s is not supported, use username and password", path)
+		}
+		if entry.Auth == "" {
+			return entry.Username, entry.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth of %s in %s: %w", server, path, err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", "", fmt.Errorf("invalid auth of %s in %s, expect username:password", server, path)
+		}
+		return username, password, nil
+	}
+
+	if helper := dockerConfig.CredHelpers[host]; helper != "" {
+		return credentialHelperGet(ctx, helper, host)
+	}
+	if dockerConfig.CredsStore != "" {
+		return credentialHelperGet(ctx, dockerConfig.CredsStore, host)
+	}
+	log.Printf("[ Registry ] No credentials for %s in %s, pull anonymously", host, path)
+	return "", "", nil
+}
+
+// dockerConfigHost auths 的 key 可以是 https://host/v1/ 等形式
+func dockerConfigHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ := strings.Cut(server, "/")
+	return host
+}
+
+// credentialHelperGet 调用 docker-credential-<helper> get, 没有凭据时匿名访问
+func credentialHelperGet(ctx context.Context, helper string, host string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			log.Printf("[ Registry ] docker-credential-%s has no credentials for %s, pull anonymously", helper, host)
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("docker-credential-%s get: %w: %s", helper, err, message)
+	}
+
+	var credentials struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &credentials); err != nil {
+		return "", "", fmt.Errorf("invalid output of docker-credential-%s: %w", helper, err)
+	}
+	if credentials.Username == "<token>" {
+		return "", "", fmt.Errorf("identity token from docker-credential-%s is not supported", helper)
+	}
+	return credentials.Username, credentials.Secret, nil
+}
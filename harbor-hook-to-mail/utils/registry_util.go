@@ -0,0 +1,444 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/exyb/harbor-hook-to-mail/config"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// DecryptRegistryConfig 复制 registry 配置并解密各个 registry 的密码, 检查 CA 证书能否读取
+func DecryptRegistryConfig(registryConfig RegistryConfig) (*RegistryConfig, error) {
+	password, err := DecryptPassword(registryConfig.Registry.Auth.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt registry password: %w", err)
+	}
+	registryConfig.Registry.Auth.Password = password
+
+	registries := make([]RegistryHost, 0, len(registryConfig.Registries))
+	for _, registry := range registryConfig.Registries {
+		if registry.Auth.Password, err = DecryptPassword(registry.Auth.Password); err != nil {
+			return nil, fmt.Errorf("failed to decrypt password of registry %s: %w", registry.Host, err)
+		}
+		if _, err := registryTLSConfig(registry); err != nil {
+			return nil, err
+		}
+		registries = append(registries, registry)
+	}
+	registryConfig.Registries = registries
+	return &registryConfig, nil
+}
+
+// ImageReference 镜像地址, e.g. harbor.example.com/build-hook/demo-app:test_20240630120000
+type ImageReference struct {
+	Host       string
+	Repository string
+	// tag 或者 digest
+	Reference string
+}
+
+func (ref *ImageReference) String() string {
+	if strings.HasPrefix(ref.Reference, "sha256:") {
+		return fmt.Sprintf("%s/%s@%s", ref.Host, ref.Repository, ref.Reference)
+	}
+	return fmt.Sprintf("%s/%s:%s", ref.Host, ref.Repository, ref.Reference)
+}
+
+func ParseImageReference(image string) (*ImageReference, error) {
+	image = strings.TrimPrefix(strings.TrimPrefix(image, "https://"), "http://")
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) < 2 || !(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return nil, fmt.Errorf("image %s has no registry host", image)
+	}
+	ref := &ImageReference{Host: parts[0]}
+
+	repository := parts[1]
+	if i := strings.Index(repository, "@"); i >= 0 {
+		ref.Repository, ref.Reference = repository[:i], repository[i+1:]
+	} else if i := strings.LastIndex(repository, ":"); i >= 0 && !strings.Contains(repository[i:], "/") {
+		ref.Repository, ref.Reference = repository[:i], repository[i+1:]
+	} else {
+		ref.Repository, ref.Reference = repository, "latest"
+	}
+	if ref.Repository == "" || ref.Reference == "" {
+		return nil, fmt.Errorf("invalid image reference %s", image)
+	}
+	return ref, nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	// manifest list / image index
+	Manifests []descriptor `json:"manifests"`
+}
+
+// RegistryClient 通过 Registry v2 API 直接读取镜像内容, 不依赖 Docker daemon
+type RegistryClient struct {
+	Scheme   string
+	Username string
+	Password string
+	Client   *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func NewRegistryClient(scheme string, username string, password string) *RegistryClient {
+	if scheme == "" {
+		scheme = "https"
+	}
+	return &RegistryClient{
+		Scheme:   scheme,
+		Username: username,
+		Password: password,
+		Client:   &http.Client{Timeout: 10 * time.Minute},
+		tokens:   make(map[string]string),
+	}
+}
+
+// ExtractFiles 自顶向下遍历镜像各层, 一次性取出 files 中的文件 (镜像内路径 -> 本地路径),
+// 返回镜像中不存在 (或被 whiteout 删除) 的文件列表
+func (c *RegistryClient) ExtractFiles(ctx context.Context, ref *ImageReference, files map[string]string) ([]string, error) {
+	m, err := c.getManifest(ctx, ref, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]string, len(files))
+	for containerPath, localPath := range files {
+		pending[cleanLayerPath(containerPath)] = localPath
+	}
+
+	missing := make([]string, 0)
+	for i := len(m.Layers) - 1; i >= 0 && len(pending) > 0; i-- {
+		removed, err := c.extractFromLayer(ctx, ref, m.Layers[i], pending)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", m.Layers[i].Digest, err)
+		}
+		missing = append(missing, removed...)
+	}
+
+	for p := range pending {
+		missing = append(missing, "/"+p)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// extractFromLayer 取出本层中的文件, 返回被本层 whiteout 删除的文件
+func (c *RegistryClient) extractFromLayer(ctx context.Context, ref *ImageReference, layer descriptor, pending map[string]string) ([]string, error) {
+	body, err := c.get(ctx, ref, "/blobs/"+layer.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	reader, err := decompress(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 本层的 whiteout 只对下层生效, 本层内的同名文件优先
+	var whiteouts, opaqueDirs []string
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		name := cleanLayerPath(header.Name)
+		dir, base := path.Split(name)
+		if base == whiteoutOpaque {
+			opaqueDirs = append(opaqueDirs, strings.TrimSuffix(dir, "/"))
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whiteouts = append(whiteouts, dir+strings.TrimPrefix(base, whiteoutPrefix))
+			continue
+		}
+
+		localPath, ok := pending[name]
+		if !ok {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%s is not a regular file", header.Name)
+		}
+		if err := writeLocalFile(localPath, tarReader); err != nil {
+			return nil, err
+		}
+		log.Printf("[ Registry ] File /%s extracted from %s to %s", name, ref, localPath)
+		delete(pending, name)
+	}
+
+	var removed []string
+	for name := range pending {
+		if isHiddenBy(name, whiteouts, opaqueDirs) {
+			log.Printf("[ Registry ] File /%s removed by whiteout in layer %s", name, layer.Digest)
+			removed = append(removed, "/"+name)
+			delete(pending, name)
+		}
+	}
+	return removed, nil
+}
+
+func (c *RegistryClient) getManifest(ctx context.Context, ref *ImageReference, reference string) (*manifest, error) {
+	accept := strings.Join([]string{mediaTypeOCIManifest, mediaTypeDockerManifest, mediaTypeOCIIndex, mediaTypeDockerManifestList}, ", ")
+	body, err := c.get(ctx, ref, "/manifests/"+reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	m := &manifest{}
+	if err := json.NewDecoder(body).Decode(m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest of %s: %w", ref, err)
+	}
+	if len(m.Manifests) == 0 {
+		return m, nil
+	}
+
+	// 多架构镜像, 优先选择当前架构
+	selected := m.Manifests[0]
+	for _, d := range m.Manifests {
+		if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+			selected = d
+			break
+		}
+	}
+	return c.getManifest(ctx, ref, selected.Digest)
+}
+
+func (c *RegistryClient) get(ctx context.Context, ref *ImageReference, resource string, accept string) (io.ReadCloser, error) {
+	endpoint := fmt.Sprintf("%s://%s/v2/%s%s", c.Scheme, ref.Host, ref.Repository, resource)
+	scope := fmt.Sprintf("repository:%s:pull", ref.Repository)
+
+	resp, err := c.do(ctx, endpoint, accept, c.authorization(scope))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		auth, err := c.authenticate(ctx, challenge, scope)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = c.do(ctx, endpoint, accept, auth); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected status %s", endpoint, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (c *RegistryClient) do(ctx context.Context, endpoint string, accept string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", endpoint, err)
+	}
+	return resp, nil
+}
+
+func (c *RegistryClient) authorization(scope string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[scope]
+}
+
+// authenticate 按照 WWW-Authenticate 响应头完成 Basic 或 Bearer token 认证
+func (c *RegistryClient) authenticate(ctx context.Context, challenge string, scope string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	var auth string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	case "bearer":
+		token, err := c.fetchToken(ctx, params, scope)
+		if err != nil {
+			return "", err
+		}
+		auth = "Bearer " + token
+	default:
+		return "", fmt.Errorf("unsupported auth challenge: %q", challenge)
+	}
+
+	c.mu.Lock()
+	c.tokens[scope] = auth
+	c.mu.Unlock()
+	return auth, nil
+}
+
+func (c *RegistryClient) fetchToken(ctx context.Context, params map[string]string, scope string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request token: unexpected status %s", resp.Status)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	if tokenResponse.AccessToken != "" {
+		return tokenResponse.AccessToken, nil
+	}
+	return "", fmt.Errorf("empty token in token response")
+}
+
+// parseChallenge 解析 `Bearer realm="...",service="...",scope="..."`
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for _, pair := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok {
+			params[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return scheme, params
+}
+
+// decompress 根据内容判断层是否为 gzip 压缩
+func decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read layer: %w", err)
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+func cleanLayerPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func isHiddenBy(name string, whiteouts []string, opaqueDirs []string) bool {
+	for _, w := range whiteouts {
+		if name == w || strings.HasPrefix(name, w+"/") {
+			return true
+		}
+	}
+	for _, dir := range opaqueDirs {
+		if dir == "" || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeLocalFile(localPath string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating local directory: %w", err)
+	}
+	file, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("failed to write file content: %w", err)
+	}
+	return nil
+}
+
+// ExtractFilesFromImage 按镜像地址从 registryConfig 中选择 registry 的凭据和证书, 从镜像中读取文件
+func ExtractFilesFromImage(registryConfig *RegistryConfig, imageName string, files map[string]string) ([]string, error) {
+	ref, err := ParseImageReference(imageName)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	client, err := NewRegistryClientFor(ctx, registryConfig.ForHost(ref.Host))
+	if err != nil {
+		return nil, err
+	}
+	return client.ExtractFiles(ctx, ref, files)
+}
@@ -0,0 +1,238 @@
+package workdir
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 文件名中保留的最大长度, 超过时截断
+const maxNameLength = 100
+
+type Options struct {
+	// 超过 Retention 没有修改的事件目录被清理, 0 表示不按时间清理
+	Retention time.Duration
+	// 目录总大小上限, 超过时从最久没有修改的事件目录开始清理, 0 表示不限制
+	MaxSize int64
+	// 清理的检查间隔
+	Interval time.Duration
+	// 最近 MinAge 内修改的目录可能正在处理, 超过大小上限时也不清理
+	MinAge time.Duration
+}
+
+// WorkDir 事件处理的工作目录, 每个事件一个子目录 <namespace>/<name>/<tag>-<id>, 后台按保留时间和大小上限清理
+type WorkDir struct {
+	// 返回仍在使用的文件, e.g. 待发送通知的附件, 所在的事件目录不会被清理. 返回错误时跳过本次清理
+	InUse func() ([]string, error)
+
+	root    string
+	options Options
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(root string, options Options) (*WorkDir, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create work dir: %w", err)
+	}
+	if options.Interval <= 0 {
+		options.Interval = 10 * time.Minute
+	}
+	return &WorkDir{root: root, options: options}, nil
+}
+
+func (w *WorkDir) Root() string {
+	return w.root
+}
+
+// Sanitize 把 webhook 中的名称转换为安全的文件名, 只保留字母, 数字, '.', '-', '_', 不会是 . 或 ..
+func Sanitize(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+		if b.Len() >= maxNameLength {
+			break
+		}
+	}
+	sanitized := strings.TrimLeft(b.String(), ".")
+	if sanitized == "" {
+		return "_"
+	}
+	return sanitized
+}
+
+// EventDir 创建事件的目录, id 为 0 时 (e.g. replay) 使用当前时间区分
+func (w *WorkDir) EventDir(namespace string, name string, tag string, id uint64) (string, error) {
+	suffix := fmt.Sprintf("%d", id)
+	if id == 0 {
+		suffix = fmt.Sprintf("t%d", time.Now().UnixNano())
+	}
+	dir := filepath.Join(w.root, Sanitize(namespace), Sanitize(name), Sanitize(tag)+"-"+suffix)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create event dir: %w", err)
+	}
+	return dir, nil
+}
+
+// Start 启动后台清理
+func (w *WorkDir) Start() {
+	if w.options.Retention <= 0 && w.options.MaxSize <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			if removed, freed, err := w.Cleanup(time.Now()); err != nil {
+				log.Printf("[ WorkDir ] Failed to clean up %s: %v", w.root, err)
+			} else if removed > 0 {
+				log.Printf("[ WorkDir ] Removed %d event dirs, freed %d bytes", removed, freed)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.options.Interval):
+			}
+		}
+	}()
+}
+
+// Stop 停止后台清理
+func (w *WorkDir) Stop() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.wg.Wait()
+}
+
+type eventDir struct {
+	path    string
+	modTime time.Time
+	size    int64
+	inUse   bool
+}
+
+// Cleanup 清理超过保留时间的事件目录, 总大小仍然超过上限时从最久没有修改的目录开始清理, 返回清理的目录数和释放的字节数
+func (w *WorkDir) Cleanup(now time.Time) (int, int64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var inUse []string
+	if w.InUse != nil {
+		var err error
+		if inUse, err = w.InUse(); err != nil {
+			return 0, 0, fmt.Errorf("failed to list files in use: %w", err)
+		}
+	}
+	dirs, err := w.eventDirs(inUse)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total int64
+	for _, dir := range dirs {
+		total += dir.size
+	}
+	removed, freed := 0, int64(0)
+	remove := func(dir *eventDir) {
+		if err := os.RemoveAll(dir.path); err != nil {
+			log.Printf("[ WorkDir ] Failed to remove %s: %v", dir.path, err)
+			return
+		}
+		removed++
+		freed += dir.size
+		total -= dir.size
+		// 删除空的 namespace 和 name 目录
+		for parent := filepath.Dir(dir.path); parent != w.root; parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+
+	// dirs 按修改时间从旧到新排序
+	kept := dirs[:0]
+	for _, dir := range dirs {
+		if !dir.inUse && w.options.Retention > 0 && now.Sub(dir.modTime) > w.options.Retention {
+			remove(dir)
+			continue
+		}
+		kept = append(kept, dir)
+	}
+	for _, dir := range kept {
+		if w.options.MaxSize <= 0 || total <= w.options.MaxSize {
+			break
+		}
+		if !dir.inUse && now.Sub(dir.modTime) > w.options.MinAge {
+			remove(dir)
+		}
+	}
+	return removed, freed, nil
+}
+
+// eventDirs 列出 <namespace>/<name>/<event> 三层的事件目录, 修改时间取目录中最新的文件
+func (w *WorkDir) eventDirs(inUse []string) ([]*eventDir, error) {
+	matches, err := filepath.Glob(filepath.Join(w.root, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	dirs := make([]*eventDir, 0, len(matches))
+	for _, path := range matches {
+		info, err := os.Lstat(path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		dir := &eventDir{path: path, modTime: info.ModTime()}
+		err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() {
+				dir.size += info.Size()
+			}
+			if info.ModTime().After(dir.modTime) {
+				dir.modTime = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ WorkDir ] Failed to scan %s: %v", path, err)
+			continue
+		}
+		for _, file := range inUse {
+			if strings.HasPrefix(file, path+string(filepath.Separator)) {
+				dir.inUse = true
+				break
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].modTime.Before(dirs[j].modTime)
+	})
+	return dirs, nil
+}